@@ -1,12 +1,12 @@
 package commander
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
 	"os/exec"
+	"time"
 )
 
 func split(data []byte, atEOF bool) (advance int, token []byte, spliterror error) {
@@ -30,19 +30,30 @@ func split(data []byte, atEOF bool) (advance int, token []byte, spliterror error
 	return 0, nil, nil
 }
 
+// DefaultGracePeriod time which a stopped process has to exit by itself before it is killed
+const DefaultGracePeriod = 10 * time.Second
+
+// ErrStopped cause of cancellation when Stop is called
+var ErrStopped = errors.New("command is stopped")
+
 type Commander struct {
 	command   string
 	args      []string
-	outStream io.ReadCloser
-	errStream io.ReadCloser
+	outLines  *lineQueue // lines of stdout for StdoutLogs
+	errLines  *lineQueue // lines of stderr for StderrLogs
+	tailLines int        // number of the last lines of stderr which are kept for errors
 	cmd       *exec.Cmd
 	isRunning bool
+	grace     time.Duration
+	cancel    context.CancelCauseFunc // cancel the running command, nil if it is not started
 }
 
 func New(command string, args ...string) Commander {
 	return Commander{
-		command: command,
-		args:    args,
+		command:   command,
+		args:      args,
+		grace:     DefaultGracePeriod,
+		tailLines: DefaultTailLines,
 	}
 }
 
@@ -54,8 +65,25 @@ func (c *Commander) SetArgs(args []string) {
 	c.args = args
 }
 
+// SetGracePeriod set time which a stopped process has to exit by itself before it is killed
+func (c *Commander) SetGracePeriod(grace time.Duration) {
+	c.grace = grace
+}
+
+// SetTailLines set number of the last lines of stderr which are kept for errors
+func (c *Commander) SetTailLines(n int) {
+	c.tailLines = n
+}
+
 func (c *Commander) Run() chan error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext start the command, it is stopped when ctx is done
+// done receives nil if the command succeeds, otherwise an *Error which tells cancellation, timeout and failure apart
+func (c *Commander) RunContext(ctx context.Context) chan error {
 	done := make(chan error, 1)
+	c.outLines, c.errLines = nil, nil
 	if c.command == "" {
 		done <- errors.New("cannot run without command")
 		close(done)
@@ -68,13 +96,16 @@ func (c *Commander) Run() chan error {
 	}
 
 	cmd := exec.Command(c.command, c.args...)
+	// the whole group is killed if the process doesn't exit in grace period
+	setProcessGroup(cmd)
 	errStream, err := cmd.StderrPipe()
 	if err != nil {
 		done <- err
 		close(done)
 		return done
 	}
-	c.errStream = errStream
+	errLines, tail, errDone := newLineQueue(), newRingBuffer(c.tailLines), make(chan struct{})
+	c.errLines = errLines
 
 	outStream, err := cmd.StdoutPipe()
 	if err != nil {
@@ -82,93 +113,96 @@ func (c *Commander) Run() chan error {
 		close(done)
 		return done
 	}
-	c.outStream = outStream
+	outLines, outDone := newLineQueue(), make(chan struct{})
+	c.outLines = outLines
 
+	// ffmpeg quits gracefully when it reads q
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		done <- err
+		close(done)
+		return done
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	c.cancel = cancel
 	err = cmd.Start()
 	c.cmd = cmd
 	go func(err error) {
 		c.isRunning = true
-		defer func() {
+		// the command is not running when done receives
+		finish := func(err error) {
 			c.isRunning = false
-		}()
-		if err != nil {
-			var outb bytes.Buffer
-			io.Copy(&outb, outStream)
-			done <- fmt.Errorf("failed start %s (%s) with %s, message %s", c.command, c.args, err, outb.String())
+			cancel(nil)
+			done <- err
 			close(done)
+		}
+		if err != nil {
+			errLines.close()
+			outLines.close()
+			finish(&Error{Kind: Failed, Command: c.command, Args: c.args, Err: err})
 			return
 		}
 
-		err = cmd.Wait()
+		go readLines(errStream, tail, errLines, errDone)
+		go readLines(outStream, nil, outLines, outDone)
+		exited := make(chan error, 1)
+		go func() {
+			// wait closes the pipes, so they are read to the end first
+			<-errDone
+			<-outDone
+			exited <- cmd.Wait()
+		}()
 
-		if err != nil {
-			if err.Error() != "signal: killed" {
-				var outb bytes.Buffer
-				io.Copy(&outb, outStream)
-				err = fmt.Errorf("failed finish %s (%s) with %s message %s", c.command, c.args, err, outb.String())
-			} else {
-				err = nil
+		select {
+		case err = <-exited:
+			if err != nil {
+				err = &Error{Kind: Failed, Command: c.command, Args: c.args, Err: err, Stderr: tail.Lines()}
 			}
+		case <-ctx.Done():
+			errLines.drop()
+			outLines.drop()
+			killed := c.terminate(stdin, exited)
+			e := ContextError(ctx, c.command, c.args)
+			e.Killed, e.Stderr = killed, tail.Lines()
+			err = e
 		}
-		done <- err
-		close(done)
+		finish(err)
 	}(err)
 
 	return done
 }
 
+// terminate ask the process to quit by q and SIGINT, its group is killed if it doesn't exit in grace period
+// return true if it is killed
+func (c *Commander) terminate(stdin io.Writer, exited chan error) bool {
+	stdin.Write([]byte("q"))
+	interrupt(c.cmd.Process)
+	select {
+	case <-exited:
+		return false
+	case <-time.After(c.grace):
+		killGroup(c.cmd.Process)
+		<-exited
+		return true
+	}
+}
+
+// Stop stop the running command gracefully, done of Run receives an *Error of Canceled kind with ErrStopped
 func (c *Commander) Stop() error {
-	return c.cmd.Process.Kill()
+	if c.cancel == nil {
+		return errors.New("command is not started")
+	}
+	c.cancel(ErrStopped)
+	return nil
 }
 
+// StderrLogs lines of stderr of the running command, the last lines which are written before this call are kept for it
 func (c *Commander) StderrLogs() chan string {
-	out := make(chan string)
-
-	go func() {
-		defer close(out)
-		if c.errStream == nil {
-			out <- ""
-			return
-		}
-		defer c.errStream.Close()
-
-		scanner := bufio.NewScanner(c.errStream)
-
-		scanner.Split(split)
-		buf := make([]byte, 2)
-		scanner.Buffer(buf, bufio.MaxScanTokenSize)
-
-		for scanner.Scan() {
-			line := scanner.Text()
-			out <- line
-		}
-	}()
-
-	return out
+	return c.errLines.logs()
 }
 
+// StdoutLogs lines of stdout of the running command, it is closed at the end of stdout
 func (c *Commander) StdoutLogs() chan string {
-	out := make(chan string)
-
-	go func() {
-		defer close(out)
-		if c.outStream == nil {
-			out <- ""
-			return
-		}
-		defer c.outStream.Close()
-
-		scanner := bufio.NewScanner(c.outStream)
-
-		scanner.Split(split)
-		buf := make([]byte, 2)
-		scanner.Buffer(buf, bufio.MaxScanTokenSize)
-
-		for scanner.Scan() {
-			line := scanner.Text()
-			out <- line
-		}
-	}()
-
-	return out
+	return c.outLines.logs()
 }
@@ -0,0 +1,122 @@
+package commander
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommander_Stop(t *testing.T) {
+	c := New("sleep", "5")
+	done := c.Run()
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, c.Stop())
+	err := <-done
+	assert.True(t, IsKind(err, Canceled))
+	assert.True(t, errors.Is(err, ErrStopped))
+	assert.False(t, err.(*Error).Killed)
+
+	c = New("sh", "-c", "exit 1")
+	err = <-c.Run()
+	assert.True(t, IsKind(err, Failed))
+
+	c = New("true", "ok")
+	assert.Nil(t, <-c.Run())
+}
+
+func TestCommander_Timeout(t *testing.T) {
+	// the shell and its child ignore interrupt, so the group is killed after grace period
+	c := New("sh", "-c", "trap '' INT; sleep 5; sleep 5")
+	c.SetGracePeriod(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := <-c.RunContext(ctx)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.True(t, IsKind(err, Timeout))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, err.(*Error).Killed)
+}
+
+func TestCommander_StderrTail(t *testing.T) {
+	c := New("sh", "-c", "echo one >&2; echo two >&2; echo three >&2; exit 3")
+	c.SetTailLines(2)
+	done := c.Run()
+	var lines []string
+	for line := range c.StderrLogs() {
+		lines = append(lines, line)
+	}
+	err := <-done
+	assert.Equal(t, []string{"one", "two", "three"}, lines)
+	assert.True(t, IsKind(err, Failed))
+	assert.Equal(t, []string{"two", "three"}, err.(*Error).Stderr)
+
+	// stderr is read even if nobody reads logs
+	c = New("sh", "-c", "echo failed >&2; exit 1")
+	err = <-c.Run()
+	assert.Equal(t, []string{"failed"}, err.(*Error).Stderr)
+
+	r := newRingBuffer(3)
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		r.add(line)
+	}
+	assert.Equal(t, []string{"c", "d", "e"}, r.Lines())
+}
+
+func TestCommander_StdoutEnd(t *testing.T) {
+	// the process is waited after stdout ends, so the last lines are kept for a late reader
+	c := New("sh", "-c", "echo frame=1; echo progress=end")
+	assert.Nil(t, <-c.Run())
+	var lines []string
+	for line := range c.StdoutLogs() {
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{"frame=1", "progress=end"}, lines)
+}
+
+func TestLineQueue_Bound(t *testing.T) {
+	// an unread stream keeps only its last lines
+	q := newLineQueue()
+	q.size = 2
+	for _, line := range []string{"a", "b", "c"} {
+		q.push(line)
+	}
+	q.close()
+	var lines []string
+	for line := range q.logs() {
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{"b", "c"}, lines)
+
+	// a read stream waits for the reader instead of dropping lines
+	q = newLineQueue()
+	q.size = 1
+	logs := q.logs()
+	pushed := make(chan struct{})
+	go func() {
+		for _, line := range []string{"a", "b", "c"} {
+			q.push(line)
+		}
+		q.close()
+		close(pushed)
+	}()
+	lines = nil
+	for line := range logs {
+		lines = append(lines, line)
+	}
+	<-pushed
+	assert.Equal(t, []string{"a", "b", "c"}, lines)
+
+	// a stopped process doesn't wait for a reader which is gone
+	q = newLineQueue()
+	q.size = 1
+	q.logs()
+	q.push("a")
+	q.push("b")
+	q.drop()
+	q.push("c")
+	q.push("d")
+}
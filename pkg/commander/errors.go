@@ -0,0 +1,59 @@
+package commander
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorKind reason why a command doesn't succeed
+type ErrorKind string
+
+const (
+	Failed   ErrorKind = "failed"   // the process exits with an error by itself
+	Canceled ErrorKind = "canceled" // context is canceled or Stop is called
+	Timeout  ErrorKind = "timeout"  // deadline of context is exceeded
+)
+
+// Error error of a command which doesn't succeed
+// Err is the error of process for failure, or the cause of context for cancellation and timeout,
+// so errors.Is(err, context.Canceled) and errors.Is(err, ErrStopped) work
+type Error struct {
+	Kind    ErrorKind
+	Command string
+	Args    []string
+	Err     error
+	Stderr  []string // the last lines of stderr
+	Killed  bool     // process didn't exit in grace period and its group was killed
+}
+
+func (e *Error) Error() string {
+	switch e.Kind {
+	case Failed:
+		return fmt.Sprintf("failed %s (%s) with %s message %s", e.Command, e.Args, e.Err, strings.Join(e.Stderr, "\n"))
+	default:
+		return fmt.Sprintf("%s %s (%s) by %s, killed %t", e.Kind, e.Command, e.Args, e.Err, e.Killed)
+	}
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// IsKind check if err is an *Error of kind
+func IsKind(err error, kind ErrorKind) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Kind == kind
+}
+
+// ContextError the error of a command which is stopped because ctx is done
+// it is of Timeout kind if deadline of ctx is exceeded, otherwise of Canceled kind
+func ContextError(ctx context.Context, command string, args []string) *Error {
+	cause := context.Cause(ctx)
+	kind := Canceled
+	if errors.Is(cause, context.DeadlineExceeded) {
+		kind = Timeout
+	}
+	return &Error{Kind: kind, Command: command, Args: args, Err: cause}
+}
@@ -0,0 +1,157 @@
+package commander
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// DefaultTailLines number of the last lines of stderr which are kept for errors
+const DefaultTailLines = 30
+
+// ringBuffer the last lines which are added, it is safe for concurrent use
+type ringBuffer struct {
+	mu    sync.Mutex
+	lines []string
+	start int // index of the oldest line when buffer is full
+	size  int
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{lines: make([]string, 0, size), size: size}
+}
+
+func (r *ringBuffer) add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.size <= 0 {
+		return
+	}
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.start] = line
+	r.start = (r.start + 1) % r.size
+}
+
+// Lines the lines in order of adding
+func (r *ringBuffer) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines := make([]string, 0, len(r.lines))
+	lines = append(lines, r.lines[r.start:]...)
+	return append(lines, r.lines[:r.start]...)
+}
+
+// queueLines number of lines of an output stream which are kept until they are read
+const queueLines = 1024
+
+// lineQueue lines of an output stream which are waiting to be read, it is closed at the end of stream
+// it keeps at most queueLines lines, the oldest line is dropped when it is full and nobody reads it,
+// and push waits for room while it is read, so a slow reader slows the process instead of growing the queue
+type lineQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	lines   []string
+	size    int
+	reading bool // logs is called
+	dropped bool // the process is stopped, lines are dropped instead of waiting for the reader
+	closed  bool
+}
+
+func newLineQueue() *lineQueue {
+	q := &lineQueue{size: queueLines}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *lineQueue) push(line string) {
+	q.mu.Lock()
+	for q.reading && !q.dropped && len(q.lines) >= q.size {
+		q.cond.Wait()
+	}
+	if len(q.lines) >= q.size {
+		q.lines = q.lines[1:]
+	}
+	q.lines = append(q.lines, line)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *lineQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// drop stop waiting for the reader, so a stopped process can exit even if its logs are not read anymore
+func (q *lineQueue) drop() {
+	q.mu.Lock()
+	q.dropped = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+// pop wait for the next line, ok is false if queue is closed and empty
+func (q *lineQueue) pop() (line string, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.lines) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.lines) == 0 {
+		return "", false
+	}
+	line = q.lines[0]
+	q.lines = q.lines[1:]
+	q.cond.Broadcast()
+	return line, true
+}
+
+// logs send the queued lines to a channel, it is closed when queue is closed and empty
+// a nil queue of a command which is not started sends an empty line
+func (q *lineQueue) logs() chan string {
+	out := make(chan string)
+	if q != nil {
+		q.mu.Lock()
+		q.reading = true
+		q.mu.Unlock()
+	}
+	go func() {
+		defer close(out)
+		if q == nil {
+			out <- ""
+			return
+		}
+		for {
+			line, ok := q.pop()
+			if !ok {
+				return
+			}
+			out <- line
+		}
+	}()
+	return out
+}
+
+// readLines read stream to the end, so the output is complete before the process is waited
+// lines are kept in tail if it is not nil and queued until they are read, see lineQueue for its bound
+func readLines(stream io.Reader, tail *ringBuffer, queue *lineQueue, done chan struct{}) {
+	defer close(done)
+	defer queue.close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Split(split)
+	buf := make([]byte, 2)
+	scanner.Buffer(buf, bufio.MaxScanTokenSize)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if tail != nil {
+			tail.add(line)
+		}
+		queue.push(line)
+	}
+}
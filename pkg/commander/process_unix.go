@@ -0,0 +1,23 @@
+//go:build !windows
+
+package commander
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup run the command in a new process group, so its children can be killed with it
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func interrupt(p *os.Process) error {
+	return p.Signal(os.Interrupt)
+}
+
+// killGroup kill the process group which p leads
+func killGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
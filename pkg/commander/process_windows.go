@@ -0,0 +1,19 @@
+//go:build windows
+
+package commander
+
+import (
+	"os"
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// interrupt windows has no interrupt signal for processes, they are asked to quit by stdin only
+func interrupt(p *os.Process) error {
+	return nil
+}
+
+func killGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -46,16 +46,22 @@ type KafkaConfig struct {
 }
 
 type ServerConfig struct {
-	FfmpegBin                        string `json:"ffmpeg_bin" mapstructure:"ffmpeg_bin"`
-	FfprobeBin                       string `json:"ffprobe_bin" mapstructure:"ffprobe_bin"`
-	OutputPath                       string `json:"output_path" mapstructure:"output_path"`
-	DownloadPath                     string `json:"download_path" mapstructure:"download_path"`
-	ClearAfterStream                 bool   `json:"clear_after_stream" mapstructure:"clear_after_stream"`
-	TranscoderVersion                int    `json:"transcoder_version" mapstructure:"transcoder_version"`
-	GoogleCloudBucket                string `json:"google_cloud_bucket" mapstructure:"google_cloud_bucket"`
-	GoogleCloudStorageCredentialPath string `json:"google_cloud_storage_credential_path" mapstructure:"google_cloud_storage_credential_path"`
-	GoogleDriveCredentialPath        string `json:"google_drive_credential_path" mapstructure:"google_drive_credential_path"`
-	Default1080Bitrate               int64  `json:"default_1080_bitrate" mapstructure:"default_1080_bitrate"`
-	IgnoreBitrateThreshold           int64  `json:"ignore_bitrate_threshold" mapstructure:"ignore_bitrate_threshold"`
-	TargetSegmentDuration            int    `json:"target_segment_duration" mapstructure:"target_segment_duration"`
+	FfmpegBin                        string  `json:"ffmpeg_bin" mapstructure:"ffmpeg_bin"`
+	FfprobeBin                       string  `json:"ffprobe_bin" mapstructure:"ffprobe_bin"`
+	OutputPath                       string  `json:"output_path" mapstructure:"output_path"`
+	DownloadPath                     string  `json:"download_path" mapstructure:"download_path"`
+	ClearAfterStream                 bool    `json:"clear_after_stream" mapstructure:"clear_after_stream"`
+	TranscoderVersion                int     `json:"transcoder_version" mapstructure:"transcoder_version"`
+	GoogleCloudBucket                string  `json:"google_cloud_bucket" mapstructure:"google_cloud_bucket"`
+	GoogleCloudStorageCredentialPath string  `json:"google_cloud_storage_credential_path" mapstructure:"google_cloud_storage_credential_path"`
+	GoogleDriveCredentialPath        string  `json:"google_drive_credential_path" mapstructure:"google_drive_credential_path"`
+	Default1080Bitrate               int64   `json:"default_1080_bitrate" mapstructure:"default_1080_bitrate"`
+	IgnoreBitrateThreshold           int64   `json:"ignore_bitrate_threshold" mapstructure:"ignore_bitrate_threshold"`
+	TargetSegmentDuration            int     `json:"target_segment_duration" mapstructure:"target_segment_duration"`
+	Encoder                          string  `json:"encoder" mapstructure:"encoder"`                     // nvenc or software, default is nvenc
+	PlaylistTemplate                 string  `json:"playlist_template" mapstructure:"playlist_template"` // eg: {res}p/index.m3u8, default is stream_{v}.m3u8
+	SegmentTemplate                  string  `json:"segment_template" mapstructure:"segment_template"`   // eg: {res}p/seg_{n:05}.ts, default is stream_{v}/data{n:02}.ts
+	StallTimeout                     int     `json:"stall_timeout" mapstructure:"stall_timeout"`         // secs without progress or output before ffmpeg or ffprobe is aborted, default is 120, negative disables it
+	MinSpeed                         float64 `json:"min_speed" mapstructure:"min_speed"`                 // min speed of encoding, 0 disables it
+	SlowTimeout                      int     `json:"slow_timeout" mapstructure:"slow_timeout"`           // secs which speed can stay below min speed, default is 60
 }
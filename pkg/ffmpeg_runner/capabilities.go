@@ -0,0 +1,125 @@
+package ffmpegrunner
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	capabilitiesMu    sync.Mutex
+	capabilitiesCache = make(map[string]*Capabilities) // ffmpeg bin => capabilities
+)
+
+// Capabilities encoders, hardware accelerations and filters supported by an ffmpeg binary
+type Capabilities struct {
+	Encoders []string `json:"encoders"`
+	HWAccels []string `json:"hwaccels"`
+	Filters  []string `json:"filters"`
+}
+
+func (c *Capabilities) HasEncoder(name string) bool {
+	return slices.Contains(c.Encoders, name)
+}
+
+func (c *Capabilities) HasHWAccel(name string) bool {
+	return slices.Contains(c.HWAccels, name)
+}
+
+func (c *Capabilities) HasFilter(name string) bool {
+	return slices.Contains(c.Filters, name)
+}
+
+// Capabilities probe ffmpeg binary for what it supports
+// the binary is probed only once, later calls return the cached result
+func (r *FfmpegRunner) Capabilities() (*Capabilities, error) {
+	capabilitiesMu.Lock()
+	defer capabilitiesMu.Unlock()
+
+	if c, ok := capabilitiesCache[r.ffmpegBin]; ok {
+		return c, nil
+	}
+
+	c := &Capabilities{}
+	out, err := r.probe("-encoders")
+	if err != nil {
+		return nil, err
+	}
+	c.Encoders = parseEncoders(out)
+
+	out, err = r.probe("-hwaccels")
+	if err != nil {
+		return nil, err
+	}
+	c.HWAccels = parseHWAccels(out)
+
+	out, err = r.probe("-filters")
+	if err != nil {
+		return nil, err
+	}
+	c.Filters = parseFilters(out)
+
+	capabilitiesCache[r.ffmpegBin] = c
+	return c, nil
+}
+
+func (r *FfmpegRunner) probe(option string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(r.ffmpegBin, "-hide_banner", option)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("cannot probe %s %s: %w, message %s", r.ffmpegBin, option, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// parseEncoders parse output of ffmpeg -encoders
+// encoders are listed after the legend, eg: " V....D libx264   libx264 H.264 / AVC / MPEG-4 AVC"
+func parseEncoders(out string) []string {
+	var encoders []string
+	started := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "---") {
+			started = true
+			continue
+		}
+		if started && len(fields) > 1 {
+			encoders = append(encoders, fields[1])
+		}
+	}
+	return encoders
+}
+
+// parseHWAccels parse output of ffmpeg -hwaccels, one method per line after the header
+func parseHWAccels(out string) []string {
+	var hwaccels []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasSuffix(line, ":") {
+			continue
+		}
+		hwaccels = append(hwaccels, line)
+	}
+	return hwaccels
+}
+
+// parseFilters parse output of ffmpeg -filters
+// eg: " ... scale_npp         V->V       NVIDIA CUDA Video Post-processing"
+func parseFilters(out string) []string {
+	var filters []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && strings.Contains(fields[2], "->") {
+			filters = append(filters, fields[1])
+		}
+	}
+	return filters
+}
@@ -0,0 +1,68 @@
+package ffmpegrunner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"transcode/pkg/commander"
+)
+
+// known failures of ffmpeg, a failed run is wrapped with one of them if its stderr tells
+// eg: errors.Is(err, ErrNoSpaceLeft)
+var (
+	ErrInvalidInput     = errors.New("invalid input")
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+	ErrNoSpaceLeft      = errors.New("no space left on device")
+	ErrHWAccelInit      = errors.New("hardware acceleration cannot be initialized")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// failurePatterns messages of stderr for each known failure, in lower case
+// the failures are checked in order, the first one is used if messages of many failures are found
+var failurePatterns = []struct {
+	err      error
+	messages []string
+}{
+	{ErrNoSpaceLeft, []string{"no space left on device", "disk quota exceeded"}},
+	{ErrPermissionDenied, []string{"permission denied", "operation not permitted"}},
+	{ErrHWAccelInit, []string{
+		"device creation failed", "failed setup for format cuda", "no device available for decoder",
+		"cannot load libcuda", "cannot load libnvidia-encode", "cuda_error", "no nvenc capable devices found",
+		"openencodesessionex failed", "hwaccel initialisation returned error", "failed to initialise vaapi",
+	}},
+	{ErrUnsupportedCodec, []string{
+		"unknown encoder", "unknown decoder", "encoder not found", "decoder not found",
+		"codec not currently supported in container", "could not find tag for codec", "unsupported codec",
+	}},
+	{ErrInvalidInput, []string{
+		"invalid data found when processing input", "no such file or directory", "moov atom not found",
+		"does not contain any stream", "could not find codec parameters", "error opening input",
+	}},
+}
+
+// Classify the known failure which lines of stderr tell, nil if there is none
+func Classify(lines []string) error {
+	for _, f := range failurePatterns {
+		for _, line := range lines {
+			line = strings.ToLower(line)
+			for _, m := range f.messages {
+				if strings.Contains(line, m) {
+					return f.err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// classify wrap a failed run with its known failure, so both errors.Is and errors.As of *commander.Error work
+func classify(err error) error {
+	var e *commander.Error
+	if !errors.As(err, &e) || e.Kind != commander.Failed {
+		return err
+	}
+	if known := Classify(e.Stderr); known != nil {
+		return fmt.Errorf("%w: %w", known, err)
+	}
+	return err
+}
@@ -1,8 +1,11 @@
 package ffmpegrunner
 
 import (
+	"context"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 	"transcode/pkg/commander"
 )
 
@@ -10,29 +13,56 @@ var equalAndSpaceRe = regexp.MustCompile(`=\s+`)
 
 type FfmpegRunner struct {
 	commander.Commander
+	ffmpegBin string
+	duration  time.Duration // duration of output, for percentage and eta of progress
 }
 
 func New(ffmpegBin, ffprobeBin string) *FfmpegRunner {
 	return &FfmpegRunner{
 		Commander: commander.New(ffmpegBin),
+		ffmpegBin: ffmpegBin,
 	}
 }
 
 func (r *FfmpegRunner) Run() chan error {
-	return r.Commander.Run()
+	return r.RunContext(context.Background())
 }
 
+// RunContext run ffmpeg, it quits gracefully when ctx is done
+// a failure is wrapped with its known error, eg: ErrHWAccelInit
+func (r *FfmpegRunner) RunContext(ctx context.Context) chan error {
+	done := make(chan error, 1)
+	cmdDone := r.Commander.RunContext(ctx)
+	go func() {
+		done <- classify(<-cmdDone)
+		close(done)
+	}()
+	return done
+}
+
+// SetArgs set args of ffmpeg, progress is reported as key=value blocks to stdout instead of stats lines of stderr
+func (r *FfmpegRunner) SetArgs(args []string) {
+	r.Commander.SetArgs(append([]string{"-progress", "pipe:1", "-nostats"}, args...))
+}
+
+// SetDuration duration of output which percentage and eta of progress are computed from, 0 if it is unknown
+func (r *FfmpegRunner) SetDuration(d time.Duration) {
+	r.duration = d
+}
+
+// Logs the progress blocks of stdout and the log lines of stderr
 func (r *FfmpegRunner) Logs() chan IProgress {
 	out := make(chan IProgress)
-	ls := r.Commander.StderrLogs()
+	errLogs := r.Commander.StderrLogs()
+	outLogs := r.Commander.StdoutLogs()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
 
 	go func() {
-		defer close(out)
+		defer wg.Done()
 
-		for line := range ls {
+		for line := range errLogs {
 			switch progressDetectType(line) {
-			case Frame:
-				out <- r.frameProgress(line)
 			case OpeningFile:
 				out <- r.openingFileProgress(line)
 			default:
@@ -40,55 +70,26 @@ func (r *FfmpegRunner) Logs() chan IProgress {
 			}
 		}
 	}()
+	go func() {
+		defer wg.Done()
 
-	return out
-}
-
-func (r *FfmpegRunner) frameProgress(line string) *FrameProgress {
-	st := equalAndSpaceRe.ReplaceAllString(line, `=`)
-
-	p := NewFrameProgress()
-	f := strings.Fields(st)
-	var framesProcessed string
-	var currentTime string
-	var currentBitrate string
-	var currentSpeed string
-	var fps string
-
-	for j := 0; j < len(f); j++ {
-		field := f[j]
-		fieldSplit := strings.Split(field, "=")
-
-		if len(fieldSplit) > 1 {
-			fieldname := strings.Split(field, "=")[0]
-			fieldvalue := strings.Split(field, "=")[1]
-
-			if fieldname == "frame" {
-				framesProcessed = fieldvalue
-			}
-
-			if fieldname == "time" {
-				currentTime = fieldvalue
-			}
-
-			if fieldname == "bitrate" {
-				currentBitrate = fieldvalue
-			}
-			if fieldname == "speed" {
-				currentSpeed = fieldvalue
-			}
-			if fieldname == "fps" {
-				fps = fieldvalue
+		p := NewFrameProgress()
+		for line := range outLogs {
+			if !p.setValue(line) {
+				continue
 			}
+			// a block ends by progress key
+			p.estimate(r.duration)
+			out <- p
+			p = NewFrameProgress()
 		}
-	}
+	}()
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
 
-	p.CurrentBitrate = currentBitrate
-	p.FramesProcessed = framesProcessed
-	p.CurrentTime = currentTime
-	p.Speed = currentSpeed
-	p.FPS = fps
-	return p
+	return out
 }
 
 func (r *FfmpegRunner) openingFileProgress(line string) *OpeningFileProgress {
@@ -120,9 +121,6 @@ func (r *FfmpegRunner) openingFileProgress(line string) *OpeningFileProgress {
 }
 
 func progressDetectType(line string) ProgressType {
-	if strings.Contains(line, "frame=") && strings.Contains(line, "time=") && strings.Contains(line, "bitrate=") {
-		return Frame
-	}
 	if strings.Contains(line, "Opening") && strings.Contains(line, "for writing") {
 		return OpeningFile
 	}
@@ -1,5 +1,43 @@
 package ffmpegrunner
 
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+	"transcode/pkg/commander"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	encoders := parseEncoders(`Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+`)
+	assert.Equal(t, []string{"libx264", "h264_nvenc", "aac"}, encoders)
+
+	hwaccels := parseHWAccels(`Hardware acceleration methods:
+vdpau
+cuda
+
+`)
+	assert.Equal(t, []string{"vdpau", "cuda"}, hwaccels)
+
+	filters := parseFilters(`Filters:
+  T.. = Timeline support
+  ..C = Command support
+ ..C scale             V->V       Scale the input video size and/or convert the image format.
+ ... scale_npp         V->V       NVIDIA Performance Primitives video scaling and format conversion
+`)
+	assert.Equal(t, []string{"scale", "scale_npp"}, filters)
+}
+
 //func TestRunner(t *testing.T) {
 //	r := New("/usr/bin/ffmpeg", "/usr/bin/ffprobe")
 //	args := []string{
@@ -36,3 +74,87 @@ package ffmpegrunner
 //		}
 //	}
 //}
+
+func TestFrameProgress(t *testing.T) {
+	var blocks []*FrameProgress
+	p := NewFrameProgress()
+	for _, line := range strings.Split(`frame=240
+fps=48.02
+stream_0_0_q=28.0
+bitrate=2104.5kbits/s
+total_size=2630144
+out_time_us=10000000
+out_time_ms=10000000
+out_time=00:00:10.000000
+dup_frames=0
+drop_frames=2
+speed=2.5x
+progress=continue
+frame=0
+fps=0.00
+bitrate=N/A
+total_size=N/A
+out_time_us=N/A
+speed=N/A
+progress=continue
+frame=1440
+out_time_us=60000000
+speed=2.4x
+progress=end`, "\n") {
+		if p.setValue(line) {
+			blocks = append(blocks, p)
+			p = NewFrameProgress()
+		}
+	}
+	assert.Len(t, blocks, 3)
+
+	blocks[0].estimate(60 * time.Second)
+	assert.Equal(t, &FrameProgress{
+		progressType:    Frame,
+		FramesProcessed: 240,
+		FPS:             48.02,
+		Bitrate:         2104500,
+		TotalSize:       2630144,
+		CurrentTime:     10 * time.Second,
+		DropFrames:      2,
+		Speed:           2.5,
+		Progress:        float64(10) / 60 * 100,
+		ETA:             20 * time.Second,
+	}, blocks[0])
+
+	blocks[1].estimate(60 * time.Second)
+	assert.Equal(t, float64(0), blocks[1].Bitrate)
+	assert.Equal(t, float64(0), blocks[1].Progress)
+	assert.Equal(t, time.Duration(-1), blocks[1].ETA)
+
+	blocks[2].estimate(0)
+	assert.True(t, blocks[2].Ended)
+	assert.Equal(t, float64(0), blocks[2].Progress)
+	blocks[2].estimate(60 * time.Second)
+	assert.Equal(t, float64(100), blocks[2].Progress)
+	assert.Equal(t, time.Duration(0), blocks[2].ETA)
+}
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, ErrHWAccelInit, Classify([]string{
+		"[h264 @ 0x55d] Cannot load libcuda.so.1",
+		"Device creation failed: -1.",
+	}))
+	assert.Equal(t, ErrNoSpaceLeft, Classify([]string{
+		"[hls @ 0x55d] Opening 'out/stream_0/data03.ts' for writing",
+		"av_interleaved_write_frame(): No space left on device",
+		"Error writing trailer of out/stream_0.m3u8: No space left on device",
+	}))
+	assert.Equal(t, ErrInvalidInput, Classify([]string{"input.mp4: Invalid data found when processing input"}))
+	assert.Equal(t, ErrUnsupportedCodec, Classify([]string{"Unknown encoder 'libsvtav1'"}))
+	assert.Equal(t, ErrPermissionDenied, Classify([]string{"out/master.m3u8: Permission denied"}))
+	assert.Nil(t, Classify([]string{"Conversion failed!"}))
+
+	err := classify(&commander.Error{Kind: commander.Failed, Err: errors.New("exit status 1"),
+		Stderr: []string{"No NVENC capable devices found"}})
+	assert.True(t, errors.Is(err, ErrHWAccelInit))
+	assert.True(t, commander.IsKind(err, commander.Failed))
+	err = classify(&commander.Error{Kind: commander.Canceled, Err: context.Canceled,
+		Stderr: []string{"No space left on device"}})
+	assert.False(t, errors.Is(err, ErrNoSpaceLeft))
+}
@@ -2,6 +2,10 @@ package ffmpegrunner
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ProgressType string
@@ -34,29 +38,103 @@ func NewProgress(line string) *Progress {
 	return &Progress{progressType: Raw, Raw: line}
 }
 
+// FrameProgress a block of -progress output of ffmpeg
+// eg: frame=240 fps=48.02 bitrate=2104.5kbits/s total_size=2630144 out_time_us=10000000 speed=2.01x progress=continue
 type FrameProgress struct {
 	progressType    ProgressType
-	FramesProcessed string
-	CurrentTime     string
-	CurrentBitrate  string
-	Progress        float64
-	Speed           string
-	FPS             string
+	FramesProcessed int64
+	FPS             float64
+	Bitrate         float64       // bits/s, 0 if it is unknown
+	TotalSize       int64         // bytes written
+	CurrentTime     time.Duration // time of output
+	DupFrames       int64
+	DropFrames      int64
+	Speed           float64       // multiplier of realtime, 0 if it is unknown
+	Progress        float64       // percentage of output duration, 0 if duration is unknown
+	ETA             time.Duration // negative if it is unknown
+	Ended           bool          // the last block
 }
 
 func NewFrameProgress() *FrameProgress {
-	return &FrameProgress{progressType: Frame}
+	return &FrameProgress{progressType: Frame, ETA: -1}
 }
 
 func (p *FrameProgress) ToString() string {
-	return "frame=" + p.FramesProcessed + " time=" + p.CurrentTime + " bitrate=" + p.CurrentBitrate +
-		" progress=" + fmt.Sprintf("%f", p.Progress) + " speed=" + p.Speed
+	return fmt.Sprintf("frame=%d fps=%.2f time=%s bitrate=%.0f progress=%.2f speed=%.2fx eta=%s",
+		p.FramesProcessed, p.FPS, p.CurrentTime, p.Bitrate, p.Progress, p.Speed, p.ETA)
 }
 
 func (p *FrameProgress) GetType() ProgressType {
 	return p.progressType
 }
 
+// setValue set a key=value line of progress block, values of N/A are ignored
+// return true if the line ends the block
+func (p *FrameProgress) setValue(line string) bool {
+	kv := strings.SplitN(line, "=", 2)
+	if len(kv) != 2 {
+		return false
+	}
+	key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+	switch key {
+	case "frame":
+		p.FramesProcessed, _ = strconv.ParseInt(value, 10, 64)
+	case "fps":
+		p.FPS, _ = strconv.ParseFloat(value, 64)
+	case "bitrate":
+		p.Bitrate = parseBitrate(value)
+	case "total_size":
+		p.TotalSize, _ = strconv.ParseInt(value, 10, 64)
+	case "out_time_us":
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && us >= 0 {
+			p.CurrentTime = time.Duration(us) * time.Microsecond
+		}
+	case "dup_frames":
+		p.DupFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "drop_frames":
+		p.DropFrames, _ = strconv.ParseInt(value, 10, 64)
+	case "speed":
+		p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(value, "x"), 64)
+	case "progress":
+		p.Ended = value == "end"
+		return true
+	}
+	return false
+}
+
+// estimate percentage and eta from duration of output
+func (p *FrameProgress) estimate(duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	if p.Ended {
+		p.Progress, p.ETA = 100, 0
+		return
+	}
+	p.Progress = math.Min(100, float64(p.CurrentTime)/float64(duration)*100)
+	if p.Speed > 0 {
+		p.ETA = time.Duration(math.Max(0, float64(duration-p.CurrentTime)/p.Speed))
+	}
+}
+
+// parseBitrate parse bitrate of progress, eg: 2104.5kbits/s
+func parseBitrate(value string) float64 {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"kbits/s", 1e3}, {"mbits/s", 1e6}, {"bits/s", 1}}
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(value, u.suffix), 64)
+			if err != nil {
+				return 0
+			}
+			return v * u.scale
+		}
+	}
+	return 0
+}
+
 type OpeningFileProgress struct {
 	progressType ProgressType
 	FilePath     string
@@ -2,12 +2,14 @@ package ffprobe
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"math"
 	"os/exec"
 	"strconv"
 	"strings"
+	"transcode/pkg/commander"
 	"transcode/pkg/config"
 	"transcode/pkg/resolution"
 
@@ -23,19 +25,73 @@ type Ffprobe struct {
 }
 
 type InputInfo struct {
-	Width        int64                 `json:"width"`
-	Height       resolution.Resolution `json:"height"`
-	Duration     int                   `json:"duration"`
-	BitRate      int64                 `json:"bit_rate"`
-	AudioBitRate int64                 `json:"audio_bit_rate"`
-	FrameRate    int                   `json:"frame_rate"` //fps
+	Width          int64                 `json:"width"`
+	Height         resolution.Resolution `json:"height"`
+	Duration       int                   `json:"duration"`
+	BitRate        int64                 `json:"bit_rate"`
+	AudioBitRate   int64                 `json:"audio_bit_rate"`
+	FrameRate      int                   `json:"frame_rate"`       //fps
+	ExactFrameRate float64               `json:"exact_frame_rate"` // r_frame_rate of video stream, eg: 29.97 for 30000/1001
+	CodecName      string                `json:"codec_name"`       // codec of video stream, eg: h264
+	Profile        string                `json:"profile"`          // profile of video stream, eg: High
+	Level          int                   `json:"level"`            // level of video stream, eg: 40
+	Rotation       int                   `json:"rotation"`         // clockwise degrees which video is rotated for display: 0, 90, 180 or 270
+
+	AudioCodecName string `json:"audio_codec_name"` // eg: aac
+
+	HasVideo bool `json:"has_video"` // input has a video stream
+	HasAudio bool `json:"has_audio"` // input has an audio stream
+	coverArt bool // the video stream is a still picture attached to audio, eg: cover art of mp3
+
+	AudioStreams    []AudioStream    `json:"audio_streams"`    // all audio streams, the first one is described by the audio fields above
+	SubtitleStreams []SubtitleStream `json:"subtitle_streams"` // all subtitle streams
 }
 
-func (i *InputInfo) setValue(args []string) {
+// AudioStream an audio stream of input, eg: a language track
+type AudioStream struct {
+	Index     int    `json:"index"` // index of stream in input, for -map 0:<index>
+	CodecName string `json:"codec_name"`
+	BitRate   int64  `json:"bit_rate"`
+	Channels  int    `json:"channels"`
+	Language  string `json:"language"` // from language tag, eg: eng
+	Title     string `json:"title"`    // from title tag, eg: English commentary
+	Default   bool   `json:"default"`  // stream has default disposition
+}
+
+func (a *AudioStream) setValue(args []string) {
 	if len(args) < 2 {
 		return
 	}
 
+	switch args[0] {
+	case "index":
+		a.Index, _ = strconv.Atoi(args[1])
+	case "codec_name":
+		a.CodecName = args[1]
+	case "bit_rate":
+		a.BitRate, _ = strconv.ParseInt(args[1], 10, 64)
+	case "channels":
+		a.Channels, _ = strconv.Atoi(args[1])
+	case "TAG:language":
+		a.Language = args[1]
+	case "TAG:title":
+		a.Title = args[1]
+	case "DISPOSITION:default":
+		a.Default = args[1] == "1"
+	}
+}
+
+func (i *InputInfo) setValue(args []string) {
+	if len(args) < 2 || i.coverArt {
+		return
+	}
+	if args[0] == "DISPOSITION:attached_pic" && args[1] == "1" {
+		// cover art is not a video, the input is audio-only
+		*i = InputInfo{coverArt: true}
+		return
+	}
+	i.HasVideo = true
+
 	switch args[0] {
 	case "width":
 		i.Width, _ = strconv.ParseInt(args[1], 10, 64)
@@ -45,19 +101,182 @@ func (i *InputInfo) setValue(args []string) {
 	case "duration":
 		fDur, _ := strconv.ParseFloat(args[1], 64)
 		i.Duration = int(math.Round(fDur))
+	case "codec_name":
+		i.CodecName = args[1]
+	case "profile":
+		i.Profile = args[1]
+	case "level":
+		level, _ := strconv.ParseInt(args[1], 10, 64)
+		i.Level = int(level)
 	case "bit_rate":
 		i.BitRate, _ = strconv.ParseInt(args[1], 10, 64)
+	case "TAG:rotate":
+		// rotate tag is clockwise
+		rotation, _ := strconv.ParseFloat(args[1], 64)
+		i.Rotation = normalizeRotation(rotation)
+	case "rotation":
+		// rotation of display matrix is counterclockwise, it is preferred to the legacy tag
+		rotation, _ := strconv.ParseFloat(args[1], 64)
+		i.Rotation = normalizeRotation(-rotation)
 	case "r_frame_rate":
 		rs := strings.Split(args[1], "/")
 		frameRate, _ := strconv.ParseInt(rs[0], 10, 64)
 		sec, _ := strconv.ParseFloat(rs[1], 64)
 		if sec != 0 {
-			frameRate = int64(math.Round(float64(frameRate) / sec))
+			i.ExactFrameRate = float64(frameRate) / sec
+			frameRate = int64(math.Round(i.ExactFrameRate))
 		}
 		i.FrameRate = int(frameRate)
 	}
 }
 
+func (i *InputInfo) setAudioValue(args []string) {
+	if len(args) < 2 {
+		return
+	}
+	i.HasAudio = true
+
+	switch args[0] {
+	case "codec_name":
+		i.AudioCodecName = args[1]
+	case "bit_rate":
+		i.AudioBitRate, _ = strconv.ParseInt(args[1], 10, 64)
+	case "duration":
+		// duration of audio-only input
+		if i.Duration == 0 {
+			fDur, _ := strconv.ParseFloat(args[1], 64)
+			i.Duration = int(math.Round(fDur))
+		}
+	}
+}
+
+// SubtitleStream a subtitle stream of input
+type SubtitleStream struct {
+	Index     int    `json:"index"`      // index of stream in input, for -map 0:<index>
+	CodecName string `json:"codec_name"` // eg: subrip, ass, mov_text, hdmv_pgs_subtitle
+	Language  string `json:"language"`   // from language tag, eg: eng
+	Title     string `json:"title"`      // from title tag
+	Default   bool   `json:"default"`    // stream has default disposition
+	Forced    bool   `json:"forced"`     // stream has forced disposition
+}
+
+// textSubtitleCodecs codecs of subtitles which can be converted to webvtt, the other ones are bitmaps
+var textSubtitleCodecs = map[string]struct{}{
+	"subrip":   {},
+	"srt":      {},
+	"ass":      {},
+	"ssa":      {},
+	"mov_text": {},
+	"webvtt":   {},
+	"text":     {},
+}
+
+// Text subtitle is text based, so it can be converted to webvtt
+func (s SubtitleStream) Text() bool {
+	_, ok := textSubtitleCodecs[s.CodecName]
+	return ok
+}
+
+func (s *SubtitleStream) setValue(args []string) {
+	if len(args) < 2 {
+		return
+	}
+
+	switch args[0] {
+	case "index":
+		s.Index, _ = strconv.Atoi(args[1])
+	case "codec_name":
+		s.CodecName = args[1]
+	case "TAG:language":
+		s.Language = args[1]
+	case "TAG:title":
+		s.Title = args[1]
+	case "DISPOSITION:default":
+		s.Default = args[1] == "1"
+	case "DISPOSITION:forced":
+		s.Forced = args[1] == "1"
+	}
+}
+
+// splitStreams split the wrapped output of ffprobe to key-value pairs of each stream
+// each stream is wrapped in [STREAM] and [/STREAM]
+func splitStreams(lines []string) [][][]string {
+	var streams [][][]string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "[STREAM]" {
+			streams = append(streams, nil)
+			continue
+		}
+		if len(streams) == 0 || line == "" || line == "[/STREAM]" {
+			continue
+		}
+		streams[len(streams)-1] = append(streams[len(streams)-1], strings.SplitN(line, "=", 2))
+	}
+	return streams
+}
+
+// setAudioStreams parse the audio streams from the wrapped output of ffprobe
+func (i *InputInfo) setAudioStreams(lines []string) {
+	for n, stream := range splitStreams(lines) {
+		a := AudioStream{}
+		for _, args := range stream {
+			a.setValue(args)
+			if n == 0 {
+				i.setAudioValue(args)
+			}
+		}
+		i.AudioStreams = append(i.AudioStreams, a)
+	}
+}
+
+// setSubtitleStreams parse the subtitle streams from the wrapped output of ffprobe
+func (i *InputInfo) setSubtitleStreams(lines []string) {
+	for _, stream := range splitStreams(lines) {
+		s := SubtitleStream{}
+		for _, args := range stream {
+			s.setValue(args)
+		}
+		i.SubtitleStreams = append(i.SubtitleStreams, s)
+	}
+}
+
+// normalizeRotation round degrees to right angles in [0, 360)
+func normalizeRotation(degrees float64) int {
+	r := int(math.Round(degrees/90)) * 90 % 360
+	if r < 0 {
+		r += 360
+	}
+	return r
+}
+
+// Rotated video is displayed with swapped width and height
+func (i *InputInfo) Rotated() bool {
+	return i.Rotation == 90 || i.Rotation == 270
+}
+
+// DisplayWidth width of video after rotation
+func (i *InputInfo) DisplayWidth() int64 {
+	if i.Rotated() {
+		return int64(i.Height)
+	}
+	return i.Width
+}
+
+// DisplayHeight height of video after rotation
+func (i *InputInfo) DisplayHeight() int64 {
+	if i.Rotated() {
+		return i.Width
+	}
+	return int64(i.Height)
+}
+
+// ShortEdge resolution of video, which is the shorter edge of display size
+// eg: 1080 for both 1920x1080 and 1080x1920
+func (i *InputInfo) ShortEdge() resolution.Resolution {
+	return resolution.Resolution(min(i.Width, int64(i.Height)))
+}
+
 func New(cfg config.ServerConfig) *Ffprobe {
 	f := &Ffprobe{
 		ffmpegBin:  cfg.FfmpegBin,
@@ -67,11 +286,18 @@ func New(cfg config.ServerConfig) *Ffprobe {
 	return f
 }
 
-func (f *Ffprobe) exec(cmd *exec.Cmd) (string, error) {
+// exec run ffprobe with args, it is killed when ctx is done and the error is the one of commander then
+func (f *Ffprobe) exec(ctx context.Context, args ...string) (string, error) {
 	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.ffprobeBin, args...)
 	cmd.Stderr = &stderr
 	cmd.Stdout = &stdout
 	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		e := commander.ContextError(ctx, f.ffprobeBin, args)
+		e.Killed = true
+		return "", e
+	}
 	if err != nil {
 		return "", err
 	}
@@ -83,11 +309,9 @@ func (f *Ffprobe) exec(cmd *exec.Cmd) (string, error) {
 }
 
 func (f *Ffprobe) FileDuration(filePath string) (string, error) {
-	cmd := exec.Command(f.ffprobeBin, []string{
+	out, err := f.exec(context.Background(),
 		"-v", "error", "-show_entries", "format=duration", "-of", "default=noprint_wrappers=1:nokey=1", filePath,
-	}...)
-
-	out, err := f.exec(cmd)
+	)
 
 	if err != nil && strings.Contains(err.Error(), "non-existing SPS 0 referenced in buffering period") {
 		f.ll.Error("actual error will be hidden", l.Error(err))
@@ -104,16 +328,18 @@ func (f *Ffprobe) FileDuration(filePath string) (string, error) {
 // InputInfo
 // input: maybe the filepath or can be the rtmp url
 // readIntervals: how many secs should read to know the info of input
-func (f *Ffprobe) InputInfo(input string, readIntervals int) (*InputInfo, error) {
-	// ffprobe -v error -read_intervals "%+2" -select_streams v:0
-	// -show_entries stream=width,height,duration,bit_rate,r_frame_rate -of default=noprint_wrappers=1 rtmp://127.0.0.1:1935/live/7868802855338312
-
-	//region read video info
-	cmd := exec.Command(f.ffprobeBin, []string{
-		"-v", "error", "-read_intervals", fmt.Sprintf("%%+%d", readIntervals), "-select_streams", "v:0",
-		"-show_entries", "stream=width,height,duration,bit_rate,r_frame_rate", "-of", "default=noprint_wrappers=1", input,
-	}...)
-	out, err := f.exec(cmd)
+// ffprobe is killed when ctx is done
+func (f *Ffprobe) InputInfo(ctx context.Context, input string, readIntervals int) (*InputInfo, error) {
+	// ffprobe -v error -read_intervals "%+2" -select_streams V:0
+	// -show_entries stream=codec_name,profile,level,width,height,duration,bit_rate,r_frame_rate:stream_disposition=attached_pic:stream_tags=rotate:stream_side_data=rotation
+	// -of default=noprint_wrappers=1 rtmp://127.0.0.1:1935/live/7868802855338312
+
+	//region read video info, V skips cover arts and the disposition guards ffprobe which doesn't
+	out, err := f.exec(ctx,
+		"-v", "error", "-read_intervals", fmt.Sprintf("%%+%d", readIntervals), "-select_streams", "V:0",
+		"-show_entries", "stream=codec_name,profile,level,width,height,duration,bit_rate,r_frame_rate:stream_disposition=attached_pic:stream_tags=rotate:stream_side_data=rotation",
+		"-of", "default=noprint_wrappers=1", input,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -125,19 +351,35 @@ func (f *Ffprobe) InputInfo(input string, readIntervals int) (*InputInfo, error)
 	}
 	//endregion
 
-	//region read audio bitrate
-	cmd = exec.Command(f.ffprobeBin, []string{
-		"-v", "error", "-read_intervals", fmt.Sprintf("%%+%d", readIntervals), "-select_streams", "a:0",
-		"-show_entries", "stream=bit_rate", "-of", "default=noprint_wrappers=1", input,
-	}...)
-	out, err = f.exec(cmd)
+	//region read audio streams, the first one gives audio bitrate and codec
+	// each stream is wrapped in [STREAM] and [/STREAM]
+	out, err = f.exec(ctx,
+		"-v", "error", "-read_intervals", fmt.Sprintf("%%+%d", readIntervals), "-select_streams", "a",
+		"-show_entries", "stream=index,codec_name,bit_rate,channels,duration:stream_tags=language,title:stream_disposition=default",
+		"-of", "default", input,
+	)
 	if err != nil {
 		return nil, err
 	}
-	lines = strings.Split(out, "\n")
-	info.AudioBitRate, _ = strconv.ParseInt(getValue(lines[0]), 10, 64)
+	info.setAudioStreams(strings.Split(out, "\n"))
 	//endregion
 
+	//region read subtitle streams
+	out, err = f.exec(ctx,
+		"-v", "error", "-select_streams", "s",
+		"-show_entries", "stream=index,codec_name:stream_tags=language,title:stream_disposition=default,forced",
+		"-of", "default", input,
+	)
+	if err != nil {
+		return nil, err
+	}
+	info.setSubtitleStreams(strings.Split(out, "\n"))
+	//endregion
+
+	if !info.HasVideo && !info.HasAudio {
+		return nil, fmt.Errorf("input %s has neither video nor audio stream", input)
+	}
+
 	return info, nil
 }
 
@@ -1,9 +1,13 @@
 package ffprobe
 
 import (
+	"context"
 	"log"
+	"strings"
 	"testing"
+	"transcode/pkg/commander"
 	"transcode/pkg/config"
+	"transcode/pkg/resolution"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/thnthien/great-deku/container"
@@ -19,7 +23,7 @@ func TestFfprobe_InputInfo(t *testing.T) {
 		FfprobeBin: "/usr/bin/ffprobe",
 	})
 
-	info, err := f.InputInfo("/home/thienthn/Downloads/test.mp4", 2)
+	info, err := f.InputInfo(context.Background(), "/home/thienthn/Downloads/test.mp4", 2)
 	assert.NoError(t, err)
 	log.Printf("%+v", info)
 }
@@ -52,3 +56,199 @@ loop:
 		log.Printf("%+v", frame)
 	}
 }
+
+func TestGOPAnalyzer(t *testing.T) {
+	a := gopAnalyzer{}
+	for i := 0; i < 10; i++ {
+		a.add(Packet{MediaType: VideoPacket, KeyFrame: boolToInt(i%4 == 0), DurationTime: 0.5})
+		a.add(Packet{MediaType: AudioPacket, KeyFrame: 1, DurationTime: 0.02})
+	}
+	gop := a.result()
+	assert.Equal(t, &GOPInfo{KeyframeCount: 3, MeanInterval: 2, MinInterval: 2, MaxInterval: 2, Fixed: true}, gop)
+	assert.Equal(t, float64(6), gop.SegmentDuration(6))
+	assert.Equal(t, float64(2), gop.SegmentDuration(1))
+
+	a = gopAnalyzer{}
+	for _, key := range []int{1, 0, 1, 0, 0, 0, 1, 0} {
+		a.add(Packet{MediaType: VideoPacket, KeyFrame: key, DurationTime: 1})
+	}
+	gop = a.result()
+	assert.Equal(t, &GOPInfo{KeyframeCount: 3, MeanInterval: 3, MinInterval: 2, MaxInterval: 4, Fixed: false}, gop)
+	assert.Equal(t, float64(6), gop.SegmentDuration(6))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestInputInfo_Rotation(t *testing.T) {
+	info := &InputInfo{}
+	for _, line := range []string{"width=1920", "height=1080", "TAG:rotate=90", "rotation=-90"} {
+		info.setValue(parseValue(line))
+	}
+	assert.Equal(t, 90, info.Rotation)
+	assert.Equal(t, int64(1080), info.DisplayWidth())
+	assert.Equal(t, int64(1920), info.DisplayHeight())
+	assert.Equal(t, resolution.R1080, info.ShortEdge())
+
+	info.setValue(parseValue("rotation=90"))
+	assert.Equal(t, 270, info.Rotation)
+	info.setValue(parseValue("rotation=180"))
+	assert.Equal(t, 180, info.Rotation)
+	assert.Equal(t, int64(1920), info.DisplayWidth())
+}
+
+func TestInputInfo_Streams(t *testing.T) {
+	info := &InputInfo{}
+	for _, line := range []string{"codec_name=aac", "bit_rate=128000", "duration=60.4", ""} {
+		info.setAudioValue(parseValue(line))
+	}
+	assert.False(t, info.HasVideo)
+	assert.True(t, info.HasAudio)
+	assert.Equal(t, 60, info.Duration)
+	assert.Equal(t, "aac", info.AudioCodecName)
+
+	info = &InputInfo{}
+	info.setAudioStreams(strings.Split(`[STREAM]
+index=1
+codec_name=aac
+channels=6
+bit_rate=384000
+DISPOSITION:default=0
+TAG:language=eng
+TAG:title=English 5.1
+[/STREAM]
+[STREAM]
+index=2
+codec_name=ac3
+channels=2
+bit_rate=N/A
+DISPOSITION:default=1
+TAG:language=fra
+[/STREAM]
+`, "\n"))
+	assert.True(t, info.HasAudio)
+	assert.Equal(t, "aac", info.AudioCodecName)
+	assert.Equal(t, int64(384000), info.AudioBitRate)
+	assert.Equal(t, []AudioStream{
+		{Index: 1, CodecName: "aac", Channels: 6, BitRate: 384000, Language: "eng", Title: "English 5.1"},
+		{Index: 2, CodecName: "ac3", Channels: 2, Language: "fra", Default: true},
+	}, info.AudioStreams)
+
+	info = &InputInfo{}
+	info.setValue(parseValue(""))
+	assert.False(t, info.HasVideo)
+	info.setValue(parseValue("width=1920"))
+	assert.True(t, info.HasVideo)
+
+	// cover art of mp3 is a video stream with attached_pic disposition
+	info = &InputInfo{}
+	for _, line := range []string{"codec_name=mjpeg", "width=600", "height=600", "r_frame_rate=90000/1",
+		"DISPOSITION:attached_pic=1", "TAG:rotate=0"} {
+		info.setValue(parseValue(line))
+	}
+	info.setAudioValue(parseValue("codec_name=mp3"))
+	assert.False(t, info.HasVideo)
+	assert.True(t, info.HasAudio)
+	assert.Equal(t, int64(0), info.Width)
+	assert.Equal(t, "", info.CodecName)
+}
+
+func TestInputInfo_SubtitleStreams(t *testing.T) {
+	info := &InputInfo{}
+	info.setSubtitleStreams(strings.Split(`[STREAM]
+index=3
+codec_name=subrip
+DISPOSITION:default=1
+DISPOSITION:forced=0
+TAG:language=eng
+[/STREAM]
+[STREAM]
+index=4
+codec_name=hdmv_pgs_subtitle
+DISPOSITION:default=0
+DISPOSITION:forced=1
+TAG:language=fra
+TAG:title=Forced
+[/STREAM]
+`, "\n"))
+	assert.Equal(t, []SubtitleStream{
+		{Index: 3, CodecName: "subrip", Language: "eng", Default: true},
+		{Index: 4, CodecName: "hdmv_pgs_subtitle", Language: "fra", Title: "Forced", Forced: true},
+	}, info.SubtitleStreams)
+	assert.True(t, info.SubtitleStreams[0].Text())
+	assert.False(t, info.SubtitleStreams[1].Text())
+}
+
+func TestFrameStats_Score(t *testing.T) {
+	var frames []FrameScore
+	for _, block := range strings.Split(`pts_time=0.000000
+TAG:lavfi.signalstats.YAVG=16.2
+TAG:lavfi.signalstats.YLOW=16
+TAG:lavfi.signalstats.YHIGH=17
+TAG:lavfi.blur=0
+--
+pts_time=10.000000
+TAG:lavfi.signalstats.YAVG=20.5
+TAG:lavfi.signalstats.YLOW=16
+TAG:lavfi.signalstats.YHIGH=35
+TAG:lavfi.blur=1.2
+--
+pts_time=20.000000
+TAG:lavfi.signalstats.YAVG=128
+TAG:lavfi.signalstats.YLOW=64
+TAG:lavfi.signalstats.YHIGH=192
+TAG:lavfi.blur=8
+--
+pts_time=30.000000
+TAG:lavfi.signalstats.YAVG=96
+TAG:lavfi.signalstats.YLOW=32
+TAG:lavfi.signalstats.YHIGH=160
+TAG:lavfi.blur=2
+--
+pts_time=40.000000
+TAG:lavfi.signalstats.YAVG=128
+TAG:lavfi.signalstats.YLOW=0
+TAG:lavfi.signalstats.YHIGH=255
+TAG:lavfi.blur=1`, "--\n") {
+		s := frameStats{}
+		for _, line := range strings.Split(block, "\n") {
+			s.setValue(parseValue(line))
+		}
+		frames = append(frames, s.score(true))
+	}
+	assert.True(t, frames[0].Black)
+	assert.True(t, frames[1].Black)
+	assert.Equal(t, float64(0), frames[1].Score)
+	assert.Equal(t, FrameScore{Time: 20, Brightness: 1, Contrast: 1, Sharpness: 0.125, Score: 0.65}, frames[2])
+	assert.Equal(t, 0.5, frames[3].Sharpness)
+	assert.InDelta(t, 0.725, frames[3].Score, 1e-9)
+
+	best, ok := bestFrame(frames, 5, 35)
+	assert.True(t, ok)
+	assert.Equal(t, float64(30), best.Time)
+	best, ok = bestFrame(frames, 0, 50)
+	assert.True(t, ok)
+	assert.Equal(t, float64(40), best.Time)
+	_, ok = bestFrame(frames[:2], 0, 50)
+	assert.False(t, ok)
+
+	s := frameStats{}
+	for _, line := range []string{"pts_time=5.000000", "TAG:lavfi.signalstats.YAVG=64", "TAG:lavfi.signalstats.YLOW=32", "TAG:lavfi.signalstats.YHIGH=96"} {
+		s.setValue(parseValue(line))
+	}
+	assert.Equal(t, FrameScore{Time: 5, Brightness: 0.5, Contrast: 0.5, Score: 0.5}, s.score(false))
+	assert.Equal(t, FrameScore{Time: 5}, frameStats{time: 5}.score(true))
+}
+
+func TestFfprobe_Canceled(t *testing.T) {
+	f := &Ffprobe{ffprobeBin: "sleep"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := f.InputInfo(ctx, "input.mp4", 2)
+	assert.True(t, commander.IsKind(err, commander.Canceled))
+	assert.ErrorIs(t, err, context.Canceled)
+}
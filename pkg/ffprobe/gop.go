@@ -0,0 +1,99 @@
+package ffprobe
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// GOPInfo keyframes structure of a video stream
+// intervals are counted between consecutive keyframes, the last gop which ends by the end of stream is ignored
+type GOPInfo struct {
+	KeyframeCount int     `json:"keyframe_count"`
+	MeanInterval  float64 `json:"mean_interval"` // in secs
+	MinInterval   float64 `json:"min_interval"`  // in secs
+	MaxInterval   float64 `json:"max_interval"`  // in secs
+	Fixed         bool    `json:"fixed"`         // all intervals are equal, with one frame tolerance
+}
+
+// SegmentDuration the segment duration nearest to target which is a multiple of keyframe interval
+// so every segment starts at a keyframe and has the same duration
+// return target if gop is not fixed
+func (g *GOPInfo) SegmentDuration(target float64) float64 {
+	if !g.Fixed || g.MeanInterval <= 0 {
+		return target
+	}
+	n := math.Round(target / g.MeanInterval)
+	if n < 1 {
+		n = 1
+	}
+	return n * g.MeanInterval
+}
+
+// AnalyzeGOP read packets of the first video stream to know its gop structure
+// readIntervals: how many secs should read, 0 for reading whole input
+// progress is called for every read packet, it can be nil
+// ffprobe is stopped when ctx is done
+func (f *Ffprobe) AnalyzeGOP(ctx context.Context, input string, readIntervals int, progress func()) (*GOPInfo, error) {
+	args := []string{"-select_streams", "v:0"}
+	if readIntervals > 0 {
+		args = append(args, "-read_intervals", fmt.Sprintf("%%+%d", readIntervals))
+	}
+	r := f.ReadPacket(input, args...)
+	done := r.RunContext(ctx)
+
+	a := gopAnalyzer{}
+	for p := range r.Logs() {
+		a.add(p)
+		if progress != nil {
+			progress()
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	return a.result(), nil
+}
+
+type gopAnalyzer struct {
+	keyframes     int
+	intervals     []float64
+	elapsed       float64 // secs since the last keyframe
+	frameDuration float64 // the longest packet duration, used as tolerance
+}
+
+func (a *gopAnalyzer) add(p Packet) {
+	if p.MediaType != VideoPacket {
+		return
+	}
+	if p.KeyFrame == 1 {
+		if a.keyframes > 0 {
+			a.intervals = append(a.intervals, a.elapsed)
+		}
+		a.keyframes++
+		a.elapsed = 0
+	}
+	if a.keyframes > 0 {
+		a.elapsed += p.DurationTime
+	}
+	if p.DurationTime > a.frameDuration {
+		a.frameDuration = p.DurationTime
+	}
+}
+
+func (a *gopAnalyzer) result() *GOPInfo {
+	g := &GOPInfo{KeyframeCount: a.keyframes}
+	if len(a.intervals) == 0 {
+		return g
+	}
+	var total float64
+	g.MinInterval = a.intervals[0]
+	for _, i := range a.intervals {
+		total += i
+		g.MinInterval = math.Min(g.MinInterval, i)
+		g.MaxInterval = math.Max(g.MaxInterval, i)
+	}
+	g.MeanInterval = total / float64(len(a.intervals))
+	g.Fixed = g.MaxInterval-g.MinInterval <= a.frameDuration+1e-6
+	return g
+}
@@ -0,0 +1,189 @@
+package ffprobe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"transcode/pkg/commander"
+)
+
+const (
+	blackLuma   = 40 // frames whose bright pixels are darker than this are black, like pix_th of blackdetect
+	sampleWidth = 320
+)
+
+// FrameScore quality of a candidate poster frame, values are from 0 to 1
+type FrameScore struct {
+	Time       float64 `json:"time"`       // secs of video
+	Brightness float64 `json:"brightness"` // 1 for mid-gray average luma, 0 for black or white
+	Contrast   float64 `json:"contrast"`   // spread between the 10th and 90th percentile luma
+	Sharpness  float64 `json:"sharpness"`  // inverse of edge width from blurdetect, 0 if it is not measured
+	Black      bool    `json:"black"`
+	Score      float64 `json:"score"`
+}
+
+// ReadFrameStats read statistics of the frame at secs of input
+// input is seeked to the keyframe before at, so only that frame is decoded
+// blur: measure sharpness by blurdetect filter, it needs ffmpeg 5.1
+// eg: ffprobe -v error -f lavfi "movie='input.mp4':seek_point=30,trim=end_frame=1,scale=320:-2,signalstats,blurdetect"
+// -show_entries frame=pts_time:frame_tags=lavfi.signalstats.YAVG,lavfi.signalstats.YLOW,lavfi.signalstats.YHIGH,lavfi.blur
+func (f *Ffprobe) ReadFrameStats(input string, at float64, blur bool) (*FrameStatsReader, error) {
+	if strings.Contains(input, "'") {
+		// input is quoted in filter graph
+		return nil, fmt.Errorf("input %s cannot have quote", input)
+	}
+	path := strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(input)
+	graph := fmt.Sprintf("movie='%s':seek_point=%s,trim=end_frame=1,scale=%d:-2,signalstats", path,
+		strconv.FormatFloat(at, 'f', -1, 64), sampleWidth)
+	tags := "lavfi.signalstats.YAVG,lavfi.signalstats.YLOW,lavfi.signalstats.YHIGH"
+	if blur {
+		graph += ",blurdetect"
+		tags += ",lavfi.blur"
+	}
+	args := []string{
+		"-v", "error", "-f", "lavfi", graph,
+		"-show_entries", "frame=pts_time:frame_tags=" + tags,
+	}
+	return &FrameStatsReader{
+		Commander: commander.New(f.ffprobeBin, args...),
+		blur:      blur,
+	}, nil
+}
+
+type FrameStatsReader struct {
+	commander.Commander
+	blur bool
+}
+
+// Logs score of the sampled frame
+func (r *FrameStatsReader) Logs() chan FrameScore {
+	frames := make(chan FrameScore)
+	go r.handleLogs(frames)
+
+	return frames
+}
+
+func (r *FrameStatsReader) handleLogs(frames chan FrameScore) {
+	defer close(frames)
+	ls := r.Commander.StdoutLogs()
+
+	s := frameStats{}
+	for line := range ls {
+		if line == "[FRAME]" {
+			s = frameStats{}
+		} else if line == "[/FRAME]" {
+			frames <- s.score(r.blur)
+		} else {
+			s.setValue(parseValue(line))
+		}
+	}
+}
+
+// frameStats the luma statistics of signalstats and the blur of blurdetect
+type frameStats struct {
+	time  float64
+	avg   float64
+	low   float64
+	high  float64
+	blur  float64
+	valid bool // signalstats is reported
+}
+
+func (s *frameStats) setValue(args []string) {
+	if len(args) < 2 {
+		return
+	}
+	val, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return
+	}
+	switch args[0] {
+	case "pts_time":
+		s.time = val
+	case "TAG:lavfi.signalstats.YAVG":
+		s.avg = val
+		s.valid = true
+	case "TAG:lavfi.signalstats.YLOW":
+		s.low = val
+	case "TAG:lavfi.signalstats.YHIGH":
+		s.high = val
+	case "TAG:lavfi.blur":
+		s.blur = val
+	}
+}
+
+// score weigh brightness, contrast and sharpness of frame
+// black frames score 0, so a fade-in is never chosen if there is another frame
+func (s frameStats) score(blur bool) FrameScore {
+	f := FrameScore{Time: s.time}
+	if !s.valid {
+		return f
+	}
+	f.Brightness = math.Max(0, 1-math.Abs(s.avg-128)/128)
+	f.Contrast = math.Min(1, math.Max(0, s.high-s.low)/128)
+	f.Black = s.high < blackLuma
+	if f.Black {
+		return f
+	}
+	if !blur {
+		f.Score = 0.5*f.Brightness + 0.5*f.Contrast
+		return f
+	}
+	if s.blur > 0 {
+		// blur is width of edges in pixels, it is about 1 for the sharpest frames
+		f.Sharpness = math.Min(1, 1/s.blur)
+	}
+	f.Score = 0.3*f.Brightness + 0.3*f.Contrast + 0.4*f.Sharpness
+	return f
+}
+
+// PickPoster sample candidates frames evenly over duration of input and return the best one
+// every candidate is read by its own ffprobe which seeks to it, so the whole input is not decoded
+// the frames at the start and the end are skipped, they are usually fades
+// progress is called for every read candidate, it can be nil
+// ffprobe is stopped when ctx is done
+func (f *Ffprobe) PickPoster(ctx context.Context, input string, duration float64, candidates int, blur bool, progress func()) (*FrameScore, error) {
+	if duration <= 0 || candidates <= 0 {
+		return nil, errors.New("duration and candidates of poster must be positive")
+	}
+	interval := duration / float64(candidates+1)
+	var frames []FrameScore
+	for i := 1; i <= candidates; i++ {
+		r, err := f.ReadFrameStats(input, float64(i)*interval, blur)
+		if err != nil {
+			return nil, err
+		}
+		done := r.RunContext(ctx)
+		for s := range r.Logs() {
+			frames = append(frames, s)
+		}
+		if err = <-done; err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress()
+		}
+	}
+	best, ok := bestFrame(frames, interval/2, duration-interval/2)
+	if !ok {
+		return nil, fmt.Errorf("no frame of %s can be poster", input)
+	}
+	return &best, nil
+}
+
+// bestFrame the frame of the highest score between from and to secs, the earliest one if they are equal
+// ok is false if no frame has a score, eg: all frames are black
+func bestFrame(frames []FrameScore, from, to float64) (best FrameScore, ok bool) {
+	for _, f := range frames {
+		if f.Score <= 0 || f.Time < from || f.Time > to {
+			continue
+		}
+		if !ok || f.Score > best.Score {
+			best, ok = f, true
+		}
+	}
+	return
+}
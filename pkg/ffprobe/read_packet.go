@@ -6,11 +6,15 @@ import (
 	"transcode/pkg/commander"
 )
 
-func (f *Ffprobe) ReadPacket(input string) *ReadPacketor {
+// ReadPacket read packets of input
+// extraArgs: args placed before the input, eg: -select_streams v:0
+func (f *Ffprobe) ReadPacket(input string, extraArgs ...string) *ReadPacketor {
 	args := []string{
 		"-show_packets", "-show_entries",
-		"packet=codec_type,duration_time,size,flags", input,
+		"packet=codec_type,pts_time,duration_time,size,pos,flags",
 	}
+	args = append(args, extraArgs...)
+	args = append(args, input)
 	return &ReadPacketor{
 		Commander: commander.New(f.ffprobeBin, args...),
 	}
@@ -26,8 +30,10 @@ const (
 type Packet struct {
 	MediaType    PacketMediaType `json:"media_type"`
 	KeyFrame     int             `json:"key_frame"`
+	PtsTime      float64         `json:"pts_time"`
 	DurationTime float64         `json:"duration_time"`
 	Size         int64           `json:"size"`
+	Pos          int64           `json:"pos"` // byte offset in input, -1 if it is unknown
 }
 
 type ReadPacketor struct {
@@ -48,10 +54,12 @@ func (r *ReadPacketor) handleLogs(packets chan Packet) {
 	var f Packet
 	for line := range ls {
 		if line == "[PACKET]" {
+			f.PtsTime = 0
 			f.DurationTime = 0
 			f.MediaType = ""
 			f.KeyFrame = 0
 			f.Size = 0
+			f.Pos = -1
 		} else if line == "[/PACKET]" {
 			packets <- f
 		} else {
@@ -64,6 +72,15 @@ func (r *ReadPacketor) handleLogs(packets chan Packet) {
 				} else {
 					f.KeyFrame = 0
 				}
+			} else if strings.HasPrefix(line, "pts_time") {
+				val, _ := strconv.ParseFloat(value, 64)
+				f.PtsTime = val
+			} else if strings.HasPrefix(line, "pos") {
+				val, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					val = -1
+				}
+				f.Pos = val
 			} else if strings.HasPrefix(line, "duration_time") {
 				val, _ := strconv.ParseFloat(value, 64)
 				f.DurationTime = val
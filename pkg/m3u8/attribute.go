@@ -0,0 +1,155 @@
+package m3u8
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Attribute an attribute of attribute list of a tag, eg: BANDWIDTH=1280000 or CODECS="avc1.640028"
+type Attribute struct {
+	Key    string
+	Value  string // value without quotes
+	Quoted bool   // value is a quoted string
+}
+
+func (a Attribute) String() string {
+	if a.Quoted {
+		return a.Key + `="` + a.Value + `"`
+	}
+	return a.Key + "=" + a.Value
+}
+
+// Attributes attribute list of a tag, the order is kept for writing
+type Attributes []Attribute
+
+// ParseAttributes parse attribute list, commas in quoted strings are kept
+func ParseAttributes(s string) Attributes {
+	var attrs Attributes
+	for len(s) > 0 {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		a := Attribute{Key: strings.TrimSpace(s[:eq])}
+		s = s[eq+1:]
+		if strings.HasPrefix(s, `"`) {
+			a.Quoted = true
+			s = s[1:]
+			end := strings.IndexByte(s, '"')
+			if end < 0 {
+				end = len(s)
+			}
+			a.Value, s = s[:end], s[min(end+1, len(s)):]
+			if comma := strings.IndexByte(s, ','); comma >= 0 {
+				s = s[comma+1:]
+			} else {
+				s = ""
+			}
+		} else if comma := strings.IndexByte(s, ','); comma >= 0 {
+			a.Value, s = s[:comma], s[comma+1:]
+		} else {
+			a.Value, s = s, ""
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+// Get value of key, empty if the list does not have key
+func (as Attributes) Get(key string) string {
+	for _, a := range as {
+		if a.Key == key {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Has the list has key
+func (as Attributes) Has(key string) bool {
+	for _, a := range as {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (as Attributes) int(key string) int64 {
+	v, _ := strconv.ParseInt(as.Get(key), 10, 64)
+	return v
+}
+
+func (as Attributes) float(key string) float64 {
+	v, _ := strconv.ParseFloat(as.Get(key), 64)
+	return v
+}
+
+func (as Attributes) bool(key string) bool {
+	return as.Get(key) == "YES"
+}
+
+// except the attributes whose keys are not in keys
+func (as Attributes) except(keys ...string) Attributes {
+	var others Attributes
+	for _, a := range as {
+		known := false
+		for _, k := range keys {
+			if a.Key == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			others = append(others, a)
+		}
+	}
+	return others
+}
+
+func (as Attributes) String() string {
+	s := make([]string, 0, len(as))
+	for _, a := range as {
+		s = append(s, a.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// attributeWriter build attribute list, empty values are skipped
+type attributeWriter struct {
+	attrs Attributes
+}
+
+func (w *attributeWriter) quoted(key, value string) {
+	if value != "" {
+		w.attrs = append(w.attrs, Attribute{Key: key, Value: value, Quoted: true})
+	}
+}
+
+func (w *attributeWriter) enum(key, value string) {
+	if value != "" {
+		w.attrs = append(w.attrs, Attribute{Key: key, Value: value})
+	}
+}
+
+func (w *attributeWriter) int(key string, value int64) {
+	if value > 0 {
+		w.attrs = append(w.attrs, Attribute{Key: key, Value: strconv.FormatInt(value, 10)})
+	}
+}
+
+func (w *attributeWriter) float(key string, value float64, prec int) {
+	if value > 0 {
+		w.attrs = append(w.attrs, Attribute{Key: key, Value: strconv.FormatFloat(value, 'f', prec, 64)})
+	}
+}
+
+func (w *attributeWriter) bool(key string, value bool) {
+	if value {
+		w.attrs = append(w.attrs, Attribute{Key: key, Value: "YES"})
+	}
+}
+
+func (w *attributeWriter) others(others Attributes) {
+	w.attrs = append(w.attrs, others...)
+}
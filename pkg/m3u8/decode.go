@@ -0,0 +1,176 @@
+package m3u8
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidPlaylist = errors.New("invalid playlist, missing #EXTM3U")
+
+// Playlist master or media playlist
+type Playlist interface {
+	Encode() string
+}
+
+// WriteFile serialize playlist to file
+func WriteFile(path string, p Playlist) error {
+	return os.WriteFile(path, []byte(p.Encode()), 0666)
+}
+
+// ReadMasterFile parse master playlist from file
+func ReadMasterFile(path string) (*MasterPlaylist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeMaster(f)
+}
+
+// ReadMediaFile parse media playlist from file
+func ReadMediaFile(path string) (*MediaPlaylist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeMedia(f)
+}
+
+// lines read trimmed non-empty lines, the first one must be #EXTM3U
+func lines(r io.Reader) ([]string, error) {
+	var ls []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ls = append(ls, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ls) == 0 || ls[0] != "#EXTM3U" {
+		return nil, ErrInvalidPlaylist
+	}
+	return ls[1:], nil
+}
+
+// splitTag split tag line to name and value, eg: #EXT-X-VERSION:3 to #EXT-X-VERSION and 3
+func splitTag(line string) (string, string) {
+	name, value, _ := strings.Cut(line, ":")
+	return name, value
+}
+
+// DecodeMaster parse master playlist
+func DecodeMaster(r io.Reader) (*MasterPlaylist, error) {
+	ls, err := lines(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &MasterPlaylist{}
+	var variant *Variant // variant which is waiting for its uri
+	for _, line := range ls {
+		if !strings.HasPrefix(line, "#") {
+			if variant != nil {
+				variant.URI = line
+				p.Variants = append(p.Variants, variant)
+				variant = nil
+			}
+			continue
+		}
+		name, value := splitTag(line)
+		switch name {
+		case "#EXT-X-VERSION":
+			p.Version, _ = strconv.Atoi(value)
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		case "#EXT-X-MEDIA":
+			p.Media = append(p.Media, parseMedia(ParseAttributes(value)))
+		case "#EXT-X-STREAM-INF":
+			variant = parseVariant(ParseAttributes(value))
+		case "#EXT-X-I-FRAME-STREAM-INF":
+			p.IFrameVariants = append(p.IFrameVariants, parseVariant(ParseAttributes(value)))
+		default:
+			if strings.HasPrefix(line, "#EXT") {
+				p.Tags = append(p.Tags, line)
+			}
+		}
+	}
+	return p, nil
+}
+
+// DecodeMedia parse media playlist
+func DecodeMedia(r io.Reader) (*MediaPlaylist, error) {
+	ls, err := lines(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &MediaPlaylist{}
+	segment := &Segment{} // segment which is waiting for its uri
+	started := false      // a tag of segment is read, so unknown tags belong to segments
+	for _, line := range ls {
+		if !strings.HasPrefix(line, "#") {
+			segment.URI = line
+			p.Segments = append(p.Segments, segment)
+			segment = &Segment{}
+			continue
+		}
+		name, value := splitTag(line)
+		switch name {
+		case "#EXT-X-VERSION":
+			p.Version, _ = strconv.Atoi(value)
+		case "#EXT-X-TARGETDURATION":
+			p.TargetDuration, _ = strconv.Atoi(value)
+		case "#EXT-X-MEDIA-SEQUENCE":
+			p.MediaSequence, _ = strconv.ParseInt(value, 10, 64)
+		case "#EXT-X-DISCONTINUITY-SEQUENCE":
+			p.DiscontinuitySequence, _ = strconv.ParseInt(value, 10, 64)
+		case "#EXT-X-PLAYLIST-TYPE":
+			p.PlaylistType = value
+		case "#EXT-X-INDEPENDENT-SEGMENTS":
+			p.IndependentSegments = true
+		case "#EXT-X-I-FRAMES-ONLY":
+			p.IFramesOnly = true
+		case "#EXT-X-ENDLIST":
+			p.Ended = true
+		case "#EXTINF":
+			duration, title, _ := strings.Cut(value, ",")
+			segment.Duration, _ = strconv.ParseFloat(duration, 64)
+			segment.Title = title
+			started = true
+		case "#EXT-X-BYTERANGE":
+			segment.ByteRange = parseByteRange(value)
+		case "#EXT-X-DISCONTINUITY":
+			segment.Discontinuity = true
+			started = true
+		case "#EXT-X-KEY":
+			segment.Key = parseKey(ParseAttributes(value))
+			started = true
+		case "#EXT-X-MAP":
+			segment.Map = parseMap(ParseAttributes(value))
+			started = true
+		case "#EXT-X-PROGRAM-DATE-TIME":
+			segment.ProgramDateTime, _ = time.Parse(time.RFC3339Nano, value)
+			started = true
+		case "#EXT-X-DATERANGE":
+			segment.DateRanges = append(segment.DateRanges, parseDateRange(ParseAttributes(value)))
+			started = true
+		default:
+			if !strings.HasPrefix(line, "#EXT") {
+				// comment
+				continue
+			}
+			if started {
+				segment.Tags = append(segment.Tags, line)
+			} else {
+				p.Tags = append(p.Tags, line)
+			}
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,102 @@
+package m3u8
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAttributes(t *testing.T) {
+	attrs := ParseAttributes(`BANDWIDTH=1280000,CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080,CLOSED-CAPTIONS=NONE`)
+	assert.Equal(t, Attributes{
+		{Key: "BANDWIDTH", Value: "1280000"},
+		{Key: "CODECS", Value: "avc1.640028,mp4a.40.2", Quoted: true},
+		{Key: "RESOLUTION", Value: "1920x1080"},
+		{Key: "CLOSED-CAPTIONS", Value: "NONE"},
+	}, attrs)
+	assert.Equal(t, `BANDWIDTH=1280000,CODECS="avc1.640028,mp4a.40.2",RESOLUTION=1920x1080,CLOSED-CAPTIONS=NONE`, attrs.String())
+}
+
+func TestMasterPlaylist(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,CHANNELS="2",URI="audio_en.m3u8"
+
+#EXT-X-STREAM-INF:BANDWIDTH=2186000,AVERAGE-BANDWIDTH=1457000,RESOLUTION=1920x1080,FRAME-RATE=30.000,CODECS="avc1.4d4028,mp4a.40.2",AUDIO="audio"
+stream_0.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=1214000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2",AUDIO="audio",VIDEO-RANGE=SDR
+stream_1.m3u8
+
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=150000,RESOLUTION=1920x1080,CODECS="avc1.4d4028",URI="iframe_0.m3u8"
+`
+	p, err := DecodeMaster(strings.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, 6, p.Version)
+	assert.Equal(t, 1, len(p.Media))
+	assert.Equal(t, "audio_en.m3u8", p.Media[0].URI)
+	assert.True(t, p.Media[0].Default)
+	assert.Equal(t, 2, len(p.Variants))
+	assert.Equal(t, &Variant{URI: "stream_0.m3u8", Bandwidth: 2186000, AverageBandwidth: 1457000, Width: 1920, Height: 1080,
+		FrameRate: 30, Codecs: "avc1.4d4028,mp4a.40.2", Audio: "audio"}, p.Variants[0])
+	assert.Equal(t, Attributes{{Key: "VIDEO-RANGE", Value: "SDR"}}, p.Variants[1].Others)
+	assert.Equal(t, "iframe_0.m3u8", p.IFrameVariants[0].URI)
+	assert.Equal(t, content, p.Encode())
+
+	_, err = DecodeMaster(strings.NewReader("stream_0.m3u8\n"))
+	assert.Equal(t, ErrInvalidPlaylist, err)
+}
+
+func TestMediaPlaylist(t *testing.T) {
+	content := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-KEY:METHOD=AES-128,URI="https://example.com/key",IV=0x00000000000000000000000000000001
+#EXT-X-MAP:URI="stream_0_init.mp4",BYTERANGE="720@0"
+#EXT-X-PROGRAM-DATE-TIME:2024-01-02T03:04:05.5Z
+#EXT-X-DATERANGE:ID="ad-1",START-DATE="2024-01-02T03:04:05Z",DURATION=30.5,X-AD-ID="42"
+#EXTINF:6.000000,
+#EXT-X-BYTERANGE:1000@720
+stream_0_data.m4s
+#EXTINF:6.000000,
+#EXT-X-BYTERANGE:2000
+stream_0_data.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-CUE-IN
+#EXTINF:4.500000,last
+stream_0_data01.m4s
+#EXT-X-ENDLIST
+`
+	p, err := DecodeMedia(strings.NewReader(content))
+	assert.Nil(t, err)
+	assert.Equal(t, 6, p.TargetDuration)
+	assert.Equal(t, PlaylistVOD, p.PlaylistType)
+	assert.True(t, p.Ended)
+	assert.Equal(t, 3, len(p.Segments))
+	assert.Equal(t, 16.5, p.Duration())
+
+	first := p.Segments[0]
+	assert.Equal(t, &Key{Method: "AES-128", URI: "https://example.com/key", IV: "0x00000000000000000000000000000001"}, first.Key)
+	assert.Equal(t, &Map{URI: "stream_0_init.mp4", ByteRange: &ByteRange{Length: 720, Offset: 0, HasOffset: true}}, first.Map)
+	assert.Equal(t, &ByteRange{Length: 1000, Offset: 720, HasOffset: true}, first.ByteRange)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 500000000, time.UTC), first.ProgramDateTime)
+	assert.Equal(t, "ad-1", first.DateRanges[0].ID)
+	assert.Equal(t, 30.5, first.DateRanges[0].Duration)
+	assert.Equal(t, "42", first.DateRanges[0].Others.Get("X-AD-ID"))
+
+	assert.Equal(t, &ByteRange{Length: 2000}, p.Segments[1].ByteRange)
+	assert.Nil(t, p.Segments[1].Key)
+
+	last := p.Segments[2]
+	assert.True(t, last.Discontinuity)
+	assert.Equal(t, []string{"#EXT-X-CUE-IN"}, last.Tags)
+	assert.Equal(t, "last", last.Title)
+
+	assert.Equal(t, content, p.Encode())
+}
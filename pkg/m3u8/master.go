@@ -0,0 +1,174 @@
+package m3u8
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// media types of EXT-X-MEDIA
+const (
+	MediaAudio          = "AUDIO"
+	MediaVideo          = "VIDEO"
+	MediaSubtitles      = "SUBTITLES"
+	MediaClosedCaptions = "CLOSED-CAPTIONS"
+)
+
+// MasterPlaylist playlist which lists variant streams and renditions
+type MasterPlaylist struct {
+	Version             int
+	IndependentSegments bool
+	Media               []*Media   // EXT-X-MEDIA
+	Variants            []*Variant // EXT-X-STREAM-INF
+	IFrameVariants      []*Variant // EXT-X-I-FRAME-STREAM-INF, their URI is in attributes
+	Tags                []string   // unknown tags, written after known ones
+}
+
+// Media a rendition of EXT-X-MEDIA
+type Media struct {
+	Type            string
+	GroupID         string
+	Name            string
+	Language        string
+	AssocLanguage   string
+	URI             string
+	Default         bool
+	Autoselect      bool
+	Forced          bool
+	InstreamID      string
+	Characteristics string
+	Channels        string
+	Others          Attributes // unknown attributes
+}
+
+// Variant a variant stream of EXT-X-STREAM-INF or EXT-X-I-FRAME-STREAM-INF
+type Variant struct {
+	URI              string
+	Bandwidth        int64
+	AverageBandwidth int64
+	Codecs           string
+	Width            int
+	Height           int
+	FrameRate        float64
+	HDCPLevel        string
+	Audio            string // group id of audio renditions
+	Video            string // group id of video renditions
+	Subtitles        string // group id of subtitles renditions
+	ClosedCaptions   string // group id of closed captions renditions, or NONE
+	Others           Attributes
+}
+
+func parseMedia(attrs Attributes) *Media {
+	return &Media{
+		Type:            attrs.Get("TYPE"),
+		GroupID:         attrs.Get("GROUP-ID"),
+		Name:            attrs.Get("NAME"),
+		Language:        attrs.Get("LANGUAGE"),
+		AssocLanguage:   attrs.Get("ASSOC-LANGUAGE"),
+		URI:             attrs.Get("URI"),
+		Default:         attrs.bool("DEFAULT"),
+		Autoselect:      attrs.bool("AUTOSELECT"),
+		Forced:          attrs.bool("FORCED"),
+		InstreamID:      attrs.Get("INSTREAM-ID"),
+		Characteristics: attrs.Get("CHARACTERISTICS"),
+		Channels:        attrs.Get("CHANNELS"),
+		Others: attrs.except("TYPE", "GROUP-ID", "NAME", "LANGUAGE", "ASSOC-LANGUAGE", "URI", "DEFAULT",
+			"AUTOSELECT", "FORCED", "INSTREAM-ID", "CHARACTERISTICS", "CHANNELS"),
+	}
+}
+
+func (m *Media) String() string {
+	w := attributeWriter{}
+	w.enum("TYPE", m.Type)
+	w.quoted("GROUP-ID", m.GroupID)
+	w.quoted("NAME", m.Name)
+	w.quoted("LANGUAGE", m.Language)
+	w.quoted("ASSOC-LANGUAGE", m.AssocLanguage)
+	w.bool("DEFAULT", m.Default)
+	w.bool("AUTOSELECT", m.Autoselect)
+	w.bool("FORCED", m.Forced)
+	w.quoted("INSTREAM-ID", m.InstreamID)
+	w.quoted("CHARACTERISTICS", m.Characteristics)
+	w.quoted("CHANNELS", m.Channels)
+	w.quoted("URI", m.URI)
+	w.others(m.Others)
+	return "#EXT-X-MEDIA:" + w.attrs.String()
+}
+
+func parseVariant(attrs Attributes) *Variant {
+	v := &Variant{
+		URI:              attrs.Get("URI"),
+		Bandwidth:        attrs.int("BANDWIDTH"),
+		AverageBandwidth: attrs.int("AVERAGE-BANDWIDTH"),
+		Codecs:           attrs.Get("CODECS"),
+		FrameRate:        attrs.float("FRAME-RATE"),
+		HDCPLevel:        attrs.Get("HDCP-LEVEL"),
+		Audio:            attrs.Get("AUDIO"),
+		Video:            attrs.Get("VIDEO"),
+		Subtitles:        attrs.Get("SUBTITLES"),
+		ClosedCaptions:   attrs.Get("CLOSED-CAPTIONS"),
+		Others: attrs.except("URI", "BANDWIDTH", "AVERAGE-BANDWIDTH", "CODECS", "RESOLUTION", "FRAME-RATE",
+			"HDCP-LEVEL", "AUDIO", "VIDEO", "SUBTITLES", "CLOSED-CAPTIONS"),
+	}
+	if res := strings.SplitN(attrs.Get("RESOLUTION"), "x", 2); len(res) == 2 {
+		v.Width, _ = strconv.Atoi(res[0])
+		v.Height, _ = strconv.Atoi(res[1])
+	}
+	return v
+}
+
+// attributes of variant, uri is included for i-frame variants
+func (v *Variant) attributes(iframe bool) Attributes {
+	w := attributeWriter{}
+	w.int("BANDWIDTH", v.Bandwidth)
+	w.int("AVERAGE-BANDWIDTH", v.AverageBandwidth)
+	if v.Width > 0 && v.Height > 0 {
+		w.enum("RESOLUTION", fmt.Sprintf("%dx%d", v.Width, v.Height))
+	}
+	w.float("FRAME-RATE", v.FrameRate, 3)
+	w.quoted("CODECS", v.Codecs)
+	w.enum("HDCP-LEVEL", v.HDCPLevel)
+	w.quoted("VIDEO", v.Video)
+	if iframe {
+		w.quoted("URI", v.URI)
+	} else {
+		w.quoted("AUDIO", v.Audio)
+		w.quoted("SUBTITLES", v.Subtitles)
+		if v.ClosedCaptions == "NONE" {
+			w.enum("CLOSED-CAPTIONS", v.ClosedCaptions)
+		} else {
+			w.quoted("CLOSED-CAPTIONS", v.ClosedCaptions)
+		}
+	}
+	w.others(v.Others)
+	return w.attrs
+}
+
+// Encode serialize playlist
+func (p *MasterPlaylist) Encode() string {
+	b := strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	if p.Version > 0 {
+		fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.Version)
+	}
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	for _, t := range p.Tags {
+		b.WriteString(t + "\n")
+	}
+	for _, m := range p.Media {
+		b.WriteString(m.String() + "\n")
+	}
+	if len(p.Media) > 0 {
+		b.WriteString("\n")
+	}
+	for _, v := range p.Variants {
+		b.WriteString("#EXT-X-STREAM-INF:" + v.attributes(false).String() + "\n")
+		b.WriteString(v.URI + "\n\n")
+	}
+	for _, v := range p.IFrameVariants {
+		b.WriteString("#EXT-X-I-FRAME-STREAM-INF:" + v.attributes(true).String() + "\n")
+	}
+	return b.String()
+}
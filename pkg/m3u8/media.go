@@ -0,0 +1,230 @@
+package m3u8
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// playlist types of EXT-X-PLAYLIST-TYPE
+const (
+	PlaylistVOD   = "VOD"
+	PlaylistEvent = "EVENT"
+)
+
+// MediaPlaylist playlist which lists segments of a rendition
+type MediaPlaylist struct {
+	Version               int
+	TargetDuration        int
+	MediaSequence         int64
+	DiscontinuitySequence int64
+	PlaylistType          string
+	IndependentSegments   bool
+	IFramesOnly           bool
+	Segments              []*Segment
+	Ended                 bool     // EXT-X-ENDLIST
+	Tags                  []string // unknown tags of header
+}
+
+// Segment a media segment
+// key, map and date ranges are the tags written before this segment,
+// a key or map applies to all following segments until the next one
+type Segment struct {
+	URI             string
+	Duration        float64
+	Title           string
+	ByteRange       *ByteRange
+	Discontinuity   bool
+	Key             *Key
+	Map             *Map
+	ProgramDateTime time.Time
+	DateRanges      []*DateRange
+	Tags            []string // unknown tags written before this segment
+}
+
+// ByteRange sub-range of resource, EXT-X-BYTERANGE
+type ByteRange struct {
+	Length    int64
+	Offset    int64
+	HasOffset bool // without offset, the range starts after the previous one
+}
+
+// Key encryption of segments, EXT-X-KEY
+type Key struct {
+	Method            string
+	URI               string
+	IV                string
+	KeyFormat         string
+	KeyFormatVersions string
+}
+
+// Map media initialization section, EXT-X-MAP
+type Map struct {
+	URI       string
+	ByteRange *ByteRange
+}
+
+// DateRange EXT-X-DATERANGE
+type DateRange struct {
+	ID              string
+	Class           string
+	StartDate       time.Time
+	EndDate         time.Time
+	Duration        float64
+	PlannedDuration float64
+	EndOnNext       bool
+	Others          Attributes // X-<client-attribute> and SCTE35 attributes
+}
+
+// parseByteRange parse value of <n>[@<o>]
+func parseByteRange(s string) *ByteRange {
+	r := &ByteRange{}
+	parts := strings.SplitN(s, "@", 2)
+	r.Length, _ = strconv.ParseInt(parts[0], 10, 64)
+	if len(parts) == 2 {
+		r.Offset, _ = strconv.ParseInt(parts[1], 10, 64)
+		r.HasOffset = true
+	}
+	return r
+}
+
+func (r *ByteRange) String() string {
+	if r.HasOffset {
+		return fmt.Sprintf("%d@%d", r.Length, r.Offset)
+	}
+	return strconv.FormatInt(r.Length, 10)
+}
+
+func parseKey(attrs Attributes) *Key {
+	return &Key{
+		Method:            attrs.Get("METHOD"),
+		URI:               attrs.Get("URI"),
+		IV:                attrs.Get("IV"),
+		KeyFormat:         attrs.Get("KEYFORMAT"),
+		KeyFormatVersions: attrs.Get("KEYFORMATVERSIONS"),
+	}
+}
+
+func (k *Key) String() string {
+	w := attributeWriter{}
+	w.enum("METHOD", k.Method)
+	w.quoted("URI", k.URI)
+	w.enum("IV", k.IV)
+	w.quoted("KEYFORMAT", k.KeyFormat)
+	w.quoted("KEYFORMATVERSIONS", k.KeyFormatVersions)
+	return "#EXT-X-KEY:" + w.attrs.String()
+}
+
+func parseMap(attrs Attributes) *Map {
+	m := &Map{URI: attrs.Get("URI")}
+	if attrs.Has("BYTERANGE") {
+		m.ByteRange = parseByteRange(attrs.Get("BYTERANGE"))
+	}
+	return m
+}
+
+func (m *Map) String() string {
+	w := attributeWriter{}
+	w.quoted("URI", m.URI)
+	if m.ByteRange != nil {
+		w.quoted("BYTERANGE", m.ByteRange.String())
+	}
+	return "#EXT-X-MAP:" + w.attrs.String()
+}
+
+func parseDateRange(attrs Attributes) *DateRange {
+	d := &DateRange{
+		ID:              attrs.Get("ID"),
+		Class:           attrs.Get("CLASS"),
+		Duration:        attrs.float("DURATION"),
+		PlannedDuration: attrs.float("PLANNED-DURATION"),
+		EndOnNext:       attrs.bool("END-ON-NEXT"),
+		Others: attrs.except("ID", "CLASS", "START-DATE", "END-DATE", "DURATION", "PLANNED-DURATION",
+			"END-ON-NEXT"),
+	}
+	d.StartDate, _ = time.Parse(time.RFC3339Nano, attrs.Get("START-DATE"))
+	d.EndDate, _ = time.Parse(time.RFC3339Nano, attrs.Get("END-DATE"))
+	return d
+}
+
+func (d *DateRange) String() string {
+	w := attributeWriter{}
+	w.quoted("ID", d.ID)
+	w.quoted("CLASS", d.Class)
+	if !d.StartDate.IsZero() {
+		w.quoted("START-DATE", d.StartDate.Format(time.RFC3339Nano))
+	}
+	if !d.EndDate.IsZero() {
+		w.quoted("END-DATE", d.EndDate.Format(time.RFC3339Nano))
+	}
+	w.float("DURATION", d.Duration, -1)
+	w.float("PLANNED-DURATION", d.PlannedDuration, -1)
+	w.others(d.Others)
+	w.bool("END-ON-NEXT", d.EndOnNext)
+	return "#EXT-X-DATERANGE:" + w.attrs.String()
+}
+
+// Duration total duration of segments
+func (p *MediaPlaylist) Duration() float64 {
+	var d float64
+	for _, s := range p.Segments {
+		d += s.Duration
+	}
+	return d
+}
+
+// Encode serialize playlist
+func (p *MediaPlaylist) Encode() string {
+	b := strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	if p.Version > 0 {
+		fmt.Fprintf(&b, "#EXT-X-VERSION:%d\n", p.Version)
+	}
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", p.TargetDuration)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.MediaSequence)
+	if p.DiscontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.DiscontinuitySequence)
+	}
+	if p.PlaylistType != "" {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:" + p.PlaylistType + "\n")
+	}
+	if p.IndependentSegments {
+		b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+	}
+	if p.IFramesOnly {
+		b.WriteString("#EXT-X-I-FRAMES-ONLY\n")
+	}
+	for _, t := range p.Tags {
+		b.WriteString(t + "\n")
+	}
+	for _, s := range p.Segments {
+		if s.Key != nil {
+			b.WriteString(s.Key.String() + "\n")
+		}
+		if s.Map != nil {
+			b.WriteString(s.Map.String() + "\n")
+		}
+		if s.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if !s.ProgramDateTime.IsZero() {
+			b.WriteString("#EXT-X-PROGRAM-DATE-TIME:" + s.ProgramDateTime.Format(time.RFC3339Nano) + "\n")
+		}
+		for _, d := range s.DateRanges {
+			b.WriteString(d.String() + "\n")
+		}
+		for _, t := range s.Tags {
+			b.WriteString(t + "\n")
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.6f,%s\n", s.Duration, s.Title)
+		if s.ByteRange != nil {
+			b.WriteString("#EXT-X-BYTERANGE:" + s.ByteRange.String() + "\n")
+		}
+		b.WriteString(s.URI + "\n")
+	}
+	if p.Ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+	return b.String()
+}
@@ -9,4 +9,59 @@ type TranscodeReq struct {
 	StoredFolderPath string                  `json:"stored_folder_path"`
 	KeyInfoFilePath  string                  `json:"key_info_file_path"`
 	Resolutions      []resolution.Resolution `json:"resolutions"`
+	Encoder          string                  `json:"encoder"`           // nvenc or software, empty for the default of server
+	Formats          []string                `json:"formats"`           // hls and/or dash, or cmaf; empty for hls only
+	Codecs           []string                `json:"codecs"`            // h264, hevc, av1; a ladder for each codec, empty for h264 only
+	PlaylistTemplate string                  `json:"playlist_template"` // naming template of hls playlists, empty for the one of server
+	SegmentTemplate  string                  `json:"segment_template"`  // naming template of hls segments, empty for the one of server
+	Subtitles        []SubtitleReq           `json:"subtitles"`         // sidecar subtitle files, they are published with the embedded ones
+	Overlays         []OverlayReq            `json:"overlays"`          // watermarks and burned-in subtitles, drawn on every rendition in order
+	UserID           string                  `json:"user_id"`           // id of viewer or owner, for {user_id} of text overlays
+	Images           ImagesReq               `json:"images"`            // poster, thumbnails and sprite, none by default
+	Preview          PreviewReq              `json:"preview"`           // animated preview of snippets, none by default
+	Resume           bool                    `json:"resume"`            // resume the paused job whose partial output is in stored folder
+}
+
+// PreviewReq short silent animation of evenly spaced snippets of video, eg: for listing pages
+type PreviewReq struct {
+	Format   string  `json:"format"`   // webp, gif or mp4, empty for no preview
+	Duration float64 `json:"duration"` // secs of preview, 0 for 6
+	Snippets int     `json:"snippets"` // number of snippets, 0 for 3
+	Width    int     `json:"width"`    // 0 for 320
+}
+
+// ImagesReq images of video which are generated in the same job
+type ImagesReq struct {
+	Poster         bool    `json:"poster"`          // a poster image
+	SmartPoster    bool    `json:"smart_poster"`    // pick the poster from scored candidate frames instead of at 10% of video
+	Thumbnails     int     `json:"thumbnails"`      // number of thumbnails at fixed intervals, 0 for none
+	ThumbnailWidth int     `json:"thumbnail_width"` // 0 for 320
+	Sprite         bool    `json:"sprite"`          // storyboard sprite sheets with a webvtt index for scrub previews
+	SpriteInterval float64 `json:"sprite_interval"` // seconds between tiles of sprite, 0 to fit the video in 100 tiles
+	TileWidth      int     `json:"tile_width"`      // width of a tile of sprite, 0 for 160
+}
+
+// SubtitleReq a sidecar subtitle file of video
+type SubtitleReq struct {
+	FilePath string `json:"file_path"` // srt, ass, ssa or vtt file
+	Language string `json:"language"`  // eg: en
+	Title    string `json:"title"`     // name of subtitle in players, empty for the language
+	Default  bool   `json:"default"`
+	Forced   bool   `json:"forced"`
+}
+
+// OverlayReq an overlay which is drawn on every rendition, its size is relative to the rendition
+// - image: FilePath is the image, Scale is its width relative to the width of rendition, 0.15 by default
+// - text: Text is a template with {timestamp} for time of video and {user_id} for UserID of request,
+// Scale is the font size relative to the height of rendition, 0.04 by default
+// - subtitle: burn in FilePath, or the subtitle stream SubtitleIndex of source if FilePath is empty
+type OverlayReq struct {
+	Type          string  `json:"type"`           // image, text or subtitle
+	FilePath      string  `json:"file_path"`      // image or subtitle file
+	Text          string  `json:"text"`           // template of text overlay
+	FontFile      string  `json:"font_file"`      // font of text overlay, empty for the default font of ffmpeg
+	Position      string  `json:"position"`       // top_left, top_right, bottom_left, bottom_right or center, bottom_right by default
+	Scale         float64 `json:"scale"`          // size relative to rendition, 0 for the default of type
+	Opacity       float64 `json:"opacity"`        // from 0 to 1, 0 for opaque
+	SubtitleIndex int     `json:"subtitle_index"` // index of subtitle stream of source to burn in, eg: 0 for the first one
 }
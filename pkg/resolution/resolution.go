@@ -1,40 +1,136 @@
 package resolution
 
+import "math"
+
+// Resolution height of video, any height is valid, the common ones are rungs of Ladder
 type Resolution int
 
 const (
+	R2160 Resolution = 2160
+	R1440 Resolution = 1440
 	R1080 Resolution = 1080
 	R720  Resolution = 720
 	R480  Resolution = 480
 	R360  Resolution = 360
+	R240  Resolution = 240
+	R144  Resolution = 144
 )
 
+const kb = int64(1024)
+
+// Rung default settings of a resolution
+type Rung struct {
+	Resolution   Resolution
+	Bitrate      int64 // default h264 video bitrate, in bits/s
+	AudioBitrate int64 // in bits/s
+	StepRatio    int64 // percent of bitrate of this rung to the next lower rung for the same quality, eg: 180 for 1.8 times
+}
+
+const (
+	bitrate1080 = 3584 * kb // 3.5Mb
+	bitrate720  = bitrate1080 * 10 / 18
+	bitrate480  = bitrate720 * 10 / 18
+	bitrate360  = bitrate480 * 10 / 16
+	bitrate240  = bitrate360 * 10 / 18
+	bitrate1440 = bitrate1080 * 18 / 10
+)
+
+// Ladder rungs of common resolutions, in decreasing order
+// default bitrates follow the step ratios from 1080
+var Ladder = []Rung{
+	{Resolution: R2160, Bitrate: bitrate1440 * 225 / 100, AudioBitrate: 256 * kb, StepRatio: 225},
+	{Resolution: R1440, Bitrate: bitrate1440, AudioBitrate: 256 * kb, StepRatio: 180},
+	{Resolution: R1080, Bitrate: bitrate1080, AudioBitrate: 256 * kb, StepRatio: 180},
+	{Resolution: R720, Bitrate: bitrate720, AudioBitrate: 192 * kb, StepRatio: 180},
+	{Resolution: R480, Bitrate: bitrate480, AudioBitrate: 128 * kb, StepRatio: 160},
+	{Resolution: R360, Bitrate: bitrate360, AudioBitrate: 96 * kb, StepRatio: 180},
+	{Resolution: R240, Bitrate: bitrate240, AudioBitrate: 64 * kb, StepRatio: 200},
+	{Resolution: R144, Bitrate: bitrate240 * 100 / 200, AudioBitrate: 48 * kb},
+}
+
+// Level position of resolution in ladder, 1 for the lowest rung, 0 if resolution is not a rung
 func (r Resolution) Level() int {
-	switch r {
-	case R360:
-		return 1
-	case R480:
-		return 2
-	case R720:
-		return 3
-	case R1080:
-		return 4
-	default:
-		return 0
+	for i, rung := range Ladder {
+		if rung.Resolution == r {
+			return len(Ladder) - i
+		}
 	}
+	return 0
 }
 
+// FromLevel the rung resolution of level, 0 if there is no rung of level
 func FromLevel(level int) Resolution {
-	switch level {
-	case 1:
-		return R360
-	case 2:
-		return R480
-	case 3:
-		return R720
-	case 4:
-		return R1080
-	default:
+	if level < 1 || level > len(Ladder) {
 		return 0
 	}
+	return Ladder[len(Ladder)-level].Resolution
+}
+
+// RungOf settings of resolution
+// the ones of heights between rungs are interpolated, the ones above the ladder are scaled by number of pixels
+func RungOf(r Resolution) Rung {
+	top, bottom := Ladder[0], Ladder[len(Ladder)-1]
+	if r == top.Resolution {
+		return top
+	}
+	if r > top.Resolution {
+		scale := float64(r) * float64(r) / (float64(top.Resolution) * float64(top.Resolution))
+		return Rung{
+			Resolution:   r,
+			Bitrate:      int64(float64(top.Bitrate) * scale),
+			AudioBitrate: top.AudioBitrate,
+			StepRatio:    int64(math.Round(100 * scale)), // to the top rung
+		}
+	}
+	if r <= bottom.Resolution {
+		return Rung{Resolution: r, Bitrate: bottom.Bitrate, AudioBitrate: bottom.AudioBitrate}
+	}
+	for i := 1; i < len(Ladder); i++ {
+		high, low := Ladder[i-1], Ladder[i]
+		if r == low.Resolution {
+			return low
+		}
+		if r > low.Resolution {
+			// r is between low and high
+			f := float64(r-low.Resolution) / float64(high.Resolution-low.Resolution)
+			return Rung{
+				Resolution:   r,
+				Bitrate:      low.Bitrate + int64(f*float64(high.Bitrate-low.Bitrate)),
+				AudioBitrate: low.AudioBitrate,
+				StepRatio:    int64(math.Round(100 * math.Pow(float64(high.StepRatio)/100, f))),
+			}
+		}
+	}
+	return bottom
+}
+
+// StepDown the bitrate at resolution to which gives the same quality as bitRate at resolution from
+// bitrate is divided by step ratios of rungs between the resolutions
+func StepDown(bitRate int64, from, to Resolution) int64 {
+	for from > to {
+		rung := RungOf(from)
+		if rung.StepRatio == 0 {
+			// lower than the lowest rung
+			return bitRate
+		}
+		next := nextRung(from)
+		if next < to {
+			// to is between from and the next rung, step a part of the ratio
+			f := float64(from-to) / float64(from-next)
+			return int64(float64(bitRate) / math.Pow(float64(rung.StepRatio)/100, f))
+		}
+		bitRate = bitRate * 100 / rung.StepRatio
+		from = next
+	}
+	return bitRate
+}
+
+// nextRung the highest rung which is lower than r, 0 if r is not higher than the lowest rung
+func nextRung(r Resolution) Resolution {
+	for _, rung := range Ladder {
+		if rung.Resolution < r {
+			return rung.Resolution
+		}
+	}
+	return 0
 }
@@ -0,0 +1,40 @@
+package resolution
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLevel(t *testing.T) {
+	assert.Equal(t, 8, R2160.Level())
+	assert.Equal(t, 3, R360.Level())
+	assert.Equal(t, 0, Resolution(900).Level())
+	assert.Equal(t, R1080, FromLevel(R1080.Level()))
+	assert.Equal(t, Resolution(0), FromLevel(9))
+}
+
+func TestRungOf(t *testing.T) {
+	assert.Equal(t, Ladder[2], RungOf(R1080))
+	assert.Equal(t, Ladder[0], RungOf(R2160))
+
+	// between 1080 and 720, bitrate is interpolated
+	r := RungOf(900)
+	assert.Equal(t, (bitrate1080+bitrate720)/2, r.Bitrate)
+	assert.Equal(t, int64(192*kb), r.AudioBitrate)
+	assert.Equal(t, int64(134), r.StepRatio) // sqrt(1.8)
+
+	// above the ladder, bitrate is scaled by number of pixels
+	assert.Equal(t, Ladder[0].Bitrate*4, RungOf(4320).Bitrate)
+	assert.Equal(t, Ladder[len(Ladder)-1].Bitrate, RungOf(100).Bitrate)
+}
+
+func TestStepDown(t *testing.T) {
+	assert.Equal(t, int64(2038897), StepDown(3670016, R1080, R720))
+	assert.Equal(t, int64(707950), StepDown(3670016, R1080, R360))
+	assert.Equal(t, int64(196652), StepDown(3670016, R1080, R144))
+	assert.Equal(t, int64(bitrate1440), StepDown(Ladder[0].Bitrate, R2160, R1440))
+	// a part of step ratio between rungs
+	assert.InDelta(t, 1000000, StepDown(1341640, R1080, 900), 1)
+	assert.Equal(t, int64(3670016), StepDown(3670016, R1080, R1080))
+}
@@ -2,6 +2,7 @@ package transcoder
 
 import (
 	"context"
+	"transcode/pkg/ffprobe"
 	"transcode/pkg/resolution"
 )
 
@@ -15,19 +16,155 @@ func (f UploadFile) String() string {
 	return "name=" + f.Name + " " + "Path=" + f.Path + " " + "UploadKey=" + f.UploadKey
 }
 
+// EncoderReport explains which encoder was used for the job and why
+type EncoderReport struct {
+	Requested string   `json:"requested"`
+	Used      string   `json:"used"`
+	Reason    string   `json:"reason"`
+	Fallback  bool     `json:"fallback"` // the job was retried with software encoder after the requested one failed
+	HWAccels  []string `json:"hwaccels"` // hardware accelerations supported by ffmpeg
+	Encoders  []string `json:"encoders"` // encoders supported by ffmpeg
+}
+
+// Rendition a retention of output, which is a resolution encoded with a codec
+type Rendition struct {
+	Resolution     resolution.Resolution `json:"resolution"`
+	Codec          string                `json:"codec"`  // h264, hevc or av1
+	Codecs         string                `json:"codecs"` // RFC 6381 codecs of video and audio, eg: avc1.640028,mp4a.40.2
+	Width          int                   `json:"width"`
+	Height         int                   `json:"height"`
+	FrameRate      int                   `json:"frame_rate"`
+	VideoBitrate   int                   `json:"video_bitrate"`   // target bitrate of encoding, 0 if it is copied
+	Copy           bool                  `json:"copy"`            // video is copied from source
+	Language       string                `json:"language"`        // language of alternate audio rendition, from its source stream
+	IFramePlaylist string                `json:"iframe_playlist"` // i-frame playlist for trick play, relative to the stored folder
+}
+
+// Subtitle a webvtt subtitle rendition of hls
+type Subtitle struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Playlist string `json:"playlist"` // webvtt playlist, relative to the stored folder
+	Embedded bool   `json:"embedded"` // converted from a stream of source, otherwise from a sidecar file
+}
+
+// Image an image of video, its path is relative to the stored folder and to FolderName in storage
+type Image struct {
+	Path   string  `json:"path"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Time   float64 `json:"time"` // seconds of video where the image is taken, the first tile for sprite sheets
+}
+
+// Sprite storyboard sprite sheets and their webvtt index for scrub previews
+type Sprite struct {
+	Index      string  `json:"index"` // webvtt which maps time ranges to tiles, eg: sprite_00.jpg#xywh=160,0,160,90
+	Sheets     []Image `json:"sheets"`
+	TileWidth  int     `json:"tile_width"`
+	TileHeight int     `json:"tile_height"`
+	Columns    int     `json:"columns"`
+	Rows       int     `json:"rows"`
+	Interval   float64 `json:"interval"` // seconds between tiles
+}
+
+// Images images of video which are generated in the job
+type Images struct {
+	Poster      *Image              `json:"poster"`
+	PosterScore *ffprobe.FrameScore `json:"poster_score"` // score of the picked frame, nil if poster is not picked by scores
+	Thumbnails  []Image             `json:"thumbnails"`
+	Sprite      *Sprite             `json:"sprite"`
+}
+
+// Snippet a part of source which is in preview
+type Snippet struct {
+	Start    float64 `json:"start"`    // secs of source
+	Duration float64 `json:"duration"` // secs
+}
+
+// Preview short silent animation of snippets of video, its path is relative to the stored folder
+type Preview struct {
+	Path     string    `json:"path"`
+	Format   string    `json:"format"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Duration float64   `json:"duration"` // secs
+	Snippets []Snippet `json:"snippets"`
+}
+
 type OutputData struct {
-	Width             int
-	Resolution        int
+	Width             int // width of source for display, after rotation
+	Height            int // height of source for display, after rotation
+	Resolution        int // short edge of source
+	Rotation          int // clockwise degrees which source is rotated for display
 	FPS               int
 	Duration          int
 	VideoBitrate      int
 	AudioBitrate      int
 	TranscodeDuration int
 	Resolutions       []resolution.Resolution
+	Renditions        []Rendition
+	Subtitles         []Subtitle
+	Images            *Images  // nil if no image is requested or generated
+	Preview           *Preview // nil if no preview is requested or generated
+	Encoder           EncoderReport
+	GOP               *ffprobe.GOPInfo // gop structure of source, nil if it cannot be analyzed
+	Watchdog          []WatchdogEvent  // actions of watchdog on stages, in order of time
+	Paused            *PausePoint      // nil if the job is not paused
+}
+
+// PausePoint where a paused job is resumed, the completed segments before it are kept in the stored folder
+type PausePoint struct {
+	Time         float64 `json:"time"`          // secs of source, the end of the completed segments
+	LastSegments []int64 `json:"last_segments"` // index of the last completed segment of each rendition, -1 if none is completed
+}
+
+// Stage a run of ffmpeg in the job, the renditions are transcoded first and the artifacts are generated after them
+type Stage string
+
+const (
+	StageTranscode Stage = "transcode"
+	StageSubtitles Stage = "subtitles"
+	StageImages    Stage = "images"
+	StagePreview   Stage = "preview"
+)
+
+// Progress an event of progress of the running stage
+type Progress struct {
+	Stage   Stage   `json:"stage"`
+	Frame   int64   `json:"frame"`
+	FPS     float64 `json:"fps"`
+	Bitrate float64 `json:"bitrate"` // bits/s, 0 if it is unknown
+	Time    float64 `json:"time"`    // secs of output
+	Speed   float64 `json:"speed"`   // multiplier of realtime, 0 if it is unknown
+	Percent float64 `json:"percent"` // 0 if duration is unknown
+	ETA     float64 `json:"eta"`     // secs, negative if it is unknown
+	Ended   bool    `json:"ended"`   // the last event of stage
+}
+
+// WatchdogAction what the watchdog did on a running stage
+type WatchdogAction string
+
+const (
+	WatchdogSlow      WatchdogAction = "slow"      // speed fell below min speed
+	WatchdogRecovered WatchdogAction = "recovered" // speed is back to min speed
+	WatchdogAbort     WatchdogAction = "abort"     // ffmpeg is stopped because it stalled or was slow for too long
+)
+
+// WatchdogEvent an action of the watchdog and the progress of stage when it was taken
+type WatchdogEvent struct {
+	Stage  Stage          `json:"stage"`
+	Action WatchdogAction `json:"action"`
+	Reason string         `json:"reason"`
+	Frame  int64          `json:"frame"`
+	Time   float64        `json:"time"`  // secs of output
+	Speed  float64        `json:"speed"` // 0 if it is unknown
 }
 
 type ITranscoder interface {
 	Transcode(ctx context.Context) (OutputData, error)
 	Stop(isPause bool) error
 	Output() chan UploadFile
+	// Progress events of the running stage, they are dropped if the receiver is slow
+	// it is closed when Transcode returns
+	Progress() chan Progress
 }
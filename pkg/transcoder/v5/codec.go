@@ -0,0 +1,160 @@
+package v5
+
+import (
+	"fmt"
+)
+
+// Codec video codec of retention
+type Codec string
+
+const (
+	H264 Codec = "h264"
+	HEVC Codec = "hevc"
+	AV1  Codec = "av1"
+)
+
+type codecInfo struct {
+	efficiency int64  // percent of h264 bitrate needed for the same quality
+	tag        string // codec tag of stream, empty for the default one
+	fmp4       bool   // hls needs fmp4 segments for this codec
+}
+
+var codecInfos = map[Codec]codecInfo{
+	H264: {efficiency: 100},
+	HEVC: {efficiency: 60, tag: "hvc1", fmp4: true},
+	AV1:  {efficiency: 50, fmp4: true},
+}
+
+// GetCodec return the codec of name, ok is false if codec is not supported
+func GetCodec(name string) (codec Codec, ok bool) {
+	_, ok = codecInfos[Codec(name)]
+	return Codec(name), ok
+}
+
+// efficiency percent of h264 bitrate that codec needs for the same quality
+// unknown codecs are considered as h264
+func efficiency(codec string) int64 {
+	if info, ok := codecInfos[Codec(codec)]; ok {
+		return info.efficiency
+	}
+	return 100
+}
+
+// h264 profile_idc of encoders, used for codecs attribute
+var h264EncoderProfiles = map[string]int{
+	"h264_nvenc": 77,  // main
+	"libx264":    100, // high
+}
+
+// h264 profile_idc of source profile names reported by ffprobe
+var h264Profiles = map[string]int{
+	"Constrained Baseline":  66,
+	"Baseline":              66,
+	"Main":                  77,
+	"Extended":              88,
+	"High":                  100,
+	"High 10":               110,
+	"High 4:2:2":            122,
+	"High 4:4:4 Predictive": 244,
+}
+
+type codecLevel struct {
+	idc        int   // level value in codecs string
+	maxPicSize int64 // h264: macroblocks per frame, hevc and av1: luma samples per frame
+	maxRate    int64 // h264: macroblocks per sec, hevc and av1: luma samples per sec
+}
+
+var h264Levels = []codecLevel{
+	{10, 99, 1485}, {11, 396, 3000}, {12, 396, 6000}, {13, 396, 11880},
+	{20, 396, 11880}, {21, 792, 19800}, {22, 1620, 20250},
+	{30, 1620, 40500}, {31, 3600, 108000}, {32, 5120, 216000},
+	{40, 8192, 245760}, {41, 8192, 245760}, {42, 8704, 522240},
+	{50, 22080, 589824}, {51, 36864, 983040}, {52, 36864, 2073600},
+	{60, 139264, 4177920}, {61, 139264, 8355840}, {62, 139264, 16711680},
+}
+
+// level_idc of hevc is level * 30
+var hevcLevels = []codecLevel{
+	{30, 36864, 552960},
+	{60, 122880, 3686400}, {63, 245760, 7372800},
+	{90, 552960, 16588800}, {93, 983040, 33177600},
+	{120, 2228224, 66846720}, {123, 2228224, 133693440},
+	{150, 8912896, 267386880}, {153, 8912896, 534773760}, {156, 8912896, 1069547520},
+	{180, 35651584, 1069547520}, {183, 35651584, 2139095040}, {186, 35651584, 4278190080},
+}
+
+// seq_level_idx of av1
+var av1Levels = []codecLevel{
+	{0, 147456, 4423680}, {1, 278784, 8363520},
+	{4, 665856, 19975680}, {5, 1065024, 31950720},
+	{8, 2359296, 70778880}, {9, 2359296, 141557760},
+	{12, 8912896, 267386880}, {13, 8912896, 534773760}, {14, 8912896, 1069547520},
+	{16, 35651584, 1069547520}, {17, 35651584, 2139095040}, {18, 35651584, 4278190080},
+}
+
+// findLevel the lowest level which supports picture size and rate, the highest level if none
+func findLevel(levels []codecLevel, picSize, rate int64) int {
+	for _, lv := range levels {
+		if picSize <= lv.maxPicSize && rate <= lv.maxRate {
+			return lv.idc
+		}
+	}
+	return levels[len(levels)-1].idc
+}
+
+// videoCodecString RFC 6381 codecs string of a video encoded by encoder
+// eg: avc1.640028, hvc1.1.6.L120.B0, av01.0.08M.08
+func videoCodecString(codec Codec, encoder string, width, height, fps int) string {
+	switch codec {
+	case HEVC:
+		level := findLevel(hevcLevels, int64(width*height), int64(width*height*fps))
+		return fmt.Sprintf("hvc1.1.6.L%d.B0", level)
+	case AV1:
+		level := findLevel(av1Levels, int64(width*height), int64(width*height*fps))
+		return fmt.Sprintf("av01.0.%02dM.08", level)
+	default:
+		mbs := int64(((width + 15) / 16) * ((height + 15) / 16))
+		level := findLevel(h264Levels, mbs, mbs*int64(fps))
+		profile, ok := h264EncoderProfiles[encoder]
+		if !ok {
+			profile = 100
+		}
+		return h264CodecString(profile, level)
+	}
+}
+
+// sourceH264CodecString codecs string of h264 source which is copied into retention
+func sourceH264CodecString(profile string, level int) string {
+	idc, ok := h264Profiles[profile]
+	if !ok {
+		idc = 100
+	}
+	return h264CodecString(idc, level)
+}
+
+func h264CodecString(profile, level int) string {
+	constraints := 0
+	if profile == 66 || profile == 77 {
+		// constraint_set1_flag, baseline and main streams are decodable by main profile decoders
+		constraints = 0x40
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", profile, constraints, level)
+}
+
+// audioCodecStrings RFC 6381 codecs string of audio codecs reported by ffprobe
+var audioCodecStrings = map[string]string{
+	"aac":  "mp4a.40.2",
+	"mp3":  "mp4a.40.34",
+	"ac3":  "ac-3",
+	"eac3": "ec-3",
+	"opus": "Opus",
+	"flac": "fLaC",
+}
+
+// audioCodecString codecs string of audio, encoded audio is aac
+func audioCodecString(sourceCodec string, copied bool) string {
+	if s, ok := audioCodecStrings[sourceCodec]; ok && copied {
+		return s
+	}
+	return audioCodecStrings["aac"]
+}
@@ -2,10 +2,13 @@ package v5
 
 import (
 	"fmt"
+	"math"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"transcode/pkg/config"
+	"transcode/pkg/ffprobe"
 	"transcode/pkg/resolution"
 )
 
@@ -14,43 +17,46 @@ var (
 	Mb       = Kb * Kb
 	tmpVideo = []string{"-map", "v:0"}
 	tmpAudio = []string{"-map", "a:0"}
+
+	// codecs of source that can be copied into hls mpegts segments without re-encoding
+	copyableCodecs = map[string]struct{}{
+		"h264": {},
+	}
+)
+
+const (
+	masterName   = "master.m3u8"  // hls master playlist
+	manifestName = "manifest.mpd" // dash manifest
+	audioGroup   = "audio"        // agroup of alternate audio renditions, ffmpeg writes it as GROUP-ID="group_audio"
+)
+
+// OutputFormat adaptive streaming format of output
+type OutputFormat string
+
+const (
+	HLSFormat  OutputFormat = "hls"  // master.m3u8, a media playlist and mpegts segments for each retention
+	DASHFormat OutputFormat = "dash" // manifest.mpd, fmp4 init and media segments for each representation
+	// CMAFFormat fmp4 segments of dash, which are shared with hls: manifest.mpd, master.m3u8
+	// and a media playlist for each representation with EXT-X-MAP of its init segment
+	CMAFFormat OutputFormat = "cmaf"
 )
 
 var defaultCommandBuilder CommandBuilder
 
 func init() {
-	defaultCommandBuilder.df1080Bitrate = Mb * 35 / 10                                 // 3.5Mb
-	defaultCommandBuilder.df720Bitrate = defaultCommandBuilder.df1080Bitrate * 10 / 18 // df1080 / 1.8, 2.2Mb
-	defaultCommandBuilder.df480Bitrate = defaultCommandBuilder.df720Bitrate * 10 / 18  // df720 / 1.8, 1.2Mb
-	defaultCommandBuilder.df360Bitrate = defaultCommandBuilder.df480Bitrate * 10 / 16  // df480 / 1.6, 790Kb
-	defaultCommandBuilder.df1080AudioBitrate = 256 * Kb
-	defaultCommandBuilder.df720AudioBitrate = 192 * Kb
-	defaultCommandBuilder.df480AudioBitrate = 128 * Kb
-	defaultCommandBuilder.df360AudioBitrate = 96 * Kb
-	defaultCommandBuilder.defaultBitrate = map[resolution.Resolution]defaultBitRate{
-		resolution.R1080: {defaultCommandBuilder.df1080Bitrate, defaultCommandBuilder.df1080AudioBitrate},
-		resolution.R720:  {defaultCommandBuilder.df720Bitrate, defaultCommandBuilder.df720AudioBitrate},
-		resolution.R480:  {defaultCommandBuilder.df480Bitrate, defaultCommandBuilder.df480AudioBitrate},
-		resolution.R360:  {defaultCommandBuilder.df360Bitrate, defaultCommandBuilder.df360AudioBitrate},
-	}
+	defaultCommandBuilder.df1080Bitrate = resolution.RungOf(resolution.R1080).Bitrate // 3.5Mb
 	defaultCommandBuilder.ignoreResolutionThreshold = 150 * Kb
 	defaultCommandBuilder.frameRateThreshold = 48
 	defaultCommandBuilder.targetDuration = 6
+	defaultCommandBuilder.encoder = NvencEncoder
 }
 
 type CommandBuilder struct {
-	df1080Bitrate             int64
-	df720Bitrate              int64
-	df480Bitrate              int64
-	df360Bitrate              int64
-	df1080AudioBitrate        int64
-	df720AudioBitrate         int64
-	df480AudioBitrate         int64
-	df360AudioBitrate         int64
-	defaultBitrate            map[resolution.Resolution]defaultBitRate
+	df1080Bitrate             int64 // default bitrate of 1080, bitrates of other resolutions are scaled with it
 	ignoreResolutionThreshold int64
 	frameRateThreshold        int
 	targetDuration            int
+	encoder                   EncoderName
 }
 
 func NewCommandBuilder(cfg config.ServerConfig) *CommandBuilder {
@@ -64,6 +70,9 @@ func NewCommandBuilder(cfg config.ServerConfig) *CommandBuilder {
 	if cfg.TargetSegmentDuration > 0 {
 		cb.targetDuration = cfg.TargetSegmentDuration
 	}
+	if _, ok := GetEncoder(EncoderName(cfg.Encoder)); ok {
+		cb.encoder = EncoderName(cfg.Encoder)
+	}
 	return &cb
 }
 
@@ -73,8 +82,54 @@ type defaultBitRate struct {
 }
 
 type filterBitRate struct {
-	inputBitRate string
-	maxRate      string
+	bitRate int64
+}
+
+func (f filterBitRate) inputBitRate() string {
+	return fmt.Sprintf("%dk", f.bitRate/Kb)
+}
+
+func (f filterBitRate) maxRate() string {
+	return fmt.Sprintf("%dk", f.bitRate*150/100/Kb) // max_rate = bitrate * 1.5
+}
+
+// rendition a retention of output, which is a resolution encoded with a codec
+type rendition struct {
+	Resolution   resolution.Resolution
+	Codec        Codec
+	Width        int
+	Height       int
+	FrameRate    int
+	NoVideo      bool                 // audio-only retention
+	NoAudio      bool                 // video-only retention
+	Copy         bool                 // video is copied from source instead of encoding
+	CopyAudio    bool                 // audio is copied from source instead of encoding
+	AudioBitRate int64                // bitrate of encoded audio
+	AudioGroup   string               // group of alternate audio renditions which this rendition belongs to or references
+	Audio        *ffprobe.AudioStream // source track of alternate audio rendition, nil for the other ones
+	GroupAudio   *ffprobe.AudioStream // default source track of the audio group which video variant references
+	bitRate      filterBitRate
+}
+
+// codecsString RFC 6381 codecs of rendition, eg: avc1.640028,mp4a.40.2
+func (r rendition) codecsString(enc Encoder, info *ffprobe.InputInfo) string {
+	codecs := make([]string, 0, 2)
+	if !r.NoVideo {
+		video := videoCodecString(r.Codec, enc.VideoCodec(r.Codec), r.Width, r.Height, r.FrameRate)
+		if r.Copy {
+			video = sourceH264CodecString(info.Profile, info.Level)
+		}
+		codecs = append(codecs, video)
+	}
+	if r.Audio != nil {
+		codecs = append(codecs, audioCodecString(r.Audio.CodecName, r.CopyAudio))
+	} else if r.GroupAudio != nil {
+		// variant lists the codec of the default rendition of its audio group
+		codecs = append(codecs, audioCodecString(r.GroupAudio.CodecName, r.CopyAudio))
+	} else if !r.NoAudio {
+		codecs = append(codecs, audioCodecString(info.AudioCodecName, r.CopyAudio))
+	}
+	return strings.Join(codecs, ",")
 }
 
 type CommandConfig struct {
@@ -90,42 +145,245 @@ type CommandConfig struct {
 	SourceBitRate      int64                   `json:"source_bit_rate"`
 	SourceAudioBitRate int64                   `json:"source_audio_bit_rate"`
 	SourceFrameRate    int                     `json:"source_frame_rate"`
+	SourceRotation     int                     `json:"source_rotation"`      // clockwise degrees which video is rotated for display
+	SourceNoVideo      bool                    `json:"source_no_video"`      // source has no video stream, output is audio-only
+	SourceNoAudio      bool                    `json:"source_no_audio"`      // source has no audio stream, output is video-only
+	SourceAudioStreams []ffprobe.AudioStream   `json:"source_audio_streams"` // several ones are alternate audio renditions of hls
+	Encoder            EncoderName             `json:"encoder"`              // empty for the default encoder of builder
+	SourceVideoCodec   string                  `json:"source_video_codec"`   // eg: h264
+	SourceGOP          *ffprobe.GOPInfo        `json:"source_gop"`           // nil if unknown
+	Formats            []OutputFormat          `json:"formats"`              // empty for hls only
+	Codecs             []Codec                 `json:"codecs"`               // a ladder for each codec, empty for h264 only
+	Naming             NamingTemplate          `json:"naming"`               // names of hls files, empty for the default ones
+	Overlays           []Overlay               `json:"overlays"`             // drawn on every rendition in order
+	StartTime          float64                 `json:"start_time"`           // secs of source which a resumed job starts from
+	StartNumber        int64                   `json:"start_number"`         // index of the first hls segment of a resumed job
 }
 
-func (b *CommandBuilder) downBitRateValue(bitRate int64, currentRes resolution.Resolution, targetRes resolution.Resolution) int64 {
-	defBitRate := b.defaultBitrate[currentRes]
-	if bitRate > defBitRate.Video {
-		bitRate = defBitRate.Video
+// codecs return the requested codecs, h264 is the default one
+func (c CommandConfig) codecs() []Codec {
+	if len(c.Codecs) == 0 {
+		return []Codec{H264}
 	}
-	for currentRes.Level() > targetRes.Level() {
-		switch currentRes {
-		case resolution.R1080, resolution.R720:
-			bitRate = bitRate * 10 / 18
-		case resolution.R480:
-			bitRate = bitRate * 10 / 16
+	return c.Codecs
+}
+
+func (c CommandConfig) hasCodec(codec Codec) bool {
+	for _, cc := range c.codecs() {
+		if cc == codec {
+			return true
 		}
-		currentRes = resolution.FromLevel(currentRes.Level() - 1)
 	}
+	return false
+}
 
-	return bitRate
+// alternateAudio audio streams are demuxed into alternate renditions which are referenced by video variants
+// it is only for hls output of source which has several audio streams, dash keeps the first audio stream
+func (c CommandConfig) alternateAudio() bool {
+	formats := c.formats()
+	return !c.SourceNoVideo && len(c.SourceAudioStreams) > 1 && len(formats) == 1 && formats[0] == HLSFormat
+}
+
+// formats return the requested output formats, hls is the default one
+func (c CommandConfig) formats() []OutputFormat {
+	if len(c.Formats) == 0 {
+		return []OutputFormat{HLSFormat}
+	}
+	return c.Formats
 }
 
-func (b *CommandBuilder) buildCommand(cfg CommandConfig) ([]string, []resolution.Resolution) {
-	m3u8Output := filepath.Join(cfg.StoredFolderPath, "stream_%v.m3u8")
-	tsOutput := filepath.Join(cfg.StoredFolderPath, "stream_%v_data%02d.ts")
+// defaultBitrate default bitrates of resolution from the ladder table
+// video bitrate is scaled by the configured bitrate of 1080
+func (b *CommandBuilder) defaultBitrate(res resolution.Resolution) defaultBitRate {
+	rung := resolution.RungOf(res)
+	ref := resolution.RungOf(resolution.R1080).Bitrate
+	return defaultBitRate{
+		Video: rung.Bitrate * b.df1080Bitrate / ref,
+		Audio: rung.AudioBitrate,
+	}
+}
+
+func (b *CommandBuilder) downBitRateValue(bitRate int64, currentRes resolution.Resolution, targetRes resolution.Resolution) int64 {
+	defBitRate := b.defaultBitrate(currentRes)
+	if bitRate > defBitRate.Video {
+		bitRate = defBitRate.Video
+	}
+	return resolution.StepDown(bitRate, currentRes, targetRes)
+}
 
+func (b *CommandBuilder) buildCommand(cfg CommandConfig) ([]string, []rendition) {
+	if cfg.SourceNoVideo {
+		renditions := []rendition{b.buildAudioRendition(cfg)}
+		return b.buildTranscodeCommand(cfg, renditions), renditions
+	}
 	cfg.TargetResolutions = b.chooseTargetResolutions(cfg)
 	if len(cfg.TargetResolutions) == 0 {
 		return nil, nil
 	}
 	var filterBitRates map[resolution.Resolution]filterBitRate
 	filterBitRates, cfg.TargetResolutions = b.buildFilterBitRates(cfg)
+	renditions := b.buildRenditions(cfg, filterBitRates)
+
+	args := b.buildTranscodeCommand(cfg, renditions)
+	return args, renditions
+}
 
-	args := b.buildTranscodeCommand(cfg, filterBitRates, m3u8Output, tsOutput)
-	return args, cfg.TargetResolutions
+// buildRenditions build a ladder of target resolutions for each codec, ladders are in the order of requested codecs
+// bitrates of h264 are scaled by the efficiency of codec
+func (b *CommandBuilder) buildRenditions(cfg CommandConfig, bitRates map[resolution.Resolution]filterBitRate) []rendition {
+	copySource := b.canCopySource(cfg)
+	renditions := make([]rendition, 0, len(cfg.TargetResolutions)*len(cfg.codecs()))
+	for _, codec := range cfg.codecs() {
+		for i, res := range cfg.TargetResolutions {
+			dbr := b.defaultBitrate(res)
+			r := rendition{
+				Resolution:   res,
+				Codec:        codec,
+				FrameRate:    cfg.SourceFrameRate,
+				Copy:         copySource && codec == H264 && i == 0,
+				NoAudio:      cfg.SourceNoAudio,
+				CopyAudio:    cfg.SourceAudioBitRate <= dbr.Audio,
+				AudioBitRate: dbr.Audio,
+				bitRate:      filterBitRate{bitRate: bitRates[res].bitRate * codecInfos[codec].efficiency / 100},
+			}
+			r.Width, r.Height = scaledSize(cfg.SourceWidth, cfg.SourceHeight, res)
+			if res < resolution.R1080 && cfg.SourceFrameRate >= b.frameRateThreshold {
+				// only retentions from 1080 keep the source fps
+				r.FrameRate = cfg.SourceFrameRate / 2
+			}
+			renditions = append(renditions, r)
+		}
+	}
+	if cfg.alternateAudio() {
+		renditions = b.addAlternateAudio(cfg, renditions)
+	}
+	return renditions
 }
 
-func (b *CommandBuilder) buildTranscodeCommand(cfg CommandConfig, bitRates map[resolution.Resolution]filterBitRate, m3u8Output, tsOutput string) []string {
+// addAlternateAudio demux audio of video renditions into a rendition for each audio stream of source
+// audio streams are copied if they can be put into segments as they are, the other ones are encoded to aac stereo
+// the default stream is the first one which has default disposition, or the first stream
+func (b *CommandBuilder) addAlternateAudio(cfg CommandConfig, renditions []rendition) []rendition {
+	dbr := b.defaultBitrate(cfg.TargetResolutions[0])
+	defaultIdx := 0
+	for i, s := range cfg.SourceAudioStreams {
+		if s.Default {
+			defaultIdx = i
+			break
+		}
+	}
+	streams := make([]ffprobe.AudioStream, len(cfg.SourceAudioStreams))
+	for i, s := range cfg.SourceAudioStreams {
+		s.Default = i == defaultIdx
+		streams[i] = s
+	}
+	for i := range renditions {
+		renditions[i].NoAudio = true
+		renditions[i].AudioGroup = audioGroup
+		renditions[i].GroupAudio = &streams[defaultIdx]
+		renditions[i].CopyAudio = copyableAudio(streams[defaultIdx], dbr.Audio)
+	}
+	for i := range streams {
+		renditions = append(renditions, rendition{
+			NoVideo:      true,
+			CopyAudio:    copyableAudio(streams[i], dbr.Audio),
+			AudioBitRate: dbr.Audio,
+			AudioGroup:   audioGroup,
+			Audio:        &streams[i],
+		})
+	}
+	return renditions
+}
+
+// copyableAudio the audio stream can be copied into hls segments instead of encoding
+// players support aac, mp3, ac3 and eac3 in mpegts, streams with more than 2 channels or unknown bitrate are encoded to stereo
+func copyableAudio(s ffprobe.AudioStream, maxBitRate int64) bool {
+	switch s.CodecName {
+	case "aac", "mp3", "ac3", "eac3":
+		return s.Channels > 0 && s.Channels <= 2 && s.BitRate > 0 && s.BitRate <= maxBitRate
+	}
+	return false
+}
+
+// buildAudioRendition the retention of audio-only source
+// audio is copied if source bitrate is not higher than the default audio bitrate of the top resolution
+func (b *CommandBuilder) buildAudioRendition(cfg CommandConfig) rendition {
+	top := resolution.R1080
+	if len(cfg.TargetResolutions) > 0 {
+		top = cfg.TargetResolutions[0]
+		for _, r := range cfg.TargetResolutions {
+			top = max(top, r)
+		}
+	}
+	dbr := b.defaultBitrate(top)
+	return rendition{
+		NoVideo:      true,
+		CopyAudio:    cfg.SourceAudioBitRate <= dbr.Audio,
+		AudioBitRate: dbr.Audio,
+	}
+}
+
+// scaledSize the size of video whose short edge is scaled to resolution, keeping aspect ratio
+// the long edge is divisible by 2 like scale=-2:height
+// eg: 1920x1080 to 720 is 1280x720, 1080x1920 to 720 is 720x1280
+func scaledSize(width, height int64, res resolution.Resolution) (int, int) {
+	if width < height {
+		return int(res), scaledEdge(height, width, int64(res))
+	}
+	return scaledEdge(width, height, int64(res)), int(res)
+}
+
+// scaledEdge the long edge when short edge is scaled
+func scaledEdge(long, short, scaledShort int64) int {
+	if short == 0 {
+		return 0
+	}
+	return int(math.Round(float64(long*scaledShort)/float64(short)/2) * 2)
+}
+
+// portrait video is taller than wide after rotation
+func (c CommandConfig) portrait() bool {
+	return c.SourceWidth < c.SourceHeight
+}
+
+// canCopySource check if the top retention can be remuxed from source instead of re-encoding
+// source must have the resolution of top retention, a codec that can be put into segments,
+// a bitrate under the default of top retention and keyframes spacing which is usable as segment duration
+func (b *CommandBuilder) canCopySource(cfg CommandConfig) bool {
+	top := cfg.TargetResolutions[0]
+	if top != cfg.SourceResolution {
+		return false
+	}
+	if cfg.SourceRotation != 0 {
+		// players of hls segments don't apply rotation of stream
+		return false
+	}
+	if len(cfg.Overlays) > 0 {
+		// overlays are drawn on decoded frames
+		return false
+	}
+	if _, ok := copyableCodecs[cfg.SourceVideoCodec]; !ok {
+		return false
+	}
+	if !cfg.hasCodec(H264) {
+		return false
+	}
+	if cfg.SourceBitRate > b.defaultBitrate(top).Video {
+		return false
+	}
+	// segments are cut at source keyframes, so too long gop makes segments too long
+	gop := cfg.SourceGOP
+	return gop != nil && gop.KeyframeCount > 1 && gop.MaxInterval <= float64(2*b.targetDuration)
+}
+
+// formatSeconds format seconds for ffmpeg args
+// it is truncated to microseconds, so hls muxer won't miss the keyframe at exactly sec
+func formatSeconds(sec float64) string {
+	return strconv.FormatFloat(math.Floor(sec*1e6)/1e6, 'f', -1, 64)
+}
+
+// buildTranscodeCommand build the ffmpeg args, with an output for each requested format
+func (b *CommandBuilder) buildTranscodeCommand(cfg CommandConfig, renditions []rendition) []string {
 	// example command:
 	// ffmpeg -y -hwaccel cuda -hwaccel_output_format cuda -i rtmp://127.0.0.1:1935/live/7868802855338312
 	// -preset medium -c:v h264_nvenc -no-scenecut 1 -forced-idr 1 -force_key_frames "expr:gte(t,n_forced*6)"
@@ -141,79 +399,201 @@ func (b *CommandBuilder) buildTranscodeCommand(cfg CommandConfig, bitRates map[r
 	// -master_pl_name master.m3u8
 	// -var_stream_map "v:0,a:0 v:1,a:1 v:2,a:2 v:3,a:3"
 	// -fps_mode passthrough output/53011690794520577/1678766701573/stream_%v.m3u8
+	// the software encoder produces the same command without hardware decoding, using libx264 and scale filters
 
-	args := []string{
-		"-y", "-threads", "1", "-hwaccel", "cuda", "-hwaccel_output_format", "cuda", "-i", cfg.FilePath,
-		"-preset", "medium", "-c:v", "h264_nvenc", "-no-scenecut", "1", "-forced-idr", "1",
-		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", b.targetDuration), "-ac", "2",
+	// when the top retention is copied from source, the codecs are set per stream:
+	// -c:v:0 copy -c:a:0 copy -c:v:1 h264_nvenc -filter:v:1 scale_npp=-2:720 ...
+	// and -force_key_frames source -hls_time <multiple of source keyframe interval> to align segments of all retentions
+
+	// portrait video is scaled by its width, which is the short edge: -filter:v:1 scale_npp=720:-2
+	// rotated video is decoded to system memory so ffmpeg can rotate it, then uploaded for scaling:
+	// -hwaccel cuda ... -filter:v:1 hwupload_cuda,scale_npp=720:-2
+
+	// overlays are drawn on scaled frames in system memory, images are loaded by movie sources:
+	// -filter:v:1 movie='logo.png',scale=192:-1,format=rgba[wm0];scale_npp=-2:720,hwdownload,format=nv12[bg0];[bg0][wm0]overlay=x=W-w-22:y=H-h-22
+
+	// when there are ladders of several codecs, the encoder and its options are set per stream:
+	// -c:v:3 hevc_nvenc -no-scenecut:v:3 1 -forced-idr:v:3 1 -filter:v:3 scale_npp=-2:1080 ... -tag:v:3 hvc1
+
+	enc := b.chooseEncoder(cfg.Encoder)
+	segmentTime := b.segmentTime(cfg, renditions)
+	args := []string{"-y"}
+	if !cfg.SourceNoVideo {
+		args = append(args, enc.InputArgs(cfg.SourceRotation != 0)...)
+	}
+	if cfg.StartTime > 0 {
+		// a resumed job seeks to the end of its completed segments
+		args = append(args, "-ss", formatSeconds(cfg.StartTime))
+	}
+	args = append(args, "-i", cfg.FilePath)
+
+	if formats := cfg.formats(); len(formats) > 1 {
+		// hls and dash muxers share the encoded streams through tee muxer, so each rendition is encoded once
+		// dash keeps the video streams and the first audio stream
+		// tee muxer has no default encoder, audio which is not copied is encoded to aac
+		args = append(args, "-c:a", "aac")
+		args = append(args, b.buildStreamArgs(cfg, enc, renditions, false)...)
+		dashStreams := "v,a:0"
+		if cfg.SourceNoVideo || cfg.SourceNoAudio {
+			dashStreams = ""
+		}
+		return append(args, teeArgs(
+			teeSlave(b.buildHLSArgs(cfg, renditions, segmentTime), ""),
+			teeSlave(b.buildDASHArgs(cfg, renditions, segmentTime, false), dashStreams),
+		)...)
+	}
+	for _, format := range cfg.formats() {
+		switch format {
+		case DASHFormat, CMAFFormat:
+			args = append(args, b.buildStreamArgs(cfg, enc, renditions, true)...)
+			args = append(args, b.buildDASHArgs(cfg, renditions, segmentTime, format == CMAFFormat)...)
+		default:
+			args = append(args, b.buildStreamArgs(cfg, enc, renditions, false)...)
+			args = append(args, b.buildHLSArgs(cfg, renditions, segmentTime)...)
+		}
+	}
+
+	return args
+}
+
+// segmentTime the duration of segments of renditions, in seconds
+// segments have the same duration if source gop is fixed, otherwise they are cut at the first keyframe after targetDuration
+func (b *CommandBuilder) segmentTime(cfg CommandConfig, renditions []rendition) string {
+	if hasCopy(renditions) {
+		return formatSeconds(cfg.SourceGOP.SegmentDuration(float64(b.targetDuration)))
 	}
+	return strconv.Itoa(b.targetDuration)
+}
+
+func hasCopy(renditions []rendition) bool {
+	for _, r := range renditions {
+		if r.Copy {
+			return true
+		}
+	}
+	return false
+}
 
-	resLen := len(cfg.TargetResolutions)
+// needFMP4 check if a codec of renditions cannot be put into mpegts segments
+func needFMP4(renditions []rendition) bool {
+	for _, r := range renditions {
+		if codecInfos[r.Codec].fmp4 {
+			return true
+		}
+	}
+	return false
+}
+
+// streamOptions add the stream specifier of video idx to options, eg: -forced-idr 1 => -forced-idr:v:1 1
+func streamOptions(options []string, idx int) []string {
+	res := make([]string, 0, len(options))
+	for _, o := range options {
+		if strings.HasPrefix(o, "-") {
+			o = fmt.Sprintf("%s:v:%d", o, idx)
+		}
+		res = append(res, o)
+	}
+	return res
+}
+
+// buildStreamArgs build the options of streams of an output: mapping, codecs, filters and bitrates
+// singleAudio: audio is mapped once for all retentions instead of once per retention
+func (b *CommandBuilder) buildStreamArgs(cfg CommandConfig, enc Encoder, renditions []rendition, singleAudio bool) []string {
+	if cfg.SourceNoVideo {
+		return buildAudioStreamArgs(renditions)
+	}
+	codecs := cfg.codecs()
+	copySource := hasCopy(renditions)
+	// encoder and its options are set for all streams if all retentions are encoded with the same codec
+	sharedEncoder := len(codecs) == 1 && !copySource
+	sharedOptions := len(codecs) == 1
+
+	forceKeyFrames := fmt.Sprintf("expr:gte(t,n_forced*%d)", b.targetDuration)
+	if copySource {
+		forceKeyFrames = "source"
+	}
+	args := []string{"-preset", "medium"}
+	if sharedEncoder {
+		args = append(args, "-c:v", enc.VideoCodec(codecs[0]))
+	}
+	if sharedOptions {
+		args = append(args, enc.CodecArgs(codecs[0])...)
+	}
+	args = append(args, "-force_key_frames", forceKeyFrames)
+	if !cfg.SourceNoAudio {
+		args = append(args, "-ac", "2")
+	}
+
+	resLen := len(renditions)
 	videoMap := make([]string, 0, resLen*2)
 	audioMap := make([]string, 0, resLen*2)
 	filterList := make([]string, 0, resLen*2)
 	bitRateList := make([]string, 0, resLen*2)
-	streamMap := make([]string, 0, resLen*2)
 
-	scaleDownFrameRate := 0
-	if cfg.SourceFrameRate >= b.frameRateThreshold {
-		// if source fps >= fps threshold, minimize it by 2
-		scaleDownFrameRate = cfg.SourceFrameRate / 2
-	}
-	for idx, res := range cfg.TargetResolutions {
-		dbr := b.defaultBitrate[res]
+	audioIdx := 0 // index of output audio stream
+	for idx, r := range renditions {
+		if r.Audio != nil {
+			// alternate audio is mapped from its source stream after the video renditions
+			audioMap = append(audioMap, "-map", fmt.Sprintf("0:%d", r.Audio.Index))
+			bitRateList = append(bitRateList, audioBitRateArgs(r, audioIdx)...)
+			audioIdx++
+			continue
+		}
+		hasAudio := !r.NoAudio && (!singleAudio || idx == 0)
 		videoMap = append(videoMap, tmpVideo...)
-		audioMap = append(audioMap, tmpAudio...)
-		streamMap = append(streamMap, fmt.Sprintf("v:%d,a:%d", idx, idx))
 		var filter, bitRate []string
-		if cfg.SourceAudioBitRate > dbr.Audio {
-			bitRate = []string{fmt.Sprintf("-b:a:%d", idx), fmt.Sprintf("%dk", dbr.Audio/Kb)}
-		} else {
-			bitRate = []string{fmt.Sprintf("-c:a:%d", idx), "copy"}
+		if hasAudio {
+			audioMap = append(audioMap, tmpAudio...)
+			bitRate = audioBitRateArgs(r, audioIdx)
+			audioIdx++
 		}
-		switch res {
-		case resolution.R1080:
-			filter = []string{
-				fmt.Sprintf("-filter:v:%d", idx), "scale_npp=-2:1080",
-			}
-		case resolution.R720:
-			val := "scale_npp=-2:720"
-			if scaleDownFrameRate != 0 {
-				val = fmt.Sprintf("fps=%d,", scaleDownFrameRate) + val
-			}
-			filter = []string{
-				fmt.Sprintf("-filter:v:%d", idx), val,
-			}
-		case resolution.R480:
-			val := "scale_npp=-2:480"
-			if scaleDownFrameRate != 0 {
-				val = fmt.Sprintf("fps=%d,", scaleDownFrameRate) + val
-			}
-			filter = []string{
-				fmt.Sprintf("-filter:v:%d", idx), val,
+		if r.Copy {
+			filter = []string{fmt.Sprintf("-c:v:%d", idx), "copy"}
+			if hasAudio && r.CopyAudio {
+				filter = append(filter, bitRate...)
 			}
-		case resolution.R360:
-			val := "scale_npp=-2:360"
-			if scaleDownFrameRate != 0 {
-				val = fmt.Sprintf("fps=%d,", scaleDownFrameRate) + val
-			}
-			filter = []string{
-				fmt.Sprintf("-filter:v:%d", idx), val,
+			filterList = append(filterList, filter...)
+			bitRateList = append(bitRateList, bitRate...)
+			continue
+		}
+		if !sharedEncoder {
+			filter = []string{fmt.Sprintf("-c:v:%d", idx), enc.VideoCodec(r.Codec)}
+		}
+		if !sharedOptions {
+			filter = append(filter, streamOptions(enc.CodecArgs(r.Codec), idx)...)
+		}
+		val := enc.ScaleFilter(-2, r.Height, cfg.SourceRotation != 0)
+		if cfg.portrait() {
+			val = enc.ScaleFilter(r.Width, -2, cfg.SourceRotation != 0)
+		}
+		if r.FrameRate != cfg.SourceFrameRate {
+			// if source fps >= fps threshold, minimize it by 2
+			val = fmt.Sprintf("fps=%d,", r.FrameRate) + val
+		}
+		if len(cfg.Overlays) > 0 {
+			// overlays are drawn by cpu filters on scaled frames
+			if download := enc.DownloadFilter(); download != "" {
+				val += "," + download
 			}
-		default:
-			val := fmt.Sprintf("scale_npp=-2:%d", res)
-			if scaleDownFrameRate != 0 {
-				val = fmt.Sprintf("fps=%d,", scaleDownFrameRate) + val
+			if cfg.StartTime > 0 {
+				// a resumed input starts at 0, overlays are drawn with the timestamps of source
+				// and output_ts_offset shifts the encoded frames, so they are shifted back after overlays
+				val += fmt.Sprintf(",setpts=PTS+%s/TB", formatSeconds(cfg.StartTime))
 			}
-			filter = []string{
-				fmt.Sprintf("-filter:v:%d", idx), val,
+			val = overlayFilters(val, cfg.Overlays, cfg.FilePath, r.Width, r.Height)
+			if cfg.StartTime > 0 {
+				val += fmt.Sprintf(",setpts=PTS-%s/TB", formatSeconds(cfg.StartTime))
 			}
 		}
+		filter = append(filter, fmt.Sprintf("-filter:v:%d", idx), val)
 		filter = append(filter, []string{
-			fmt.Sprintf("-b:v:%d", idx), bitRates[res].inputBitRate,
-			fmt.Sprintf("-maxrate:v:%d", idx), bitRates[res].maxRate,
-			fmt.Sprintf("-bufsize:v:%d", idx), bitRates[res].maxRate,
+			fmt.Sprintf("-b:v:%d", idx), r.bitRate.inputBitRate(),
+			fmt.Sprintf("-maxrate:v:%d", idx), r.bitRate.maxRate(),
+			fmt.Sprintf("-bufsize:v:%d", idx), r.bitRate.maxRate(),
 		}...)
+		if tag := codecInfos[r.Codec].tag; tag != "" {
+			filter = append(filter, fmt.Sprintf("-tag:v:%d", idx), tag)
+		}
 		filterList = append(filterList, filter...)
 		bitRateList = append(bitRateList, bitRate...)
 	}
@@ -222,22 +602,183 @@ func (b *CommandBuilder) buildTranscodeCommand(cfg CommandConfig, bitRates map[r
 	args = append(args, audioMap...)
 	args = append(args, filterList...)
 	args = append(args, bitRateList...)
+	return args
+}
 
-	args = append(args, []string{
+// audioBitRateArgs the codec or bitrate of output audio stream idx, eg: -c:a:0 copy or -b:a:0 192k
+func audioBitRateArgs(r rendition, idx int) []string {
+	if r.CopyAudio {
+		return []string{fmt.Sprintf("-c:a:%d", idx), "copy"}
+	}
+	return []string{fmt.Sprintf("-b:a:%d", idx), fmt.Sprintf("%dk", r.AudioBitRate/Kb)}
+}
+
+// buildAudioStreamArgs args of audio-only retentions
+// eg: -ac 2 -map a:0 -b:a:0 256k
+func buildAudioStreamArgs(renditions []rendition) []string {
+	args := []string{"-ac", "2"}
+	var bitRates []string
+	for idx, r := range renditions {
+		args = append(args, tmpAudio...)
+		bitRates = append(bitRates, audioBitRateArgs(r, idx)...)
+	}
+	return append(args, bitRates...)
+}
+
+// buildHLSArgs the hls output, files are named by the naming template of config
+// eg: {res}p/index.m3u8 and {res}p/seg_{n:05}.ts make -hls_segment_filename <folder>/%vp/seg_%05d.ts,
+// -var_stream_map "v:0,a:0,name:1080 v:1,a:1,name:720" and <folder>/%vp/index.m3u8
+// segments are fmp4 if a codec cannot be put into mpegts: -hls_segment_type fmp4 -hls_fmp4_init_filename %vp/index_init.mp4
+// alternate audio renditions are in a group which video variants reference:
+// -var_stream_map "v:0,agroup:audio v:1,agroup:audio a:0,agroup:audio,language:eng,default:yes a:1,agroup:audio,language:fra"
+func (b *CommandBuilder) buildHLSArgs(cfg CommandConfig, renditions []rendition, segmentTime string) []string {
+	fmp4 := needFMP4(renditions)
+	playlist, segment, init := cfg.Naming.ffmpegNames(fmp4)
+	names, _ := cfg.Naming.renditionNames(renditions)
+	streamMap := make([]string, 0, len(renditions))
+	videoIdx, audioIdx := 0, 0
+	for idx, r := range renditions {
+		streams := make([]string, 0, 5)
+		if !r.NoVideo {
+			streams = append(streams, fmt.Sprintf("v:%d", videoIdx))
+			videoIdx++
+		}
+		if !r.NoAudio {
+			streams = append(streams, fmt.Sprintf("a:%d", audioIdx))
+			audioIdx++
+		}
+		if r.AudioGroup != "" {
+			streams = append(streams, "agroup:"+r.AudioGroup)
+		}
+		if r.Audio != nil {
+			if lang := r.Audio.Language; lang != "" && !strings.ContainsAny(lang, ", :") {
+				streams = append(streams, "language:"+lang)
+			}
+			if r.Audio.Default {
+				streams = append(streams, "default:yes")
+			}
+		}
+		stream := strings.Join(streams, ",")
+		if names != nil {
+			stream += ",name:" + names[idx]
+		}
+		streamMap = append(streamMap, stream)
+	}
+
+	args := []string{
 		"-f", "hls",
-		"-hls_time", fmt.Sprintf("%d", b.targetDuration), "-hls_playlist_type", "vod", "-hls_flags", "independent_segments",
-		"-hls_segment_type", "mpegts", "-hls_segment_filename", tsOutput,
-	}...)
+		"-hls_time", segmentTime, "-hls_playlist_type", "vod", "-hls_flags", "independent_segments",
+	}
+	if fmp4 {
+		args = append(args, "-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", init)
+	} else {
+		args = append(args, "-hls_segment_type", "mpegts")
+	}
+	args = append(args, "-hls_segment_filename", filepath.Join(cfg.StoredFolderPath, segment))
 	if cfg.KeyInfoFilePath != "" {
 		args = append(args, "-hls_key_info_file", cfg.KeyInfoFilePath)
 	}
-	args = append(args, "-master_pl_name", "master.m3u8", "-var_stream_map", strings.Join(streamMap, " "),
-		"-fps_mode", "passthrough", m3u8Output,
+	if cfg.StartTime > 0 {
+		// timestamps and numbers of segments continue the completed ones, so they are appended without discontinuity
+		args = append(args, "-output_ts_offset", formatSeconds(cfg.StartTime),
+			"-start_number", strconv.FormatInt(cfg.StartNumber, 10))
+	}
+	args = append(args, "-master_pl_name", masterName, "-var_stream_map", strings.Join(streamMap, " "),
+		"-fps_mode", "passthrough", filepath.Join(cfg.StoredFolderPath, playlist),
 	)
+	return args
+}
 
+// buildDASHArgs build the dash output, video retentions of each codec are in an adaptation set and the audio is in another one
+// the representation id of video retention is its index, audio representation is the last one
+// eg: -f dash -seg_duration 6 -use_template 1 -use_timeline 1
+// -init_seg_name init_stream_$RepresentationID$.m4s -media_seg_name chunk_stream_$RepresentationID$_$Number%05d$.m4s
+// -adaptation_sets "id=0,streams=v id=1,streams=a" -fps_mode passthrough output/manifest.mpd
+// hlsPlaylist: also write master.m3u8 and media_<representation id>.m3u8 playlists of the same segments
+func (b *CommandBuilder) buildDASHArgs(cfg CommandConfig, renditions []rendition, segmentTime string, hlsPlaylist bool) []string {
+	args := []string{
+		"-f", "dash",
+		"-seg_duration", segmentTime, "-use_template", "1", "-use_timeline", "1",
+		"-init_seg_name", "init_stream_$RepresentationID$.m4s",
+		"-media_seg_name", "chunk_stream_$RepresentationID$_$Number%05d$.m4s",
+	}
+	if hlsPlaylist {
+		args = append(args, "-hls_playlist", "1")
+	}
+	adaptationSets := "id=0,streams=v id=1,streams=a"
+	if cfg.SourceNoVideo {
+		adaptationSets = "id=0,streams=a"
+	} else if cfg.SourceNoAudio && len(cfg.codecs()) == 1 {
+		adaptationSets = "id=0,streams=v"
+	} else if codecs := cfg.codecs(); len(codecs) > 1 {
+		sets := make([]string, 0, len(codecs)+1)
+		for i, codec := range codecs {
+			var streams []string
+			for idx, r := range renditions {
+				if r.Codec == codec {
+					streams = append(streams, strconv.Itoa(idx))
+				}
+			}
+			sets = append(sets, fmt.Sprintf("id=%d,streams=%s", i, strings.Join(streams, ",")))
+		}
+		if !cfg.SourceNoAudio {
+			sets = append(sets, fmt.Sprintf("id=%d,streams=a", len(codecs)))
+		}
+		adaptationSets = strings.Join(sets, " ")
+	}
+	args = append(args, "-adaptation_sets", adaptationSets,
+		"-fps_mode", "passthrough", filepath.Join(cfg.StoredFolderPath, manifestName),
+	)
 	return args
 }
 
+// teeSlave convert the args of a muxer output into a slave of tee muxer, the muxer options are escaped twice,
+// once for the options of slave and once for the list of slaves
+// selectStreams: stream specifiers of the streams which are written by the slave, all streams if it is empty
+// eg: -f dash -seg_duration 6 -fps_mode passthrough out/manifest.mpd with v,a:0 make [f=dash:select=\'v,a:0\':seg_duration=\'6\']out/manifest.mpd
+func teeSlave(args []string, selectStreams string) string {
+	options := make([]string, 0, len(args)/2+1)
+	var format string
+	for i := 0; i+1 < len(args); i += 2 {
+		key := strings.TrimPrefix(args[i], "-")
+		switch key {
+		case "f":
+			format = args[i+1]
+		case "fps_mode":
+			// fps mode is an option of ffmpeg, it is set on the tee output
+		default:
+			options = append(options, key+"="+teeQuote(args[i+1]))
+		}
+	}
+	if selectStreams != "" {
+		options = append([]string{"select=" + teeQuote(selectStreams)}, options...)
+	}
+	slave := "[" + strings.Join(append([]string{"f=" + format}, options...), ":") + "]" + args[len(args)-1]
+	return teeEscaper.Replace(slave)
+}
+
+var teeEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, `|`, `\|`)
+
+// teeQuote quote the value of a slave option, so : and , in it are not separators
+func teeQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// teeArgs the tee output of slaves, encoders write global headers which fmp4 segments of slaves need
+func teeArgs(slaves ...string) []string {
+	return []string{"-flags", "+global_header", "-fps_mode", "passthrough", "-f", "tee", strings.Join(slaves, "|")}
+}
+
+// chooseEncoder return the encoder requested by command config
+// fallback to the default encoder of builder if it is not specified or unknown
+func (b *CommandBuilder) chooseEncoder(name EncoderName) Encoder {
+	if enc, ok := GetEncoder(name); ok {
+		return enc
+	}
+	enc, _ := GetEncoder(b.encoder)
+	return enc
+}
+
 func (b *CommandBuilder) chooseTargetResolutions(cfg CommandConfig) []resolution.Resolution {
 	resMap := make(map[resolution.Resolution]struct{})
 	for _, r := range cfg.TargetResolutions {
@@ -265,15 +806,18 @@ func (b *CommandBuilder) chooseTargetResolutions(cfg CommandConfig) []resolution
 	return res
 }
 
+// buildFilterBitRates build h264 bitrates of target resolutions
+// resolutions whose bitrate is too low are removed
 func (b *CommandBuilder) buildFilterBitRates(cfg CommandConfig) (map[resolution.Resolution]filterBitRate, []resolution.Resolution) {
 	bitRates := make(map[resolution.Resolution]filterBitRate)
 	res := make([]resolution.Resolution, 0, len(cfg.TargetResolutions))
-	bitRate := cfg.SourceBitRate
+	// the h264 bitrate which gives the same quality as source
+	bitRate := cfg.SourceBitRate * 100 / efficiency(cfg.SourceVideoCodec)
 	currentRes := cfg.TargetResolutions[0]
 	for i, r := range cfg.TargetResolutions {
 		bitRate = b.downBitRateValue(bitRate, currentRes, r)
 		curBitRate := bitRate
-		if i != 0 && currentRes != resolution.R1080 && cfg.SourceFrameRate > b.frameRateThreshold {
+		if i != 0 && currentRes < resolution.R1080 && cfg.SourceFrameRate > b.frameRateThreshold {
 			// if this is not source retention and source fps > 48, we will down scale fps so scale down bitrate
 			curBitRate = curBitRate * 10 / 15
 		}
@@ -287,10 +831,7 @@ func (b *CommandBuilder) buildFilterBitRates(cfg CommandConfig) (map[resolution.
 		}
 		currentRes = r
 		res = append(res, r)
-		bitRates[r] = filterBitRate{
-			inputBitRate: fmt.Sprintf("%dk", curBitRate/Kb),
-			maxRate:      fmt.Sprintf("%dk", curBitRate*150/100/Kb), // max_rate = bitrate * 1.5
-		}
+		bitRates[r] = filterBitRate{bitRate: curBitRate}
 	}
 	return bitRates, res
 }
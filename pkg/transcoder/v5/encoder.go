@@ -0,0 +1,164 @@
+package v5
+
+import (
+	"errors"
+	"fmt"
+	ffmpegrunner "transcode/pkg/ffmpeg_runner"
+)
+
+// EncoderName name of the pipeline used for decoding, scaling and encoding video
+type EncoderName string
+
+const (
+	NvencEncoder    EncoderName = "nvenc"    // cuda decoding, scale_npp and h264_nvenc
+	SoftwareEncoder EncoderName = "software" // cpu decoding, scale and libx264
+)
+
+// Encoder builds the parts of the ffmpeg command that depend on the encoding pipeline
+// the bitrate ladder, gop and hls settings are shared between all encoders
+type Encoder interface {
+	Name() EncoderName
+	// InputArgs args placed before the input, eg: hardware decoding
+	// rotated: source has a rotation, ffmpeg applies it to decoded frames in system memory
+	InputArgs(rotated bool) []string
+	// VideoCodec ffmpeg video encoder of codec
+	VideoCodec(codec Codec) string
+	// CodecArgs encoder options which keep the keyframes at the forced positions only
+	CodecArgs(codec Codec) []string
+	// ScaleFilter filter that scales video to the width and height, -2 keeps the aspect ratio
+	// rotated: frames are rotated by ffmpeg in system memory
+	ScaleFilter(width, height int, rotated bool) string
+	// DownloadFilter filter which moves scaled frames to system memory for cpu filters like overlays
+	// empty if frames are already there
+	DownloadFilter() string
+	// Check return the reason why ffmpeg cannot run this encoder for codecs, nil if it can
+	Check(caps *ffmpegrunner.Capabilities, codecs []Codec) error
+}
+
+var encoders = map[EncoderName]Encoder{
+	NvencEncoder:    nvencEncoder{},
+	SoftwareEncoder: softwareEncoder{},
+}
+
+// GetEncoder return the encoder of name
+// ok is false if there is no encoder with this name
+func GetEncoder(name EncoderName) (enc Encoder, ok bool) {
+	enc, ok = encoders[name]
+	return
+}
+
+type nvencEncoder struct{}
+
+func (nvencEncoder) Name() EncoderName {
+	return NvencEncoder
+}
+
+func (nvencEncoder) InputArgs(rotated bool) []string {
+	if rotated {
+		// autorotate cannot transpose cuda frames, so decoded frames are downloaded
+		return []string{"-threads", "1", "-hwaccel", "cuda"}
+	}
+	return []string{"-threads", "1", "-hwaccel", "cuda", "-hwaccel_output_format", "cuda"}
+}
+
+func (nvencEncoder) VideoCodec(codec Codec) string {
+	switch codec {
+	case HEVC:
+		return "hevc_nvenc"
+	case AV1:
+		return "av1_nvenc"
+	default:
+		return "h264_nvenc"
+	}
+}
+
+func (nvencEncoder) CodecArgs(codec Codec) []string {
+	return []string{"-no-scenecut", "1", "-forced-idr", "1"}
+}
+
+func (nvencEncoder) ScaleFilter(width, height int, rotated bool) string {
+	if rotated {
+		// upload the rotated frames back for scale_npp
+		return fmt.Sprintf("hwupload_cuda,scale_npp=%d:%d", width, height)
+	}
+	return fmt.Sprintf("scale_npp=%d:%d", width, height)
+}
+
+func (nvencEncoder) DownloadFilter() string {
+	// nvenc also encodes frames in system memory
+	return "hwdownload,format=nv12"
+}
+
+func (e nvencEncoder) Check(caps *ffmpegrunner.Capabilities, codecs []Codec) error {
+	if !caps.HasHWAccel("cuda") {
+		return errors.New("ffmpeg does not support cuda hwaccel")
+	}
+	if err := checkEncoders(e, caps, codecs); err != nil {
+		return err
+	}
+	if !caps.HasFilter("scale_npp") {
+		return errors.New("ffmpeg does not support scale_npp filter")
+	}
+	return nil
+}
+
+type softwareEncoder struct{}
+
+func (softwareEncoder) Name() EncoderName {
+	return SoftwareEncoder
+}
+
+func (softwareEncoder) InputArgs(rotated bool) []string {
+	return nil
+}
+
+func (softwareEncoder) VideoCodec(codec Codec) string {
+	switch codec {
+	case HEVC:
+		return "libx265"
+	case AV1:
+		return "libsvtav1"
+	default:
+		return "libx264"
+	}
+}
+
+func (softwareEncoder) CodecArgs(codec Codec) []string {
+	switch codec {
+	case HEVC:
+		return []string{"-x265-params", "scenecut=0", "-forced-idr", "1"}
+	case AV1:
+		// svt-av1 presets are numbers, 8 is the balance of speed and quality
+		return []string{"-preset", "8", "-svtav1-params", "scd=0"}
+	default:
+		return []string{"-sc_threshold", "0", "-forced-idr", "1"}
+	}
+}
+
+func (softwareEncoder) ScaleFilter(width, height int, rotated bool) string {
+	return fmt.Sprintf("scale=%d:%d", width, height)
+}
+
+func (softwareEncoder) DownloadFilter() string {
+	return ""
+}
+
+func (e softwareEncoder) Check(caps *ffmpegrunner.Capabilities, codecs []Codec) error {
+	if err := checkEncoders(e, caps, codecs); err != nil {
+		return err
+	}
+	if !caps.HasFilter("scale") {
+		return errors.New("ffmpeg does not support scale filter")
+	}
+	return nil
+}
+
+// checkEncoders check if ffmpeg supports video encoders of all codecs
+func checkEncoders(e Encoder, caps *ffmpegrunner.Capabilities, codecs []Codec) error {
+	for _, codec := range codecs {
+		if name := e.VideoCodec(codec); !caps.HasEncoder(name) {
+			return fmt.Errorf("ffmpeg does not support %s encoder", name)
+		}
+	}
+	return nil
+}
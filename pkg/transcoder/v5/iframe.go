@@ -0,0 +1,159 @@
+package v5
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"transcode/pkg/ffprobe"
+	"transcode/pkg/m3u8"
+
+	"github.com/thnthien/great-deku/l"
+)
+
+// iframe a keyframe of a ts segment, addressed by the byte range of its packets
+type iframe struct {
+	time   float64 // pts, in secs
+	offset int64
+	length int64
+}
+
+// iframePlaylistName the i-frame playlist of a media playlist, it is in the same folder so uris of segments are kept
+// eg: stream_0.m3u8 -> stream_0_iframes.m3u8
+func iframePlaylistName(playlist string) string {
+	return strings.TrimSuffix(playlist, ".m3u8") + "_iframes.m3u8"
+}
+
+// segmentIFrames the keyframes of video packets of a segment
+// a keyframe spans to the next video packet, so it includes the ts packets of other streams which are interleaved
+// size: size of segment file, the last packet spans to the end of file
+func segmentIFrames(packets []ffprobe.Packet, size int64) []iframe {
+	var frames []iframe
+	for i, p := range packets {
+		if p.MediaType != ffprobe.VideoPacket || p.KeyFrame != 1 || p.Pos < 0 {
+			continue
+		}
+		end := size
+		for _, next := range packets[i+1:] {
+			if next.MediaType == ffprobe.VideoPacket && next.Pos > p.Pos {
+				end = next.Pos
+				break
+			}
+		}
+		frames = append(frames, iframe{time: p.PtsTime, offset: p.Pos, length: end - p.Pos})
+	}
+	return frames
+}
+
+// buildIFramePlaylist the i-frame playlist of media playlist
+// frames: keyframes of each segment of media, an i-frame lasts until the next one,
+// the last one lasts until the end of its segment
+func buildIFramePlaylist(media *m3u8.MediaPlaylist, frames [][]iframe) *m3u8.MediaPlaylist {
+	p := &m3u8.MediaPlaylist{
+		Version:       4, // the lowest version which has byte ranges and i-frames only
+		MediaSequence: media.MediaSequence,
+		PlaylistType:  m3u8.PlaylistVOD,
+		IFramesOnly:   true,
+		Ended:         true,
+	}
+	type entry struct {
+		uri string
+		iframe
+	}
+	var entries []entry
+	var end float64
+	for i, s := range media.Segments {
+		if i >= len(frames) || len(frames[i]) == 0 {
+			continue
+		}
+		for _, f := range frames[i] {
+			entries = append(entries, entry{uri: s.URI, iframe: f})
+		}
+		// segments start at keyframes
+		end = frames[i][0].time + s.Duration
+	}
+	for i, e := range entries {
+		next := end
+		if i+1 < len(entries) {
+			next = entries[i+1].time
+		}
+		duration := next - e.time
+		if duration <= 0 || e.length <= 0 {
+			continue
+		}
+		p.Segments = append(p.Segments, &m3u8.Segment{
+			URI:       e.uri,
+			Duration:  duration,
+			ByteRange: &m3u8.ByteRange{Length: e.length, Offset: e.offset, HasOffset: true},
+		})
+		// durations rounded to the nearest integer must not exceed target duration
+		p.TargetDuration = max(p.TargetDuration, int(math.Round(duration)))
+	}
+	return p
+}
+
+// writeIFramePlaylist write the i-frame playlist of rendition at index from its finished segments
+// every segment file is read by its own ffprobe, so positions of packets are offsets in that file
+// ffprobe is stopped when ctx is done, advance is called for every read packet
+// return the name of playlist, relative to the stored folder
+func (t *transcoderImpl) writeIFramePlaylist(ctx context.Context, index int, advance func()) (string, error) {
+	playlistPath := t.variantPlaylist(index)
+	media, err := m3u8.ReadMediaFile(playlistPath)
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Dir(playlistPath)
+	frames := make([][]iframe, 0, len(media.Segments))
+	for _, s := range media.Segments {
+		segmentPath := filepath.Join(dir, s.URI)
+		info, err := os.Stat(segmentPath)
+		if err != nil {
+			return "", err
+		}
+		r := t.ffprobe.ReadPacket(segmentPath, "-select_streams", "v:0")
+		done := r.RunContext(ctx)
+		var packets []ffprobe.Packet
+		for p := range r.Logs() {
+			packets = append(packets, p)
+			advance()
+		}
+		if err = <-done; err != nil {
+			return "", err
+		}
+		frames = append(frames, segmentIFrames(packets, info.Size()))
+	}
+	p := buildIFramePlaylist(media, frames)
+	if len(p.Segments) == 0 {
+		return "", errors.New("no keyframe in segments")
+	}
+	name := iframePlaylistName(t.variantURI(index))
+	return name, m3u8.WriteFile(filepath.Join(t.req.StoredFolderPath, name), p)
+}
+
+// iframeVariants the EXT-X-I-FRAME-STREAM-INF of renditions whose i-frame playlists are written
+// their codecs are of video only
+func (t *transcoderImpl) iframeVariants(enc Encoder) []*m3u8.Variant {
+	var variants []*m3u8.Variant
+	for i, name := range t.iframePlaylists {
+		if name == "" {
+			continue
+		}
+		r := t.renditions[i]
+		v := &m3u8.Variant{
+			URI:    name,
+			Width:  r.Width,
+			Height: r.Height,
+			Codecs: strings.Split(r.codecsString(enc, t.info), ",")[0],
+		}
+		stats, err := measurePlaylist(filepath.Join(t.req.StoredFolderPath, name))
+		if err != nil {
+			t.ll.Error("cannot measure i-frame playlist", l.String("playlist", name), l.Error(err))
+			continue
+		}
+		v.Bandwidth, v.AverageBandwidth = stats.Peak, stats.Average
+		variants = append(variants, v)
+	}
+	return variants
+}
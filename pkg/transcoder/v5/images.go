@@ -0,0 +1,189 @@
+package v5
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"transcode/pkg/request"
+	"transcode/pkg/transcoder"
+)
+
+const (
+	posterName       = "poster.jpg"
+	thumbnailPattern = "thumbnails/thumb_%03d.jpg"
+	spritePattern    = "sprite/sprite_%02d.jpg"
+	spriteIndexName  = "sprite/sprite.vtt"
+
+	defaultThumbnailWidth = 320
+	defaultTileWidth      = 160
+	maxPosterEdge         = 1280 // the long edge of poster
+	spriteColumns         = 10
+	spriteRows            = 10
+	posterCandidates      = 20 // frames which are scored for smart poster
+)
+
+// ImageOptions images of video which are generated after the renditions
+type ImageOptions struct {
+	Poster         bool    `json:"poster"`
+	SmartPoster    bool    `json:"smart_poster"` // pick the poster from scored candidate frames
+	Thumbnails     int     `json:"thumbnails"`   // number of thumbnails at fixed intervals
+	ThumbnailWidth int     `json:"thumbnail_width"`
+	Sprite         bool    `json:"sprite"`
+	SpriteInterval float64 `json:"sprite_interval"` // seconds between tiles, 0 to fit the video in a sheet
+	TileWidth      int     `json:"tile_width"`
+}
+
+// NewImageOptions validate images of request and fill the defaults
+func NewImageOptions(req request.ImagesReq) (ImageOptions, error) {
+	o := ImageOptions{
+		Poster:         req.Poster,
+		SmartPoster:    req.SmartPoster,
+		Thumbnails:     req.Thumbnails,
+		ThumbnailWidth: req.ThumbnailWidth,
+		Sprite:         req.Sprite,
+		SpriteInterval: req.SpriteInterval,
+		TileWidth:      req.TileWidth,
+	}
+	if o.Thumbnails < 0 || o.ThumbnailWidth < 0 || o.SpriteInterval < 0 || o.TileWidth < 0 {
+		return o, errors.New("numbers of images cannot be negative")
+	}
+	if o.ThumbnailWidth == 0 {
+		o.ThumbnailWidth = defaultThumbnailWidth
+	}
+	if o.TileWidth == 0 {
+		o.TileWidth = defaultTileWidth
+	}
+	return o, nil
+}
+
+// enabled an image is requested
+func (o ImageOptions) enabled() bool {
+	return o.Poster || o.Thumbnails > 0 || o.Sprite
+}
+
+// imagePlan the images which are expected from source, their paths are relative to the stored folder
+type imagePlan struct {
+	poster            *transcoder.Image
+	thumbnails        []transcoder.Image
+	thumbnailInterval float64
+	sprite            *transcoder.Sprite
+	spriteTiles       int // number of tiles of all sheets
+}
+
+// planImages sizes and times of images
+// thumbnails and sprite need the duration of source to place their frames
+func (b *CommandBuilder) planImages(cfg CommandConfig, o ImageOptions) imagePlan {
+	plan := imagePlan{}
+	duration := float64(cfg.SourceDuration)
+	if o.Poster {
+		width, height := fitSize(cfg.SourceWidth, cfg.SourceHeight, maxPosterEdge)
+		plan.poster = &transcoder.Image{Path: posterName, Width: width, Height: height, Time: duration / 10}
+	}
+	if o.Thumbnails > 0 && duration > 0 {
+		plan.thumbnailInterval = duration / float64(o.Thumbnails)
+		height := scaledEdge(cfg.SourceHeight, cfg.SourceWidth, int64(o.ThumbnailWidth))
+		for i := 0; i < o.Thumbnails; i++ {
+			plan.thumbnails = append(plan.thumbnails, transcoder.Image{
+				Path:   fmt.Sprintf(thumbnailPattern, i),
+				Width:  o.ThumbnailWidth,
+				Height: height,
+				Time:   float64(i) * plan.thumbnailInterval,
+			})
+		}
+	}
+	if o.Sprite && duration > 0 {
+		interval := o.SpriteInterval
+		if interval == 0 {
+			interval = math.Max(1, math.Ceil(duration/(spriteColumns*spriteRows)))
+		}
+		plan.spriteTiles = int(math.Ceil(duration / interval))
+		sprite := &transcoder.Sprite{
+			Index:      spriteIndexName,
+			TileWidth:  o.TileWidth,
+			TileHeight: scaledEdge(cfg.SourceHeight, cfg.SourceWidth, int64(o.TileWidth)),
+			Columns:    spriteColumns,
+			Rows:       spriteRows,
+			Interval:   interval,
+		}
+		perSheet := spriteColumns * spriteRows
+		for i := 0; i*perSheet < plan.spriteTiles; i++ {
+			sprite.Sheets = append(sprite.Sheets, transcoder.Image{
+				Path:   fmt.Sprintf(spritePattern, i),
+				Width:  sprite.TileWidth * spriteColumns,
+				Height: sprite.TileHeight * spriteRows,
+				Time:   float64(i*perSheet) * interval,
+			})
+		}
+		plan.sprite = sprite
+	}
+	return plan
+}
+
+// fitSize the size of video whose long edge is not larger than maxEdge, keeping aspect ratio
+func fitSize(width, height int64, maxEdge int64) (int, int) {
+	if width >= height && width > maxEdge {
+		return int(maxEdge), scaledEdge(height, width, maxEdge)
+	}
+	if height > width && height > maxEdge {
+		return scaledEdge(width, height, maxEdge), int(maxEdge)
+	}
+	return int(width), int(height)
+}
+
+// buildImagesCommand build the ffmpeg args which generate images of plan from a decoding of source, an output for each kind
+// image2 muxer doesn't create folders, they must exist before running
+// eg: ffmpeg -y -i input.mp4
+// -map 0:v:0 -vf fps=1/52.7,scale=320:180 -frames:v 10 -q:v 3 -start_number 0 output/thumbnails/thumb_%03d.jpg
+// -map 0:v:0 -vf fps=1/6,scale=160:90,tile=10x10 -q:v 3 -start_number 0 output/sprite/sprite_%02d.jpg
+// -map 0:v:0 -ss 52.7 -vf scale=1280:720 -frames:v 1 -q:v 2 output/poster.jpg
+func (b *CommandBuilder) buildImagesCommand(cfg CommandConfig, plan imagePlan) []string {
+	args := []string{"-y", "-i", cfg.FilePath}
+	if len(plan.thumbnails) > 0 {
+		first := plan.thumbnails[0]
+		args = append(args, "-map", "0:v:0",
+			"-vf", fmt.Sprintf("fps=1/%s,scale=%d:%d", formatSeconds(plan.thumbnailInterval), first.Width, first.Height),
+			"-frames:v", fmt.Sprint(len(plan.thumbnails)), "-q:v", "3", "-start_number", "0",
+			filepath.Join(cfg.StoredFolderPath, thumbnailPattern),
+		)
+	}
+	if s := plan.sprite; s != nil {
+		args = append(args, "-map", "0:v:0",
+			"-vf", fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d", formatSeconds(s.Interval), s.TileWidth, s.TileHeight, s.Columns, s.Rows),
+			"-q:v", "3", "-start_number", "0",
+			filepath.Join(cfg.StoredFolderPath, spritePattern),
+		)
+	}
+	if p := plan.poster; p != nil {
+		args = append(args, "-map", "0:v:0", "-ss", formatSeconds(p.Time),
+			"-vf", fmt.Sprintf("scale=%d:%d", p.Width, p.Height), "-frames:v", "1", "-q:v", "2",
+			filepath.Join(cfg.StoredFolderPath, p.Path),
+		)
+	}
+	return args
+}
+
+// spriteIndex the webvtt which maps time ranges to tiles of sprite sheets
+// sheets: number of sheets which are generated, tiles of the missing sheets are not listed
+// eg: 00:00:06.000 --> 00:00:12.000
+// sprite_00.jpg#xywh=160,0,160,90
+func spriteIndex(s *transcoder.Sprite, tiles, sheets int, duration float64) string {
+	sb := strings.Builder{}
+	sb.WriteString("WEBVTT\n")
+	perSheet := s.Columns * s.Rows
+	for i := 0; i < tiles && i/perSheet < sheets; i++ {
+		start := float64(i) * s.Interval
+		end := math.Min(start+s.Interval, duration)
+		pos := i % perSheet
+		sb.WriteString(fmt.Sprintf("\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTime(start), vttTime(end),
+			filepath.Base(s.Sheets[i/perSheet].Path), pos%s.Columns*s.TileWidth, pos/s.Columns*s.TileHeight, s.TileWidth, s.TileHeight))
+	}
+	return sb.String()
+}
+
+// vttTime format seconds as webvtt timestamp, eg: 01:02:03.500
+func vttTime(sec float64) string {
+	ms := int64(math.Round(sec * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,255 @@
+package v5
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"transcode/pkg/ffprobe"
+	"transcode/pkg/m3u8"
+
+	"github.com/thnthien/great-deku/l"
+)
+
+// variantAttributes attributes of a variant in master playlist, zero values are kept as ffmpeg wrote
+type variantAttributes struct {
+	Bandwidth        int64 // peak segment bitrate, in bits/s
+	AverageBandwidth int64 // average segment bitrate, in bits/s
+	Width            int
+	Height           int
+	FrameRate        float64
+	Codecs           string
+}
+
+// mediaAttributes attributes of an alternate audio rendition in master playlist
+// ffmpeg names renditions by their indexes and doesn't write autoselect
+type mediaAttributes struct {
+	Name     string
+	Language string
+	Default  bool
+	Channels string
+}
+
+// bandwidthStats bitrates of segments of a media playlist
+type bandwidthStats struct {
+	Peak    int64 // the highest bitrate of a segment, in bits/s
+	Average int64 // total bits divided by total duration, in bits/s
+}
+
+// add sum of two stats, used for variants which refer to a separated audio rendition
+func (s bandwidthStats) add(other bandwidthStats) bandwidthStats {
+	return bandwidthStats{Peak: s.Peak + other.Peak, Average: s.Average + other.Average}
+}
+
+// max the higher bitrates of two stats, used for the alternate audio renditions of a group
+func (s bandwidthStats) max(other bandwidthStats) bandwidthStats {
+	return bandwidthStats{Peak: max(s.Peak, other.Peak), Average: max(s.Average, other.Average)}
+}
+
+// rewriteMaster set attributes of variants in master file
+// ffmpeg does not know codecs strings of all codecs (eg: av1, copied streams), and its bandwidths are estimated from target bitrates
+// bandwidths are measured from segments of variants, so it is only correct after all segments are written
+func (t *transcoderImpl) rewriteMaster(filePath string) error {
+	master, err := m3u8.ReadMasterFile(filePath)
+	if err != nil {
+		return err
+	}
+	enc := t.commandBuilder.chooseEncoder(t.encoder)
+	var audio bandwidthStats
+	if t.hasFormat(CMAFFormat) && t.separateAudio() {
+		// audio of cmaf is the last representation, it is shared by all variants
+		audio, err = measurePlaylist(t.variantPlaylist(len(t.renditions)))
+		if err != nil {
+			t.ll.Error("cannot measure audio playlist", l.Error(err))
+		}
+	}
+	// a variant may be played with any alternate audio rendition of its group
+	audio = audio.max(t.measureAlternateAudio())
+	variants := make(map[string]variantAttributes, len(t.renditions))
+	media := make(map[string]mediaAttributes)
+	names := make(map[string]bool) // names of renditions must be unique in group
+	for i, r := range t.renditions {
+		if r.Audio != nil {
+			attrs := alternateAudioAttributes(r, i)
+			if names[attrs.Name] {
+				attrs.Name = fmt.Sprintf("%s %d", attrs.Name, i)
+			}
+			names[attrs.Name] = true
+			media[t.variantURI(i)] = attrs
+			continue
+		}
+		v := variantAttributes{
+			Width:     r.Width,
+			Height:    r.Height,
+			FrameRate: r.exactFrameRate(t.info),
+			Codecs:    r.codecsString(enc, t.info),
+		}
+		if stats, err := measurePlaylist(t.variantPlaylist(i)); err != nil {
+			t.ll.Error("cannot measure playlist", l.Int("index", i), l.Error(err))
+		} else {
+			stats = stats.add(audio)
+			v.Bandwidth, v.AverageBandwidth = stats.Peak, stats.Average
+		}
+		variants[t.variantURI(i)] = v
+	}
+	setMasterAttributes(master, variants)
+	setMediaAttributes(master, media)
+	setSubtitleMedia(master, t.subtitleMedia())
+	master.IFrameVariants = t.iframeVariants(enc)
+	return m3u8.WriteFile(filePath, master)
+}
+
+// exactFrameRate rational frame rate of rendition, eg: 29.97 for a 30000/1001 source
+// the integer frame rate of rendition is the rounded source rate or its half
+func (r rendition) exactFrameRate(info *ffprobe.InputInfo) float64 {
+	if info == nil || info.FrameRate == 0 || info.ExactFrameRate == 0 {
+		return float64(r.FrameRate)
+	}
+	return info.ExactFrameRate * float64(r.FrameRate) / float64(info.FrameRate)
+}
+
+// subtitleMedia the EXT-X-MEDIA of subtitles whose playlists are written
+func (t *transcoderImpl) subtitleMedia() []*m3u8.Media {
+	var media []*m3u8.Media
+	for i, s := range t.subtitles {
+		if _, err := os.Stat(filepath.Join(t.req.StoredFolderPath, subtitlePlaylist(i))); err != nil {
+			// subtitles are converted after renditions
+			continue
+		}
+		media = append(media, subtitleMedia(s, i))
+	}
+	return media
+}
+
+// measureAlternateAudio the highest bitrates of alternate audio renditions, zero if there is none
+func (t *transcoderImpl) measureAlternateAudio() bandwidthStats {
+	var audio bandwidthStats
+	for i, r := range t.renditions {
+		if r.Audio == nil {
+			continue
+		}
+		stats, err := measurePlaylist(t.variantPlaylist(i))
+		if err != nil {
+			t.ll.Error("cannot measure audio playlist", l.Int("index", i), l.Error(err))
+			continue
+		}
+		audio = audio.max(stats)
+	}
+	return audio
+}
+
+// alternateAudioAttributes attributes of alternate audio rendition from tags of its source stream
+// it is named by title, language or index of stream, encoded audio is stereo and copied audio keeps its channels
+func alternateAudioAttributes(r rendition, index int) mediaAttributes {
+	name := r.Audio.Title
+	if name == "" {
+		name = r.Audio.Language
+	}
+	if name == "" {
+		name = fmt.Sprintf("audio_%d", index)
+	}
+	channels := "2"
+	if r.CopyAudio {
+		channels = strconv.Itoa(r.Audio.Channels)
+	}
+	return mediaAttributes{
+		Name:     name,
+		Language: r.Audio.Language,
+		Default:  r.Audio.Default,
+		Channels: channels,
+	}
+}
+
+// variantURI uri of media playlist of the rendition at index in master
+// the last index is audio of cmaf
+func (t *transcoderImpl) variantURI(index int) string {
+	if t.hasFormat(CMAFFormat) {
+		return fmt.Sprintf("media_%d.m3u8", index)
+	}
+	return t.files[index].playlist
+}
+
+// variantPlaylist path of media playlist of the rendition at index
+func (t *transcoderImpl) variantPlaylist(index int) string {
+	return filepath.Join(t.req.StoredFolderPath, t.variantURI(index))
+}
+
+// measurePlaylist measure bitrates of segments listed in media playlist by their sizes
+func measurePlaylist(playlistPath string) (bandwidthStats, error) {
+	stats := bandwidthStats{}
+	p, err := m3u8.ReadMediaFile(playlistPath)
+	if err != nil {
+		return stats, err
+	}
+
+	var totalBits float64
+	for _, segment := range p.Segments {
+		if segment.Duration <= 0 {
+			continue
+		}
+		var size int64
+		if segment.ByteRange != nil {
+			size = segment.ByteRange.Length
+		} else {
+			info, err := os.Stat(filepath.Join(filepath.Dir(playlistPath), segment.URI))
+			if err != nil {
+				return stats, err
+			}
+			size = info.Size()
+		}
+		bits := float64(size * 8)
+		stats.Peak = int64(math.Max(float64(stats.Peak), math.Ceil(bits/segment.Duration)))
+		totalBits += bits
+	}
+	duration := p.Duration()
+	if duration == 0 {
+		return stats, fmt.Errorf("no segment in playlist %s", playlistPath)
+	}
+	stats.Average = int64(math.Ceil(totalBits / duration))
+	return stats, nil
+}
+
+// setMasterAttributes set attributes of variants in master playlist
+// variants: attributes of each rendition, by the uri of its playlist
+func setMasterAttributes(p *m3u8.MasterPlaylist, variants map[string]variantAttributes) {
+	for _, variant := range p.Variants {
+		v, ok := variants[variant.URI]
+		if !ok {
+			continue
+		}
+		if v.Bandwidth > 0 {
+			variant.Bandwidth = v.Bandwidth
+		}
+		if v.AverageBandwidth > 0 {
+			variant.AverageBandwidth = v.AverageBandwidth
+		}
+		if v.Width > 0 && v.Height > 0 {
+			variant.Width, variant.Height = v.Width, v.Height
+		}
+		if v.FrameRate > 0 {
+			variant.FrameRate = v.FrameRate
+		}
+		if v.Codecs != "" {
+			variant.Codecs = v.Codecs
+		}
+	}
+}
+
+// setMediaAttributes set attributes of alternate audio renditions in master playlist
+// media: attributes of each rendition, by the uri of its playlist
+func setMediaAttributes(p *m3u8.MasterPlaylist, media map[string]mediaAttributes) {
+	for _, m := range p.Media {
+		attrs, ok := media[m.URI]
+		if !ok || m.Type != m3u8.MediaAudio {
+			continue
+		}
+		m.Name = attrs.Name
+		if attrs.Language != "" {
+			m.Language = attrs.Language
+		}
+		m.Default = attrs.Default
+		m.Autoselect = true
+		m.Channels = attrs.Channels
+	}
+}
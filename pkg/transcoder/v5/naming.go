@@ -0,0 +1,261 @@
+package v5
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"transcode/pkg/m3u8"
+)
+
+const (
+	DefaultPlaylistTemplate = "stream_{v}.m3u8"
+	DefaultSegmentTemplate  = "stream_{v}/data{n:02}.ts"
+
+	fixedSuffix = ".fixed" // copy of playlist with fixed uris of segments, which is uploaded while ffmpeg runs
+)
+
+var (
+	placeholderRegex          = regexp.MustCompile(`\{(v|res|codec|n)(?::(\d+))?\}`)
+	renditionPlaceholderRegex = regexp.MustCompile(`\{(?:v|res|codec)\}`)
+	numberVerbRegex           = regexp.MustCompile(`%0?\d*d`) // segment number of ffmpeg names, eg: %05d
+)
+
+// NamingTemplate names of hls output files of a rendition, relative to the stored folder
+// placeholders:
+// - {v}: index of rendition
+// - {res}: resolution, eg: 1080
+// - {codec}: codec of rendition, eg: h264
+// - {n}, {n:05}: number of segment, padded with zeros to the width
+// the placeholders of rendition must be in the same part of playlist and segment names,
+// because ffmpeg names files of a rendition by replacing %v with a name of rendition
+// eg: {res}p/index.m3u8 and {res}p/seg_{n:05}.ts make 1080p/index.m3u8 and 1080p/seg_00001.ts
+type NamingTemplate struct {
+	Playlist string `json:"playlist"`
+	Segment  string `json:"segment"`
+}
+
+// withDefault fill the empty templates by the default ones
+func (n NamingTemplate) withDefault() NamingTemplate {
+	if n.Playlist == "" {
+		n.Playlist = DefaultPlaylistTemplate
+	}
+	if n.Segment == "" {
+		n.Segment = DefaultSegmentTemplate
+	}
+	return n
+}
+
+// variantPart the part of playlist template from the first placeholder of rendition to the last one
+func (n NamingTemplate) variantPart() string {
+	locs := renditionPlaceholderRegex.FindAllStringIndex(n.Playlist, -1)
+	if len(locs) == 0 {
+		return ""
+	}
+	return n.Playlist[locs[0][0]:locs[len(locs)-1][1]]
+}
+
+// custom the templates are not the default ones
+func (n NamingTemplate) custom() bool {
+	n = n.withDefault()
+	return n.Playlist != DefaultPlaylistTemplate || n.Segment != DefaultSegmentTemplate
+}
+
+// Validate check that templates make distinct files for renditions and segments
+func (n NamingTemplate) Validate() error {
+	n = n.withDefault()
+	for _, t := range []string{n.Playlist, n.Segment} {
+		if strings.Contains(t, "%") || path.IsAbs(t) || strings.HasPrefix(path.Clean(t), "..") {
+			return fmt.Errorf("invalid naming template %s", t)
+		}
+		for _, m := range placeholderRegex.FindAllStringSubmatch(t, -1) {
+			if m[2] != "" && m[1] != "n" {
+				return fmt.Errorf("placeholder %s of naming template %s cannot have width", m[0], t)
+			}
+		}
+		if strings.ContainsAny(placeholderRegex.ReplaceAllString(t, ""), "{}") {
+			return fmt.Errorf("unknown placeholder in naming template %s", t)
+		}
+	}
+	if !strings.HasSuffix(n.Playlist, ".m3u8") {
+		return fmt.Errorf("playlist template %s must have .m3u8 extension", n.Playlist)
+	}
+	if strings.Contains(n.Playlist, "{n") {
+		return fmt.Errorf("playlist template %s cannot have segment number", n.Playlist)
+	}
+	if strings.Count(n.Segment, "{n") != 1 {
+		return fmt.Errorf("segment template %s must have one segment number", n.Segment)
+	}
+	part := n.variantPart()
+	if part == "" {
+		return fmt.Errorf("playlist template %s must have a placeholder of rendition", n.Playlist)
+	}
+	if strings.Contains(part, "/") {
+		// ffmpeg only creates the folders which have %v
+		return fmt.Errorf("placeholders of rendition in playlist template %s must be in a folder or file name", n.Playlist)
+	}
+	if strings.Count(n.Segment, part) != 1 || renditionPlaceholderRegex.MatchString(strings.Replace(n.Segment, part, "", 1)) {
+		return fmt.Errorf("segment template %s must have %s as the playlist template", n.Segment, part)
+	}
+	return nil
+}
+
+// renditionNames the names of renditions which replace %v in file names
+// nil if they are the indexes, which is the default of ffmpeg
+func (n NamingTemplate) renditionNames(renditions []rendition) ([]string, error) {
+	n = n.withDefault()
+	part := n.variantPart()
+	if part == "{v}" {
+		return nil, nil
+	}
+	names := make([]string, 0, len(renditions))
+	seen := make(map[string]bool)
+	for i, r := range renditions {
+		name := render(part, i, r)
+		if seen[name] {
+			return nil, fmt.Errorf("naming template %s makes the same name %s for renditions", n.Playlist, name)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ffmpegNames the file names with %v and segment number for ffmpeg
+// segments of fmp4 have .m4s extension
+func (n NamingTemplate) ffmpegNames(fmp4 bool) (playlist, segment, init string) {
+	n = n.withDefault()
+	part := n.variantPart()
+	playlist = strings.Replace(n.Playlist, part, "%v", 1)
+	segment = placeholderRegex.ReplaceAllStringFunc(strings.Replace(n.Segment, part, "%v", 1), func(s string) string {
+		m := placeholderRegex.FindStringSubmatch(s)
+		if m[2] != "" {
+			return "%0" + strings.TrimLeft(m[2], "0") + "d"
+		}
+		return "%d"
+	})
+	if fmp4 {
+		segment = strings.TrimSuffix(segment, path.Ext(segment)) + ".m4s"
+	}
+	// ffmpeg puts init file in the folder of playlist
+	init = strings.TrimSuffix(path.Base(playlist), ".m3u8") + "_init.mp4"
+	if !strings.Contains(init, "%v") {
+		init = "init_%v.mp4"
+	}
+	return playlist, segment, init
+}
+
+// renditionFiles names of hls files of a rendition, relative to the stored folder
+type renditionFiles struct {
+	playlist   string
+	segment    *regexp.Regexp
+	segmentDir string
+	init       string
+}
+
+// files the names of files of renditions
+func (n NamingTemplate) files(renditions []rendition, fmp4 bool) []renditionFiles {
+	names, _ := n.renditionNames(renditions)
+	playlist, segment, init := n.ffmpegNames(fmp4)
+	files := make([]renditionFiles, 0, len(renditions))
+	for i := range renditions {
+		name := strconv.Itoa(i)
+		if names != nil {
+			name = names[i]
+		}
+		p := strings.ReplaceAll(playlist, "%v", name)
+		s := regexp.QuoteMeta(strings.ReplaceAll(segment, "%v", name))
+		s = numberVerbRegex.ReplaceAllString(s, `\d+`)
+		files = append(files, renditionFiles{
+			playlist:   p,
+			segment:    regexp.MustCompile("^" + s + "$"),
+			segmentDir: path.Dir(strings.ReplaceAll(segment, "%v", name)),
+			init:       path.Join(path.Dir(p), strings.ReplaceAll(init, "%v", name)),
+		})
+	}
+	return files
+}
+
+// match the file belongs to this rendition
+func (f renditionFiles) match(name string) bool {
+	return name == f.playlist || name == f.init || f.segment.MatchString(name)
+}
+
+// render replace the placeholders of rendition
+func render(template string, idx int, r rendition) string {
+	return renditionPlaceholderRegex.ReplaceAllStringFunc(template, func(s string) string {
+		switch {
+		case r.Audio != nil && s != "{v}":
+			// alternate audio is named by its source stream
+			return fmt.Sprintf("audio_%d", r.Audio.Index)
+		case r.NoVideo && s != "{v}":
+			// audio-only rendition has neither resolution nor video codec
+			return "audio"
+		case s == "{res}":
+			return strconv.Itoa(int(r.Resolution))
+		case s == "{codec}":
+			return string(r.Codec)
+		default:
+			return strconv.Itoa(idx)
+		}
+	})
+}
+
+// fixSegmentURIs make uris of segments relative to the playlist
+// ffmpeg writes the base names of segments, which are wrong when segments are not in the folder of playlist
+// return true if the playlist is changed
+func (f renditionFiles) fixSegmentURIs(folder string) (bool, error) {
+	playlistPath := filepath.Join(folder, f.playlist)
+	p, err := m3u8.ReadMediaFile(playlistPath)
+	if err != nil {
+		return false, err
+	}
+	changed, err := f.fixURIs(folder, p)
+	if err != nil || !changed {
+		return false, err
+	}
+	return true, m3u8.WriteFile(playlistPath, p)
+}
+
+// fixedCopy write the playlist with fixed uris of segments to a copy, it is uploaded while ffmpeg still rewrites the playlist
+// the copy is replaced by rename, so an upload which is reading the previous copy is not affected
+// return the path of playlist itself if its uris are correct
+func (f renditionFiles) fixedCopy(folder string) (string, error) {
+	playlistPath := filepath.Join(folder, f.playlist)
+	p, err := m3u8.ReadMediaFile(playlistPath)
+	if err != nil {
+		return "", err
+	}
+	if changed, err := f.fixURIs(folder, p); err != nil || !changed {
+		return playlistPath, err
+	}
+	copyPath := playlistPath + fixedSuffix
+	if err = m3u8.WriteFile(copyPath+".tmp", p); err != nil {
+		return "", err
+	}
+	return copyPath, os.Rename(copyPath+".tmp", copyPath)
+}
+
+// fixURIs make uris of segments of playlist p relative to the playlist, return true if p is changed
+func (f renditionFiles) fixURIs(folder string, p *m3u8.MediaPlaylist) (bool, error) {
+	dir := filepath.Dir(filepath.Join(folder, f.playlist))
+	changed := false
+	for _, s := range p.Segments {
+		if _, err := os.Stat(filepath.Join(dir, s.URI)); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return false, err
+		}
+		rel, err := filepath.Rel(dir, filepath.Join(folder, f.segmentDir, path.Base(s.URI)))
+		if err != nil {
+			return false, err
+		}
+		s.URI = filepath.ToSlash(rel)
+		changed = true
+	}
+	return changed, nil
+}
@@ -0,0 +1,212 @@
+package v5
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"transcode/pkg/request"
+)
+
+// OverlayType kind of overlay which is drawn on renditions
+type OverlayType string
+
+const (
+	ImageOverlay    OverlayType = "image"    // watermark image, eg: logo
+	TextOverlay     OverlayType = "text"     // text of a template, eg: user id and timestamp
+	SubtitleOverlay OverlayType = "subtitle" // burned-in subtitles
+)
+
+// OverlayPosition corner or center of rendition where overlay is drawn
+type OverlayPosition string
+
+const (
+	TopLeft     OverlayPosition = "top_left"
+	TopRight    OverlayPosition = "top_right"
+	BottomLeft  OverlayPosition = "bottom_left"
+	BottomRight OverlayPosition = "bottom_right"
+	Center      OverlayPosition = "center"
+)
+
+const (
+	defaultImageScale = 0.15 // width of image relative to width of rendition
+	defaultTextScale  = 0.04 // font size relative to height of rendition
+	overlayMargin     = 0.03 // distance of overlay from edges relative to height of rendition
+)
+
+// Overlay an overlay of every rendition, its size is relative to the rendition
+type Overlay struct {
+	Type          OverlayType     `json:"type"`
+	FilePath      string          `json:"file_path"`      // image or subtitle file
+	Text          string          `json:"text"`           // template of text, user id is replaced, {timestamp} is time of video
+	FontFile      string          `json:"font_file"`      // empty for the default font of ffmpeg
+	Position      OverlayPosition `json:"position"`       // not used by subtitles
+	Scale         float64         `json:"scale"`          // width of image or font size of text, relative to rendition
+	Opacity       float64         `json:"opacity"`        // from 0 to 1
+	SubtitleIndex int             `json:"subtitle_index"` // subtitle stream of source to burn in if FilePath is empty
+}
+
+// NewOverlays validate overlays of request and fill the defaults
+// userID replaces {user_id} in templates of text
+func NewOverlays(reqs []request.OverlayReq, userID string) ([]Overlay, error) {
+	overlays := make([]Overlay, 0, len(reqs))
+	for _, req := range reqs {
+		o := Overlay{
+			Type:          OverlayType(req.Type),
+			FilePath:      req.FilePath,
+			Text:          strings.ReplaceAll(req.Text, "{user_id}", userID),
+			FontFile:      req.FontFile,
+			Position:      OverlayPosition(req.Position),
+			Scale:         req.Scale,
+			Opacity:       req.Opacity,
+			SubtitleIndex: req.SubtitleIndex,
+		}
+		if o.Position == "" {
+			o.Position = BottomRight
+		}
+		if o.Opacity == 0 {
+			o.Opacity = 1
+		}
+		switch o.Type {
+		case ImageOverlay:
+			if o.Scale == 0 {
+				o.Scale = defaultImageScale
+			}
+			if o.FilePath == "" {
+				return nil, errors.New("image overlay must have a file")
+			}
+		case TextOverlay:
+			if o.Scale == 0 {
+				o.Scale = defaultTextScale
+			}
+			if o.Text == "" {
+				return nil, errors.New("text overlay must have a text")
+			}
+		case SubtitleOverlay:
+			if o.SubtitleIndex < 0 {
+				return nil, fmt.Errorf("invalid subtitle index %d of overlay", o.SubtitleIndex)
+			}
+		default:
+			return nil, fmt.Errorf("unknown overlay type %s", req.Type)
+		}
+		if err := o.validate(); err != nil {
+			return nil, err
+		}
+		overlays = append(overlays, o)
+	}
+	return overlays, nil
+}
+
+// validate check the values which are shared by types of overlay
+func (o Overlay) validate() error {
+	switch o.Position {
+	case TopLeft, TopRight, BottomLeft, BottomRight, Center:
+	default:
+		return fmt.Errorf("unknown overlay position %s", o.Position)
+	}
+	// subtitles are scaled by libass
+	if o.Type != SubtitleOverlay && (o.Scale <= 0 || o.Scale > 1) {
+		return fmt.Errorf("scale %v of overlay must be in (0, 1]", o.Scale)
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return fmt.Errorf("opacity %v of overlay must be in [0, 1]", o.Opacity)
+	}
+	for _, file := range []string{o.FilePath, o.FontFile} {
+		if file == "" {
+			continue
+		}
+		if strings.Contains(file, "'") {
+			// files are quoted in filter graph
+			return fmt.Errorf("file %s of overlay cannot have quote", file)
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fmt.Errorf("cannot read file %s of overlay: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// overlayFilters compile overlays into the filter graph of a rendition
+// base is the filter chain which scales source to the rendition, its frames must be in system memory
+// images are loaded by movie sources, so the graph still has one input and one output for -filter:v:<idx>
+// eg: movie='logo.png',scale=288:-1,format=rgba,colorchannelmixer=aa=0.50[wm0];scale=-2:1080[bg0];
+// [bg0][wm0]overlay=x=W-w-32:y=H-h-32,drawtext=text='%{pts\:hms}':fontsize=43:fontcolor=white@1.00:...
+func overlayFilters(base string, overlays []Overlay, source string, width, height int) string {
+	var sources []string
+	chain := base
+	margin := int(math.Round(float64(height) * overlayMargin))
+	for i, o := range overlays {
+		switch o.Type {
+		case ImageOverlay:
+			image := fmt.Sprintf("movie=%s,scale=%d:-1,format=rgba", quoteFilterValue(o.FilePath),
+				int(math.Round(float64(width)*o.Scale)))
+			if o.Opacity < 1 {
+				image += fmt.Sprintf(",colorchannelmixer=aa=%.2f", o.Opacity)
+			}
+			sources = append(sources, fmt.Sprintf("%s[wm%d]", image, i))
+			x, y := overlayPosition(o.Position, "W", "H", "w", "h", margin)
+			chain += fmt.Sprintf("[bg%d];[bg%d][wm%d]overlay=x=%s:y=%s", i, i, i, x, y)
+		case TextOverlay:
+			x, y := overlayPosition(o.Position, "w", "h", "text_w", "text_h", margin)
+			text := fmt.Sprintf("drawtext=text=%s:fontsize=%d:fontcolor=white@%.2f:borderw=2:bordercolor=black@%.2f:x=%s:y=%s",
+				drawtextValue(o.Text), int(math.Round(float64(height)*o.Scale)), o.Opacity, o.Opacity, x, y)
+			if o.FontFile != "" {
+				text += ":fontfile=" + quoteFilterValue(o.FontFile)
+			}
+			chain += "," + text
+		case SubtitleOverlay:
+			// libass scales subtitles to the size of frames
+			if o.FilePath != "" {
+				chain += ",subtitles=" + quoteFilterValue(o.FilePath)
+			} else {
+				chain += fmt.Sprintf(",subtitles=%s:si=%d", quoteFilterValue(source), o.SubtitleIndex)
+			}
+		}
+	}
+	return strings.Join(append(sources, chain), ";")
+}
+
+// overlayPosition the x and y expressions of position
+// mainW, mainH: names of size of rendition, w, h: names of size of overlay
+func overlayPosition(p OverlayPosition, mainW, mainH, w, h string, margin int) (string, string) {
+	m := strconv.Itoa(margin)
+	left, top := m, m
+	right := fmt.Sprintf("%s-%s-%s", mainW, w, m)
+	bottom := fmt.Sprintf("%s-%s-%s", mainH, h, m)
+	switch p {
+	case TopLeft:
+		return left, top
+	case TopRight:
+		return right, top
+	case BottomLeft:
+		return left, bottom
+	case Center:
+		return fmt.Sprintf("(%s-%s)/2", mainW, w), fmt.Sprintf("(%s-%s)/2", mainH, h)
+	default:
+		return right, bottom
+	}
+}
+
+// quoteFilterValue quote value of filter option, eg: a file path
+// it is literal in the quotes of filter graph, then : and \ are escaped for filter options
+func quoteFilterValue(value string) string {
+	return "'" + escapeFilterOption(value) + "'"
+}
+
+func escapeFilterOption(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `:`, `\:`).Replace(value)
+}
+
+// drawtextValue the quoted text of drawtext from template, {timestamp} is time of video as hh:mm:ss.mmm
+// drawtext expands % sequences, so the other parts are escaped first
+// quotes cannot be in the quotes of filter graph, they are replaced by typographic ones
+func drawtextValue(template string) string {
+	parts := strings.Split(strings.ReplaceAll(template, "'", "’"), "{timestamp}")
+	for i, part := range parts {
+		part = strings.NewReplacer(`\`, `\\`, `%`, `\%`).Replace(part)
+		parts[i] = escapeFilterOption(part)
+	}
+	return "'" + strings.Join(parts, `%{pts\:hms}`) + "'"
+}
@@ -0,0 +1,171 @@
+package v5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"transcode/pkg/commander"
+	"transcode/pkg/m3u8"
+	"transcode/pkg/transcoder"
+
+	"github.com/thnthien/great-deku/l"
+)
+
+const pauseName = "pause.json" // pause point of a paused job, in the stored folder
+
+var ErrPaused = errors.New("transcoding is paused") // Transcode returns it with the pause point when the job is paused
+
+// canPause the completed segments can be kept and appended to, only hls media playlists without encryption are
+func (t *transcoderImpl) canPause() bool {
+	return t.hasFormat(HLSFormat) && !t.hasFormat(DASHFormat) && !t.hasFormat(CMAFFormat) && t.req.KeyInfoFilePath == ""
+}
+
+// completedSegments number of segments which all renditions completed and the secs which they last
+// hls muxer writes vod playlists when ffmpeg quits, they end with the segment it was writing, which is not completed
+// renditions are cut at the same keyframes, so the secs are the ones of the first playlist
+func completedSegments(playlists []*m3u8.MediaPlaylist) (count int, secs float64) {
+	for i, p := range playlists {
+		n := len(p.Segments)
+		if p.Ended && n > 0 {
+			n--
+		}
+		if i == 0 || n < count {
+			count = n
+		}
+	}
+	if len(playlists) == 0 {
+		return 0, 0
+	}
+	for _, s := range playlists[0].Segments[:count] {
+		secs += s.Duration
+	}
+	return count, secs
+}
+
+// appendSegments append the segments of a resumed run to the kept segments of paused job
+// the init section of fmp4 segments is written again with the same name, so it is not repeated
+func appendSegments(kept, p *m3u8.MediaPlaylist) *m3u8.MediaPlaylist {
+	merged := *p
+	merged.MediaSequence = kept.MediaSequence
+	merged.TargetDuration = max(kept.TargetDuration, p.TargetDuration)
+	merged.Segments = append([]*m3u8.Segment{}, kept.Segments...)
+	var keptMap *m3u8.Map
+	for _, s := range kept.Segments {
+		if s.Map != nil {
+			keptMap = s.Map
+		}
+	}
+	for i, s := range p.Segments {
+		if i == 0 && s.Map != nil && keptMap != nil && s.Map.URI == keptMap.URI {
+			c := *s
+			c.Map = nil
+			s = &c
+		}
+		merged.Segments = append(merged.Segments, s)
+	}
+	return &merged
+}
+
+// pause keep the segments which all renditions completed and write the pause point of job
+// the playlists are cut to the kept segments and uploaded as event playlists, the job is resumed from the end of them
+func (t *transcoderImpl) pause() (*transcoder.PausePoint, error) {
+	var e *commander.Error
+	if errors.As(t.err, &e) && e.Killed {
+		// a killed ffmpeg doesn't write the vod playlists, so the completed segments are unknown
+		return nil, errors.New("ffmpeg was killed before it wrote the playlists, the job cannot be paused")
+	}
+	playlists := make([]*m3u8.MediaPlaylist, len(t.files))
+	for i, f := range t.files {
+		playlistPath := filepath.Join(t.req.StoredFolderPath, f.playlist)
+		p, err := m3u8.ReadMediaFile(playlistPath)
+		if errors.Is(err, os.ErrNotExist) {
+			// ffmpeg is paused before it opens the output, an empty one is kept
+			p = &m3u8.MediaPlaylist{Version: 3}
+			err = os.MkdirAll(filepath.Dir(playlistPath), 0755)
+		}
+		if err != nil {
+			return nil, err
+		}
+		playlists[i] = p
+	}
+	count, secs := completedSegments(playlists)
+	point := &transcoder.PausePoint{Time: secs, LastSegments: make([]int64, len(playlists))}
+	for i, p := range playlists {
+		p.Segments = p.Segments[:count]
+		p.Ended = false
+		p.PlaylistType = m3u8.PlaylistEvent // segments are appended when the job is resumed
+		if err := m3u8.WriteFile(filepath.Join(t.req.StoredFolderPath, t.files[i].playlist), p); err != nil {
+			return nil, err
+		}
+		t.uploadFile(t.files[i].playlist)
+		point.LastSegments[i] = p.MediaSequence + int64(count) - 1
+	}
+	b, err := json.Marshal(point)
+	if err != nil {
+		return nil, err
+	}
+	t.ll.Info("paused transcode file", l.Object("pause_point", point))
+	return point, os.WriteFile(filepath.Join(t.req.StoredFolderPath, pauseName), b, 0644)
+}
+
+// readPausePoint the pause point of the paused job in folder
+func readPausePoint(folder string) (*transcoder.PausePoint, error) {
+	b, err := os.ReadFile(filepath.Join(folder, pauseName))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read pause point of job: %w", err)
+	}
+	point := &transcoder.PausePoint{}
+	if err = json.Unmarshal(b, point); err != nil {
+		return nil, fmt.Errorf("cannot read pause point of job: %w", err)
+	}
+	return point, nil
+}
+
+// nextSegment index of the first segment of resumed job, renditions have the same number of kept segments
+func nextSegment(point *transcoder.PausePoint) int64 {
+	if len(point.LastSegments) == 0 {
+		return 0
+	}
+	return point.LastSegments[0] + 1
+}
+
+// loadKept read the kept playlists of paused job before ffmpeg overwrites them
+// the renditions must be the ones which are paused
+func (t *transcoderImpl) loadKept(point *transcoder.PausePoint) error {
+	if len(point.LastSegments) != len(t.files) {
+		return fmt.Errorf("job was paused with %d renditions, it is resumed with %d",
+			len(point.LastSegments), len(t.files))
+	}
+	t.kept = make([]*m3u8.MediaPlaylist, len(t.files))
+	for i, f := range t.files {
+		p, err := m3u8.ReadMediaFile(filepath.Join(t.req.StoredFolderPath, f.playlist))
+		if err != nil {
+			return err
+		}
+		if last := p.MediaSequence + int64(len(p.Segments)) - 1; last != point.LastSegments[i] {
+			return fmt.Errorf("playlist %s ends at segment %d, it was paused at %d", f.playlist, last, point.LastSegments[i])
+		}
+		t.kept[i] = p
+	}
+	return nil
+}
+
+// appendKept put the kept segments of paused job before the segments of resumed run in the playlists and upload them
+func (t *transcoderImpl) appendKept() {
+	for i, f := range t.files {
+		playlistPath := filepath.Join(t.req.StoredFolderPath, f.playlist)
+		p, err := m3u8.ReadMediaFile(playlistPath)
+		if err != nil {
+			t.ll.Error("cannot read playlist of resumed job", l.String("playlist", f.playlist), l.Error(err))
+			continue
+		}
+		if err = m3u8.WriteFile(playlistPath, appendSegments(t.kept[i], p)); err != nil {
+			t.ll.Error("cannot append kept segments", l.String("playlist", f.playlist), l.Error(err))
+			continue
+		}
+		t.uploadFile(f.playlist)
+	}
+	t.kept = nil
+}
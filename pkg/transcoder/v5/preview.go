@@ -0,0 +1,131 @@
+package v5
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"strings"
+	"transcode/pkg/request"
+	"transcode/pkg/transcoder"
+)
+
+// PreviewFormat container of animated preview
+type PreviewFormat string
+
+const (
+	WebPPreview PreviewFormat = "webp" // animated webp
+	GIFPreview  PreviewFormat = "gif"
+	MP4Preview  PreviewFormat = "mp4" // small h264 video without audio
+)
+
+const (
+	defaultPreviewDuration = 6 // secs
+	defaultPreviewSnippets = 3
+	defaultPreviewWidth    = 320
+	maxPreviewDuration     = 30
+	previewFPS             = 12
+)
+
+// PreviewOptions animated preview of video which is generated after the renditions
+type PreviewOptions struct {
+	Format   PreviewFormat `json:"format"`   // empty if no preview is requested
+	Duration float64       `json:"duration"` // secs of preview, it is shared by snippets
+	Snippets int           `json:"snippets"`
+	Width    int           `json:"width"`
+}
+
+// NewPreviewOptions validate preview of request and fill the defaults
+func NewPreviewOptions(req request.PreviewReq) (PreviewOptions, error) {
+	o := PreviewOptions{
+		Format:   PreviewFormat(strings.ToLower(req.Format)),
+		Duration: req.Duration,
+		Snippets: req.Snippets,
+		Width:    req.Width,
+	}
+	switch o.Format {
+	case "", WebPPreview, GIFPreview, MP4Preview:
+	default:
+		return o, fmt.Errorf("unknown preview format %s", req.Format)
+	}
+	if o.Duration < 0 || o.Duration > maxPreviewDuration {
+		return o, fmt.Errorf("duration %v of preview must be in [0, %d]", o.Duration, maxPreviewDuration)
+	}
+	if o.Snippets < 0 || o.Width < 0 {
+		return o, fmt.Errorf("snippets and width of preview cannot be negative")
+	}
+	if o.Duration == 0 {
+		o.Duration = defaultPreviewDuration
+	}
+	if o.Snippets == 0 {
+		o.Snippets = defaultPreviewSnippets
+	}
+	if o.Width == 0 {
+		o.Width = defaultPreviewWidth
+	}
+	return o, nil
+}
+
+// enabled a preview is requested
+func (o PreviewOptions) enabled() bool {
+	return o.Format != ""
+}
+
+// planPreview the snippets of preview, they are evenly spaced and each one is centered in its part of source
+// source which is shorter than preview is used as a single snippet
+func (b *CommandBuilder) planPreview(cfg CommandConfig, o PreviewOptions) *transcoder.Preview {
+	duration := float64(cfg.SourceDuration)
+	if duration <= 0 {
+		return nil
+	}
+	p := &transcoder.Preview{
+		Path:   "preview." + string(o.Format),
+		Format: string(o.Format),
+		Width:  o.Width,
+		Height: scaledEdge(cfg.SourceHeight, cfg.SourceWidth, int64(o.Width)),
+	}
+	if duration <= o.Duration {
+		p.Duration = duration
+		p.Snippets = []transcoder.Snippet{{Start: 0, Duration: duration}}
+		return p
+	}
+	length := o.Duration / float64(o.Snippets)
+	part := duration / float64(o.Snippets)
+	for i := 0; i < o.Snippets; i++ {
+		start := math.Max(0, part*(float64(i)+0.5)-length/2)
+		p.Snippets = append(p.Snippets, transcoder.Snippet{Start: math.Round(start*1000) / 1000, Duration: length})
+	}
+	p.Duration = o.Duration
+	return p
+}
+
+// buildPreviewCommand build the ffmpeg args which concat the snippets of preview into a silent animation
+// each snippet is an input which is seeked, so only the snippets are decoded
+// eg: ffmpeg -y -ss 173 -t 2 -i input.mp4 -ss 523 -t 2 -i input.mp4 -ss 873 -t 2 -i input.mp4
+// -filter_complex [0:v:0]setpts=PTS-STARTPTS[s0];[1:v:0]setpts=PTS-STARTPTS[s1];[2:v:0]setpts=PTS-STARTPTS[s2];
+// [s0][s1][s2]concat=n=3:v=1:a=0,fps=12,scale=320:180[preview]
+// -map [preview] -an -c:v libwebp -loop 0 -q:v 60 output/preview.webp
+func (b *CommandBuilder) buildPreviewCommand(cfg CommandConfig, p *transcoder.Preview) []string {
+	args := []string{"-y"}
+	var graph, labels string
+	for i, s := range p.Snippets {
+		args = append(args, "-ss", formatSeconds(s.Start), "-t", formatSeconds(s.Duration), "-i", cfg.FilePath)
+		graph += fmt.Sprintf("[%d:v:0]setpts=PTS-STARTPTS[s%d];", i, i)
+		labels += fmt.Sprintf("[s%d]", i)
+	}
+	graph += fmt.Sprintf("%sconcat=n=%d:v=1:a=0,fps=%d,scale=%d:%d", labels, len(p.Snippets), previewFPS, p.Width, p.Height)
+	output := filepath.Join(cfg.StoredFolderPath, p.Path)
+	switch PreviewFormat(p.Format) {
+	case GIFPreview:
+		// a palette of the preview keeps colors of gif
+		graph += ",split[a][b];[a]palettegen[palette];[b][palette]paletteuse[preview]"
+		return append(args, "-filter_complex", graph, "-map", "[preview]", "-an", "-loop", "0", output)
+	case MP4Preview:
+		graph += ",format=yuv420p[preview]"
+		return append(args, "-filter_complex", graph, "-map", "[preview]", "-an",
+			"-c:v", "libx264", "-crf", "28", "-movflags", "+faststart", output)
+	default:
+		graph += "[preview]"
+		return append(args, "-filter_complex", graph, "-map", "[preview]", "-an",
+			"-c:v", "libwebp", "-loop", "0", "-q:v", "60", output)
+	}
+}
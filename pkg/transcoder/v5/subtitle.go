@@ -0,0 +1,184 @@
+package v5
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"transcode/pkg/ffprobe"
+	"transcode/pkg/m3u8"
+	"transcode/pkg/request"
+)
+
+const (
+	subtitleGroup = "subs" // group id of subtitle renditions in master
+	mpegtsDelay   = 126000 // ffmpeg delays timestamps of mpegts segments by twice the default mux delay 0.7s, in 90kHz
+)
+
+var (
+	subtitleRegex = regexp.MustCompile(`.?subs_(\d+)(?:\.m3u8|/).?`) // playlists and segments of subtitle renditions
+
+	// extensions of sidecar subtitle files which ffmpeg can convert to webvtt
+	subtitleExtensions = map[string]struct{}{
+		".srt": {},
+		".ass": {},
+		".ssa": {},
+		".vtt": {},
+	}
+)
+
+// subtitle a subtitle rendition, converted from an embedded text stream or a sidecar file
+type subtitle struct {
+	Stream   int    // index of embedded stream in source, -1 for sidecar file
+	FilePath string // sidecar file, empty for embedded stream
+	Language string
+	Title    string
+	Default  bool
+	Forced   bool
+}
+
+// subtitlePlaylist name of webvtt playlist of subtitle idx, relative to the stored folder
+func subtitlePlaylist(idx int) string {
+	return fmt.Sprintf("subs_%d.m3u8", idx)
+}
+
+// subtitleSegmentDir folder of webvtt segments of subtitle idx, relative to the stored folder
+func subtitleSegmentDir(idx int) string {
+	return fmt.Sprintf("subs_%d", idx)
+}
+
+// name of subtitle in players, it is the title, language or index of subtitle
+func (s subtitle) name(idx int) string {
+	if s.Title != "" {
+		return s.Title
+	}
+	if s.Language != "" {
+		return s.Language
+	}
+	return "subtitle_" + strconv.Itoa(idx)
+}
+
+// buildSubtitles the subtitles of embedded text streams of source and sidecar files of request
+// bitmap streams are skipped because they cannot be converted to webvtt
+func buildSubtitles(streams []ffprobe.SubtitleStream, sidecars []request.SubtitleReq) ([]subtitle, error) {
+	subtitles := make([]subtitle, 0, len(streams)+len(sidecars))
+	for _, s := range streams {
+		if !s.Text() {
+			continue
+		}
+		subtitles = append(subtitles, subtitle{
+			Stream:   s.Index,
+			Language: s.Language,
+			Title:    s.Title,
+			Default:  s.Default,
+			Forced:   s.Forced,
+		})
+	}
+	for _, s := range sidecars {
+		if _, ok := subtitleExtensions[strings.ToLower(filepath.Ext(s.FilePath))]; !ok {
+			return nil, fmt.Errorf("unsupported subtitle file %s", s.FilePath)
+		}
+		if _, err := os.Stat(s.FilePath); err != nil {
+			return nil, fmt.Errorf("cannot read subtitle file %s: %w", s.FilePath, err)
+		}
+		subtitles = append(subtitles, subtitle{
+			Stream:   -1,
+			FilePath: s.FilePath,
+			Language: s.Language,
+			Title:    s.Title,
+			Default:  s.Default,
+			Forced:   s.Forced,
+		})
+	}
+	return subtitles, nil
+}
+
+// buildSubtitleCommand build the ffmpeg args which convert subtitles to segmented webvtt, an output for each subtitle
+// source is the first input if a subtitle is embedded, the sidecar files are the next ones
+// segmentTime: the segment duration of renditions, so subtitle segments are cut with them
+// eg: ffmpeg -y -i input.mkv -i en.srt
+// -map 0:3 -c:s webvtt -f segment -segment_time 6 -segment_format webvtt -segment_list_type m3u8
+// -segment_list output/subs_0.m3u8 -segment_list_entry_prefix subs_0/ output/subs_0/data%02d.vtt
+// -map 1:s:0 -c:s webvtt ... output/subs_1/data%02d.vtt
+func (b *CommandBuilder) buildSubtitleCommand(filePath, storedFolderPath string, subtitles []subtitle, segmentTime string) []string {
+	args := []string{"-y"}
+	input := 0
+	for _, s := range subtitles {
+		if s.FilePath == "" {
+			args = append(args, "-i", filePath)
+			input++
+			break
+		}
+	}
+	var outputs []string
+	for idx, s := range subtitles {
+		stream := fmt.Sprintf("0:%d", s.Stream)
+		if s.FilePath != "" {
+			args = append(args, "-i", s.FilePath)
+			stream = fmt.Sprintf("%d:s:0", input)
+			input++
+		}
+		dir := subtitleSegmentDir(idx)
+		outputs = append(outputs,
+			"-map", stream, "-c:s", "webvtt",
+			"-f", "segment", "-segment_time", segmentTime, "-segment_format", "webvtt",
+			"-segment_list_type", "m3u8", "-segment_list", filepath.Join(storedFolderPath, subtitlePlaylist(idx)),
+			// segment muxer writes the base names of segments
+			"-segment_list_entry_prefix", dir+"/",
+			filepath.Join(storedFolderPath, dir, "data%02d.vtt"),
+		)
+	}
+	return append(args, outputs...)
+}
+
+// addTimestampMap map cue time 0 of webvtt segment to the mpegts timestamp of media segments, so subtitles are in sync with them
+// segment muxer doesn't write the map, without it players take cue times as timestamps of media segments
+func addTimestampMap(filePath string, mpegts int64) error {
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	header, cues, _ := strings.Cut(string(b), "\n")
+	if !strings.HasPrefix(header, "WEBVTT") {
+		return fmt.Errorf("%s is not a webvtt file", filePath)
+	}
+	if strings.HasPrefix(cues, "X-TIMESTAMP-MAP") {
+		return nil
+	}
+	timestampMap := fmt.Sprintf("X-TIMESTAMP-MAP=MPEGTS:%d,LOCAL:00:00:00.000\n", mpegts)
+	return os.WriteFile(filePath, []byte(header+"\n"+timestampMap+cues), 0644)
+}
+
+// subtitleMedia the EXT-X-MEDIA of subtitle idx
+func subtitleMedia(s subtitle, idx int) *m3u8.Media {
+	return &m3u8.Media{
+		Type:       m3u8.MediaSubtitles,
+		GroupID:    subtitleGroup,
+		Name:       s.name(idx),
+		Language:   s.Language,
+		Default:    s.Default,
+		Autoselect: true,
+		Forced:     s.Forced,
+		URI:        subtitlePlaylist(idx),
+	}
+}
+
+// setSubtitleMedia replace the subtitle renditions in master, variants refer to their group if there is any
+func setSubtitleMedia(p *m3u8.MasterPlaylist, media []*m3u8.Media) {
+	kept := make([]*m3u8.Media, 0, len(p.Media)+len(media))
+	for _, m := range p.Media {
+		if m.Type != m3u8.MediaSubtitles || m.GroupID != subtitleGroup {
+			kept = append(kept, m)
+		}
+	}
+	p.Media = append(kept, media...)
+	for _, v := range p.Variants {
+		if len(media) > 0 {
+			v.Subtitles = subtitleGroup
+		} else if v.Subtitles == subtitleGroup {
+			v.Subtitles = ""
+		}
+	}
+}
@@ -2,12 +2,22 @@ package v5
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+	"transcode/pkg/commander"
 	"transcode/pkg/config"
+	ffmpegrunner "transcode/pkg/ffmpeg_runner"
 	"transcode/pkg/ffprobe"
+	"transcode/pkg/m3u8"
 	"transcode/pkg/request"
 	"transcode/pkg/resolution"
+	"transcode/pkg/transcoder"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/thnthien/great-deku/container"
@@ -93,6 +103,10 @@ func Test_BuildCommand(t *testing.T) {
 		SourceBitRate:      491882,
 		SourceAudioBitRate: 170658,
 		SourceFrameRate:    30,
+		SourceVideoCodec:   "h264",
+		SourceGOP: &ffprobe.GOPInfo{ // keyframe every 260 frames
+			KeyframeCount: 122, MeanInterval: 26.0 / 3, MinInterval: 26.0 / 3, MaxInterval: 26.0 / 3, Fixed: true,
+		},
 	})
 	assert.Equal(t, []string{"-y", "-threads", "1", "-hwaccel", "cuda", "-hwaccel_output_format", "cuda",
 		"-i", "/home/thienthn/Downloads/1651904407363.mp4", "-preset", "medium",
@@ -130,3 +144,807 @@ func Test_BuildCommand(t *testing.T) {
 		"-master_pl_name", "master.m3u8", "-var_stream_map", "v:0,a:0 v:1,a:1 v:2,a:2", "-fps_mode", "passthrough",
 		"/home/thienthn/Downloads/output/test/stream_%v.m3u8"}, args)
 }
+
+func Test_BuildSoftwareCommand(t *testing.T) {
+	args, _ := defaultCommandBuilder.buildCommand(CommandConfig{
+		FolderName:         "thienthn",
+		FilePath:           "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720, resolution.R360},
+		SourceWidth:        1920,
+		SourceHeight:       1080,
+		SourceResolution:   1080,
+		SourceDuration:     527,
+		SourceBitRate:      1492330,
+		SourceAudioBitRate: 317375,
+		SourceFrameRate:    60,
+		Encoder:            SoftwareEncoder,
+	})
+	assert.Equal(t, []string{"-y",
+		"-i", "/home/thienthn/Downloads/hotkids.mp4", "-preset", "medium", "-c:v", "libx264",
+		"-sc_threshold", "0", "-forced-idr", "1", "-force_key_frames", "expr:gte(t,n_forced*6)",
+		"-ac", "2", "-map", "v:0", "-map", "v:0", "-map", "v:0", "-map", "a:0", "-map", "a:0", "-map", "a:0",
+		"-filter:v:0", "scale=-2:1080", "-b:v:0", "1457k", "-maxrate:v:0", "2186k", "-bufsize:v:0", "2186k",
+		"-filter:v:1", "fps=30,scale=-2:720", "-b:v:1", "809k", "-maxrate:v:1", "1214k", "-bufsize:v:1", "1214k",
+		"-filter:v:2", "fps=30,scale=-2:360", "-b:v:2", "187k", "-maxrate:v:2", "281k", "-bufsize:v:2", "281k",
+		"-b:a:0", "256k", "-b:a:1", "192k", "-b:a:2", "96k", "-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+		"-hls_flags", "independent_segments", "-hls_segment_type", "mpegts",
+		"-hls_segment_filename", "/home/thienthn/Downloads/output/test/stream_%v/data%02d.ts",
+		"-master_pl_name", "master.m3u8", "-var_stream_map", "v:0,a:0 v:1,a:1 v:2,a:2", "-fps_mode", "passthrough",
+		"/home/thienthn/Downloads/output/test/stream_%v.m3u8"}, args)
+}
+
+func Test_BuildDASHCommand(t *testing.T) {
+	cfg := CommandConfig{
+		FolderName:         "thienthn",
+		FilePath:           "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:        1920,
+		SourceHeight:       1080,
+		SourceResolution:   1080,
+		SourceDuration:     527,
+		SourceBitRate:      1492330,
+		SourceAudioBitRate: 317375,
+		SourceFrameRate:    30,
+		Formats:            []OutputFormat{DASHFormat},
+	}
+	args, _ := defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, []string{"-y", "-threads", "1", "-hwaccel", "cuda", "-hwaccel_output_format", "cuda",
+		"-i", "/home/thienthn/Downloads/hotkids.mp4", "-preset", "medium", "-c:v", "h264_nvenc",
+		"-no-scenecut", "1", "-forced-idr", "1", "-force_key_frames", "expr:gte(t,n_forced*6)",
+		"-ac", "2", "-map", "v:0", "-map", "v:0", "-map", "a:0",
+		"-filter:v:0", "scale_npp=-2:1080", "-b:v:0", "1457k", "-maxrate:v:0", "2186k", "-bufsize:v:0", "2186k",
+		"-filter:v:1", "scale_npp=-2:720", "-b:v:1", "809k", "-maxrate:v:1", "1214k", "-bufsize:v:1", "1214k",
+		"-b:a:0", "256k", "-f", "dash", "-seg_duration", "6", "-use_template", "1", "-use_timeline", "1",
+		"-init_seg_name", "init_stream_$RepresentationID$.m4s",
+		"-media_seg_name", "chunk_stream_$RepresentationID$_$Number%05d$.m4s",
+		"-adaptation_sets", "id=0,streams=v id=1,streams=a", "-fps_mode", "passthrough",
+		"/home/thienthn/Downloads/output/test/manifest.mpd"}, args)
+
+	cfg.Formats = []OutputFormat{CMAFFormat}
+	args, _ = defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, []string{"-hls_playlist", "1", "-adaptation_sets", "id=0,streams=v id=1,streams=a",
+		"-fps_mode", "passthrough", "/home/thienthn/Downloads/output/test/manifest.mpd"}, args[len(args)-7:])
+
+	// renditions are encoded once and shared by hls and dash muxers
+	cfg.Formats = []OutputFormat{HLSFormat, DASHFormat}
+	args, _ = defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, 2, countOf(args, "-filter:v:0")+countOf(args, "-filter:v:1"))
+	assert.Subset(t, args, []string{"-c:a", "aac"})
+	assert.Equal(t, []string{"-map", "v:0", "-map", "v:0", "-map", "a:0", "-map", "a:0"}, args[23:31])
+	assert.Equal(t, []string{"-flags", "+global_header", "-fps_mode", "passthrough", "-f", "tee",
+		`[f=hls:hls_time=\'6\':hls_playlist_type=\'vod\':hls_flags=\'independent_segments\':hls_segment_type=\'mpegts\':` +
+			`hls_segment_filename=\'/home/thienthn/Downloads/output/test/stream_%v/data%02d.ts\':` +
+			`master_pl_name=\'master.m3u8\':var_stream_map=\'v:0,a:0 v:1,a:1\']` +
+			`/home/thienthn/Downloads/output/test/stream_%v.m3u8|` +
+			`[f=dash:select=\'v,a:0\':seg_duration=\'6\':use_template=\'1\':use_timeline=\'1\':` +
+			`init_seg_name=\'init_stream_$RepresentationID$.m4s\':` +
+			`media_seg_name=\'chunk_stream_$RepresentationID$_$Number%05d$.m4s\':` +
+			`adaptation_sets=\'id=0,streams=v id=1,streams=a\']/home/thienthn/Downloads/output/test/manifest.mpd`,
+	}, args[len(args)-7:])
+}
+
+func countOf(args []string, arg string) int {
+	n := 0
+	for _, a := range args {
+		if a == arg {
+			n++
+		}
+	}
+	return n
+}
+
+func Test_BuildMultiCodecCommand(t *testing.T) {
+	cfg := CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:        1920,
+		SourceHeight:       1080,
+		SourceResolution:   1080,
+		SourceDuration:     527,
+		SourceBitRate:      1492330,
+		SourceAudioBitRate: 317375,
+		SourceFrameRate:    30,
+		Encoder:            SoftwareEncoder,
+		Codecs:             []Codec{H264, HEVC},
+	}
+	args, renditions := defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, 4, len(renditions))
+	assert.Equal(t, HEVC, renditions[2].Codec)
+	assert.Equal(t, resolution.R1080, renditions[2].Resolution)
+	assert.Subset(t, args, []string{"-c:v:2", "libx265", "-x265-params:v:2", "scenecut=0", "-b:v:2", "874k", "-tag:v:2", "hvc1"})
+	assert.Equal(t, []string{"-hls_segment_type", "fmp4", "-hls_fmp4_init_filename", "stream_%v_init.mp4",
+		"-hls_segment_filename", "/home/thienthn/Downloads/output/test/stream_%v/data%02d.m4s",
+		"-master_pl_name", "master.m3u8", "-var_stream_map", "v:0,a:0 v:1,a:1 v:2,a:2 v:3,a:3", "-fps_mode", "passthrough",
+		"/home/thienthn/Downloads/output/test/stream_%v.m3u8"}, args[len(args)-13:])
+}
+
+func Test_CodecString(t *testing.T) {
+	assert.Equal(t, "avc1.4d4028", videoCodecString(H264, "h264_nvenc", 1920, 1080, 30))
+	assert.Equal(t, "avc1.64001f", videoCodecString(H264, "libx264", 1280, 720, 30))
+	assert.Equal(t, "hvc1.1.6.L120.B0", videoCodecString(HEVC, "libx265", 1920, 1080, 30))
+	assert.Equal(t, "av01.0.08M.08", videoCodecString(AV1, "libsvtav1", 1920, 1080, 30))
+	assert.Equal(t, "avc1.640029", sourceH264CodecString("High", 41))
+	assert.Equal(t, "mp4a.40.2", audioCodecString("mp3", false))
+	assert.Equal(t, "mp4a.40.34", audioCodecString("mp3", true))
+}
+
+func Test_SetMasterAttributes(t *testing.T) {
+	master := &m3u8.MasterPlaylist{Version: 7, Variants: []*m3u8.Variant{
+		{URI: "stream_0.m3u8", Bandwidth: 1900000, AverageBandwidth: 1700000, Width: 1920, Height: 1080, Codecs: "avc1.4d4028,mp4a.40.2"},
+		{URI: "stream_1.m3u8", Bandwidth: 1000000, Width: 1920, Height: 1080},
+	}}
+	setMasterAttributes(master, map[string]variantAttributes{
+		"stream_0.m3u8": {Bandwidth: 2100000, AverageBandwidth: 1500000, Width: 1920, Height: 1080, FrameRate: 30000.0 / 1001, Codecs: "avc1.640028,mp4a.40.2"},
+		"stream_1.m3u8": {Codecs: "av01.0.08M.08,mp4a.40.2"},
+	})
+	assert.Equal(t, "#EXTM3U\n#EXT-X-VERSION:7\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=2100000,AVERAGE-BANDWIDTH=1500000,RESOLUTION=1920x1080,FRAME-RATE=29.970,CODECS=\"avc1.640028,mp4a.40.2\"\nstream_0.m3u8\n\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1920x1080,CODECS=\"av01.0.08M.08,mp4a.40.2\"\nstream_1.m3u8\n\n",
+		master.Encode())
+}
+
+func Test_ExactFrameRate(t *testing.T) {
+	info := &ffprobe.InputInfo{FrameRate: 60, ExactFrameRate: 60000.0 / 1001}
+	assert.InDelta(t, 59.94, rendition{FrameRate: 60}.exactFrameRate(info), 0.001)
+	assert.InDelta(t, 29.97, rendition{FrameRate: 30}.exactFrameRate(info), 0.001)
+	assert.Equal(t, 25.0, rendition{FrameRate: 25}.exactFrameRate(&ffprobe.InputInfo{FrameRate: 25}))
+}
+
+func Test_MeasurePlaylist(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "data00.ts"), make([]byte, 1000), 0666))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "data01.ts"), make([]byte, 3000), 0666))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "stream_0.m3u8"), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:4\n"+
+		"#EXTINF:4.000000,\ndata00.ts\n#EXTINF:2.000000,\ndata01.ts\n#EXT-X-ENDLIST\n"), 0666))
+	stats, err := measurePlaylist(filepath.Join(dir, "stream_0.m3u8"))
+	assert.Nil(t, err)
+	assert.Equal(t, bandwidthStats{Peak: 12000, Average: 5334}, stats)
+}
+
+func Test_NamingTemplate(t *testing.T) {
+	naming := NamingTemplate{Playlist: "{res}p/index.m3u8", Segment: "{res}p/seg_{n:05}.ts"}
+	assert.Nil(t, naming.Validate())
+	args, renditions := defaultCommandBuilder.buildCommand(CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:        1920,
+		SourceHeight:       1080,
+		SourceResolution:   1080,
+		SourceDuration:     527,
+		SourceBitRate:      1492330,
+		SourceAudioBitRate: 317375,
+		SourceFrameRate:    30,
+		Naming:             naming,
+	})
+	assert.Equal(t, []string{"-hls_segment_type", "mpegts",
+		"-hls_segment_filename", "/home/thienthn/Downloads/output/test/%vp/seg_%05d.ts",
+		"-master_pl_name", "master.m3u8", "-var_stream_map", "v:0,a:0,name:1080 v:1,a:1,name:720", "-fps_mode", "passthrough",
+		"/home/thienthn/Downloads/output/test/%vp/index.m3u8"}, args[len(args)-11:])
+
+	files := naming.files(renditions, false)
+	assert.Equal(t, "720p/index.m3u8", files[1].playlist)
+	assert.True(t, files[1].match("720p/seg_00012.ts"))
+	assert.False(t, files[0].match("720p/seg_00012.ts"))
+
+	_, renditions = defaultCommandBuilder.buildCommand(CommandConfig{
+		TargetResolutions: []resolution.Resolution{resolution.R720},
+		SourceWidth:       1280, SourceHeight: 720, SourceResolution: 720, SourceFrameRate: 30,
+		Codecs: []Codec{H264, HEVC},
+	})
+	_, err := naming.renditionNames(renditions)
+	assert.NotNil(t, err)
+	naming = NamingTemplate{Playlist: "{codec}_{res}p/index.m3u8", Segment: "{codec}_{res}p/seg_{n}.ts"}
+	assert.Nil(t, naming.Validate())
+	names, err := naming.renditionNames(renditions)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"h264_720", "hevc_720"}, names)
+	_, segment, init := naming.ffmpegNames(true)
+	assert.Equal(t, "%vp/seg_%d.m4s", segment)
+	assert.Equal(t, "init_%v.mp4", init)
+	assert.Equal(t, "hevc_720p/init_hevc_720.mp4", naming.files(renditions, true)[1].init)
+
+	assert.NotNil(t, NamingTemplate{Playlist: "index.m3u8"}.Validate())
+	assert.NotNil(t, NamingTemplate{Playlist: "{res}p/index.m3u8", Segment: "seg_{n}.ts"}.Validate())
+	assert.NotNil(t, NamingTemplate{Segment: "stream_{v}/data.ts"}.Validate())
+	assert.NotNil(t, NamingTemplate{Segment: "stream_{v}/{name}{n}.ts"}.Validate())
+	assert.NotNil(t, NamingTemplate{Playlist: "{codec}/{res}p.m3u8", Segment: "{codec}/{res}p_{n}.ts"}.Validate())
+	assert.False(t, NamingTemplate{Playlist: DefaultPlaylistTemplate}.custom())
+	assert.True(t, NamingTemplate{Segment: "stream_{v}/seg_{n:05}.ts"}.custom())
+}
+
+func Test_FixSegmentURIs(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "stream_0"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "stream_0", "data00.ts"), []byte{0}, 0666))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "stream_0.m3u8"), []byte("#EXTM3U\n#EXT-X-TARGETDURATION:6\n"+
+		"#EXTINF:6.000000,\ndata00.ts\n#EXT-X-ENDLIST\n"), 0666))
+	files := NamingTemplate{}.files([]rendition{{Resolution: resolution.R1080}}, false)
+	// playlist is not changed while ffmpeg rewrites it, the copy is uploaded
+	fixed, err := files[0].fixedCopy(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "stream_0.m3u8.fixed"), fixed)
+	p, err := m3u8.ReadMediaFile(fixed)
+	assert.Nil(t, err)
+	assert.Equal(t, "stream_0/data00.ts", p.Segments[0].URI)
+	p, err = m3u8.ReadMediaFile(filepath.Join(dir, "stream_0.m3u8"))
+	assert.Nil(t, err)
+	assert.Equal(t, "data00.ts", p.Segments[0].URI)
+
+	changed, err := files[0].fixSegmentURIs(dir)
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	p, err = m3u8.ReadMediaFile(filepath.Join(dir, "stream_0.m3u8"))
+	assert.Nil(t, err)
+	assert.Equal(t, "stream_0/data00.ts", p.Segments[0].URI)
+
+	changed, err = files[0].fixSegmentURIs(dir)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	fixed, err = files[0].fixedCopy(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "stream_0.m3u8"), fixed)
+}
+
+func Test_BuildExtendedResolutions(t *testing.T) {
+	_, renditions := defaultCommandBuilder.buildCommand(CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/4k.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R2160, resolution.R1440, resolution.R1080, 900, resolution.R240, resolution.R144},
+		SourceWidth:        3840,
+		SourceHeight:       2160,
+		SourceResolution:   2160,
+		SourceDuration:     60,
+		SourceBitRate:      40 * Mb,
+		SourceAudioBitRate: 317375,
+		SourceFrameRate:    60,
+	})
+	var res []resolution.Resolution
+	for _, r := range renditions {
+		res = append(res, r.Resolution)
+	}
+	// 144 is lower than the ignore threshold
+	assert.Equal(t, []resolution.Resolution{resolution.R2160, resolution.R1440, resolution.R1080, 900, resolution.R240}, res)
+	assert.Equal(t, 60, renditions[1].FrameRate)
+	assert.Equal(t, 30, renditions[3].FrameRate)
+	assert.Equal(t, 1600, renditions[3].Width)
+	assert.Equal(t, resolution.RungOf(resolution.R2160).Bitrate, renditions[0].bitRate.bitRate)
+	assert.Equal(t, resolution.RungOf(resolution.R1440).Bitrate, renditions[1].bitRate.bitRate)
+}
+
+func Test_BuildPortraitCommand(t *testing.T) {
+	cfg := CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/phone.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:        1080,
+		SourceHeight:       1920,
+		SourceResolution:   1080,
+		SourceDuration:     30,
+		SourceBitRate:      1492330,
+		SourceAudioBitRate: 317375,
+		SourceFrameRate:    30,
+		SourceRotation:     90,
+	}
+	args, renditions := defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, []string{"-y", "-threads", "1", "-hwaccel", "cuda",
+		"-i", "/home/thienthn/Downloads/phone.mp4"}, args[:7])
+	assert.Subset(t, args, []string{"-filter:v:0", "hwupload_cuda,scale_npp=1080:-2", "-filter:v:1", "hwupload_cuda,scale_npp=720:-2"})
+	assert.Equal(t, 1080, renditions[0].Width)
+	assert.Equal(t, 1920, renditions[0].Height)
+	assert.Equal(t, 720, renditions[1].Width)
+	assert.Equal(t, 1280, renditions[1].Height)
+	assert.Equal(t, resolution.R720, renditions[1].Resolution)
+
+	cfg.Encoder = SoftwareEncoder
+	cfg.SourceRotation = 0
+	args, _ = defaultCommandBuilder.buildCommand(cfg)
+	assert.Subset(t, args, []string{"-filter:v:1", "scale=720:-2"})
+}
+
+func Test_BuildAudioOnlyCommand(t *testing.T) {
+	cfg := CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/podcast.mp3",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceDuration:     3600,
+		SourceAudioBitRate: 320000,
+		SourceNoVideo:      true,
+	}
+	args, renditions := defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, []rendition{{NoVideo: true, AudioBitRate: 256 * Kb}}, renditions)
+	assert.Equal(t, []string{"-y", "-i", "/home/thienthn/Downloads/podcast.mp3", "-ac", "2", "-map", "a:0", "-b:a:0", "256k"}, args[:9])
+	assert.Subset(t, args, []string{"-var_stream_map", "a:0"})
+	assert.NotContains(t, args, "v:0")
+	assert.NotContains(t, args, "-c:v")
+	assert.NotContains(t, args, "-filter:v:0")
+	assert.Equal(t, "mp4a.40.2", renditions[0].codecsString(defaultCommandBuilder.chooseEncoder(SoftwareEncoder), &ffprobe.InputInfo{AudioCodecName: "mp3"}))
+
+	cfg.Naming = NamingTemplate{Playlist: "{res}/index.m3u8", Segment: "{res}/seg{n}.ts"}
+	args, _ = defaultCommandBuilder.buildCommand(cfg)
+	assert.Subset(t, args, []string{"-var_stream_map", "a:0,name:audio"})
+}
+
+func Test_BuildVideoOnlyCommand(t *testing.T) {
+	cfg := CommandConfig{
+		FilePath:          "/home/thienthn/Downloads/silent.mp4",
+		StoredFolderPath:  "/home/thienthn/Downloads/output/test",
+		TargetResolutions: []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:       1920,
+		SourceHeight:      1080,
+		SourceResolution:  1080,
+		SourceDuration:    30,
+		SourceBitRate:     1492330,
+		SourceFrameRate:   30,
+		SourceNoAudio:     true,
+		Encoder:           SoftwareEncoder,
+	}
+	args, renditions := defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, 2, len(renditions))
+	assert.Subset(t, args, []string{"-var_stream_map", "v:0 v:1"})
+	assert.NotContains(t, args, "-ac")
+	assert.NotContains(t, args, "a:0")
+	assert.True(t, renditions[0].NoAudio)
+	assert.Equal(t, "avc1.640028", renditions[0].codecsString(defaultCommandBuilder.chooseEncoder(SoftwareEncoder), &ffprobe.InputInfo{}))
+}
+
+func Test_BuildAlternateAudioCommand(t *testing.T) {
+	cfg := CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/movie.mkv",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:        1920,
+		SourceHeight:       1080,
+		SourceResolution:   1080,
+		SourceDuration:     527,
+		SourceBitRate:      1492330,
+		SourceAudioBitRate: 384000,
+		SourceFrameRate:    30,
+		SourceAudioStreams: []ffprobe.AudioStream{
+			{Index: 1, CodecName: "flac", Channels: 6, Language: "eng"},
+			{Index: 2, CodecName: "eac3", BitRate: 128000, Channels: 2, Language: "fra", Default: true},
+		},
+		Encoder: SoftwareEncoder,
+	}
+	args, renditions := defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, 4, len(renditions))
+	assert.True(t, renditions[0].NoAudio)
+	assert.Equal(t, "fra", renditions[3].Audio.Language)
+	assert.True(t, renditions[3].Audio.Default)
+	assert.False(t, renditions[2].Audio.Default)
+	assert.Subset(t, args, []string{"-map", "0:1", "0:2", "-b:a:0", "256k", "-c:a:1", "copy"})
+	assert.NotContains(t, args, "a:0")
+	assert.Subset(t, args, []string{"-var_stream_map",
+		"v:0,agroup:audio v:1,agroup:audio a:0,agroup:audio,language:eng a:1,agroup:audio,language:fra,default:yes"})
+	enc := defaultCommandBuilder.chooseEncoder(SoftwareEncoder)
+	info := &ffprobe.InputInfo{AudioCodecName: "flac"}
+	// variants list the codec of the default audio, which is copied
+	assert.Equal(t, "avc1.640028,ec-3", renditions[0].codecsString(enc, info))
+	assert.Equal(t, "mp4a.40.2", renditions[2].codecsString(enc, info))
+	assert.Equal(t, "ec-3", renditions[3].codecsString(enc, info))
+
+	cfg.Naming = NamingTemplate{Playlist: "{res}p/index.m3u8", Segment: "{res}p/seg_{n:05}.ts"}
+	names, err := cfg.Naming.renditionNames(renditions)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1080", "720", "audio_1", "audio_2"}, names)
+
+	// dash keeps the first audio stream
+	cfg.Formats = []OutputFormat{HLSFormat, DASHFormat}
+	_, renditions = defaultCommandBuilder.buildCommand(cfg)
+	assert.Equal(t, 2, len(renditions))
+}
+
+func Test_CopyableAudio(t *testing.T) {
+	assert.True(t, copyableAudio(ffprobe.AudioStream{CodecName: "aac", BitRate: 128000, Channels: 2}, 256000))
+	assert.True(t, copyableAudio(ffprobe.AudioStream{CodecName: "mp3", BitRate: 128000, Channels: 1}, 256000))
+	assert.False(t, copyableAudio(ffprobe.AudioStream{CodecName: "aac", BitRate: 384000, Channels: 2}, 256000))
+	assert.False(t, copyableAudio(ffprobe.AudioStream{CodecName: "ac3", BitRate: 192000, Channels: 6}, 256000))
+	// bitrate of flac, truehd or pcm is N/A
+	assert.False(t, copyableAudio(ffprobe.AudioStream{CodecName: "flac", Channels: 2}, 256000))
+	assert.False(t, copyableAudio(ffprobe.AudioStream{CodecName: "opus", BitRate: 96000, Channels: 2}, 256000))
+}
+
+func Test_SetMediaAttributes(t *testing.T) {
+	master := &m3u8.MasterPlaylist{Media: []*m3u8.Media{
+		{Type: m3u8.MediaAudio, GroupID: "group_audio", Name: "audio_2", URI: "stream_2.m3u8"},
+		{Type: m3u8.MediaAudio, GroupID: "group_audio", Name: "audio_3", Default: true, URI: "stream_3.m3u8"},
+	}}
+	setMediaAttributes(master, map[string]mediaAttributes{
+		"stream_2.m3u8": alternateAudioAttributes(rendition{Audio: &ffprobe.AudioStream{Language: "eng", Title: "English", Default: true}}, 2),
+		"stream_3.m3u8": alternateAudioAttributes(rendition{Audio: &ffprobe.AudioStream{Channels: 1}, CopyAudio: true}, 3),
+	})
+	assert.Equal(t, "#EXTM3U\n"+
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"group_audio\",NAME=\"English\",LANGUAGE=\"eng\",DEFAULT=YES,AUTOSELECT=YES,CHANNELS=\"2\",URI=\"stream_2.m3u8\"\n"+
+		"#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"group_audio\",NAME=\"audio_3\",AUTOSELECT=YES,CHANNELS=\"1\",URI=\"stream_3.m3u8\"\n\n",
+		master.Encode())
+}
+
+func Test_BuildSubtitleCommand(t *testing.T) {
+	dir := t.TempDir()
+	srt := filepath.Join(dir, "vi.srt")
+	assert.Nil(t, os.WriteFile(srt, []byte("1\n00:00:01,000 --> 00:00:02,000\nXin chào\n"), 0666))
+	subtitles, err := buildSubtitles([]ffprobe.SubtitleStream{
+		{Index: 3, CodecName: "subrip", Language: "eng", Default: true},
+		{Index: 4, CodecName: "hdmv_pgs_subtitle", Language: "fra"},
+	}, []request.SubtitleReq{{FilePath: srt, Language: "vi", Title: "Tiếng Việt"}})
+	assert.Nil(t, err)
+	assert.Equal(t, []subtitle{
+		{Stream: 3, Language: "eng", Default: true},
+		{Stream: -1, FilePath: srt, Language: "vi", Title: "Tiếng Việt"},
+	}, subtitles)
+
+	_, err = buildSubtitles(nil, []request.SubtitleReq{{FilePath: filepath.Join(dir, "vi.txt")}})
+	assert.NotNil(t, err)
+	_, err = buildSubtitles(nil, []request.SubtitleReq{{FilePath: filepath.Join(dir, "en.srt")}})
+	assert.NotNil(t, err)
+
+	args := defaultCommandBuilder.buildSubtitleCommand("/home/thienthn/Downloads/movie.mkv", "/home/thienthn/Downloads/output/test", subtitles, "6")
+	assert.Equal(t, []string{"-y", "-i", "/home/thienthn/Downloads/movie.mkv", "-i", srt,
+		"-map", "0:3", "-c:s", "webvtt", "-f", "segment", "-segment_time", "6", "-segment_format", "webvtt",
+		"-segment_list_type", "m3u8", "-segment_list", "/home/thienthn/Downloads/output/test/subs_0.m3u8",
+		"-segment_list_entry_prefix", "subs_0/", "/home/thienthn/Downloads/output/test/subs_0/data%02d.vtt",
+		"-map", "1:s:0", "-c:s", "webvtt", "-f", "segment", "-segment_time", "6", "-segment_format", "webvtt",
+		"-segment_list_type", "m3u8", "-segment_list", "/home/thienthn/Downloads/output/test/subs_1.m3u8",
+		"-segment_list_entry_prefix", "subs_1/", "/home/thienthn/Downloads/output/test/subs_1/data%02d.vtt"}, args)
+
+	args = defaultCommandBuilder.buildSubtitleCommand("/home/thienthn/Downloads/movie.mkv", "/home/thienthn/Downloads/output/test", subtitles[1:], "4.004")
+	assert.Equal(t, []string{"-y", "-i", srt, "-map", "0:s:0"}, args[:5])
+	assert.Subset(t, args, []string{"-segment_time", "4.004"})
+}
+
+func Test_AddTimestampMap(t *testing.T) {
+	vtt := filepath.Join(t.TempDir(), "data00.vtt")
+	assert.Nil(t, os.WriteFile(vtt, []byte("WEBVTT\n\n00:00:01.000 --> 00:00:02.000\nXin chào\n\n"), 0666))
+	assert.Nil(t, addTimestampMap(vtt, mpegtsDelay))
+	assert.Nil(t, addTimestampMap(vtt, mpegtsDelay))
+	b, err := os.ReadFile(vtt)
+	assert.Nil(t, err)
+	assert.Equal(t, "WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:126000,LOCAL:00:00:00.000\n\n00:00:01.000 --> 00:00:02.000\nXin chào\n\n", string(b))
+}
+
+func Test_SetSubtitleMedia(t *testing.T) {
+	master := &m3u8.MasterPlaylist{Variants: []*m3u8.Variant{{URI: "stream_0.m3u8", Bandwidth: 1000000}}}
+	media := []*m3u8.Media{
+		subtitleMedia(subtitle{Language: "eng", Default: true}, 0),
+		subtitleMedia(subtitle{Language: "vi", Title: "Tiếng Việt", Forced: true}, 1),
+	}
+	setSubtitleMedia(master, media)
+	setSubtitleMedia(master, media) // rewriting master keeps a group
+	assert.Equal(t, "#EXTM3U\n"+
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"eng\",LANGUAGE=\"eng\",DEFAULT=YES,AUTOSELECT=YES,URI=\"subs_0.m3u8\"\n"+
+		"#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID=\"subs\",NAME=\"Tiếng Việt\",LANGUAGE=\"vi\",AUTOSELECT=YES,FORCED=YES,URI=\"subs_1.m3u8\"\n\n"+
+		"#EXT-X-STREAM-INF:BANDWIDTH=1000000,SUBTITLES=\"subs\"\nstream_0.m3u8\n\n",
+		master.Encode())
+
+	setSubtitleMedia(master, nil)
+	assert.Equal(t, "", master.Variants[0].Subtitles)
+	assert.Equal(t, 0, len(master.Media))
+}
+
+func Test_BuildOverlayCommand(t *testing.T) {
+	dir := t.TempDir()
+	logo := filepath.Join(dir, "logo.png")
+	assert.Nil(t, os.WriteFile(logo, []byte("png"), 0666))
+	overlays, err := NewOverlays([]request.OverlayReq{
+		{Type: "image", FilePath: logo, Opacity: 0.5},
+		{Type: "text", Text: "{user_id} 100% {timestamp}", Position: "top_left"},
+		{Type: "subtitle", SubtitleIndex: 1},
+	}, "user:42")
+	assert.Nil(t, err)
+	assert.Equal(t, Overlay{Type: TextOverlay, Text: "user:42 100% {timestamp}", Position: TopLeft, Scale: 0.04, Opacity: 1}, overlays[1])
+
+	_, err = NewOverlays([]request.OverlayReq{{Type: "image", FilePath: filepath.Join(dir, "none.png")}}, "")
+	assert.NotNil(t, err)
+	_, err = NewOverlays([]request.OverlayReq{{Type: "text", Text: "a", Position: "middle"}}, "")
+	assert.NotNil(t, err)
+
+	cfg := CommandConfig{
+		FilePath:           "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath:   "/home/thienthn/Downloads/output/test",
+		TargetResolutions:  []resolution.Resolution{resolution.R1080, resolution.R720},
+		SourceWidth:        1920,
+		SourceHeight:       1080,
+		SourceResolution:   1080,
+		SourceDuration:     527,
+		SourceBitRate:      491882,
+		SourceAudioBitRate: 170658,
+		SourceFrameRate:    30,
+		SourceVideoCodec:   "h264",
+		SourceGOP:          &ffprobe.GOPInfo{KeyframeCount: 100, MeanInterval: 2, MinInterval: 2, MaxInterval: 2, Fixed: true},
+		Overlays:           overlays,
+	}
+	args, renditions := defaultCommandBuilder.buildCommand(cfg)
+	assert.False(t, renditions[0].Copy)
+	assert.Subset(t, args, []string{"-filter:v:1", "movie='" + logo + "',scale=192:-1,format=rgba,colorchannelmixer=aa=0.50[wm0];" +
+		"scale_npp=-2:720,hwdownload,format=nv12[bg0];[bg0][wm0]overlay=x=W-w-22:y=H-h-22," +
+		`drawtext=text='user\:42 100\\% %{pts\:hms}':fontsize=29:fontcolor=white@1.00:borderw=2:bordercolor=black@1.00:x=22:y=22,` +
+		"subtitles='/home/thienthn/Downloads/hotkids.mp4':si=1"})
+
+	cfg.Encoder = SoftwareEncoder
+	args, _ = defaultCommandBuilder.buildCommand(cfg)
+	assert.Subset(t, args, []string{"-filter:v:0", "movie='" + logo + "',scale=288:-1,format=rgba,colorchannelmixer=aa=0.50[wm0];" +
+		"scale=-2:1080[bg0];[bg0][wm0]overlay=x=W-w-32:y=H-h-32," +
+		`drawtext=text='user\:42 100\\% %{pts\:hms}':fontsize=43:fontcolor=white@1.00:borderw=2:bordercolor=black@1.00:x=32:y=32,` +
+		"subtitles='/home/thienthn/Downloads/hotkids.mp4':si=1"})
+}
+
+func Test_BuildImagesCommand(t *testing.T) {
+	options, err := NewImageOptions(request.ImagesReq{Poster: true, Thumbnails: 4, Sprite: true, SpriteInterval: 10})
+	assert.Nil(t, err)
+	cfg := CommandConfig{
+		FilePath:         "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath: "/home/thienthn/Downloads/output/test",
+		SourceWidth:      1920,
+		SourceHeight:     1080,
+		SourceDuration:   1050,
+	}
+	plan := defaultCommandBuilder.planImages(cfg, options)
+	assert.Equal(t, &transcoder.Image{Path: "poster.jpg", Width: 1280, Height: 720, Time: 105}, plan.poster)
+	assert.Equal(t, transcoder.Image{Path: "thumbnails/thumb_003.jpg", Width: 320, Height: 180, Time: 787.5}, plan.thumbnails[3])
+	assert.Equal(t, 105, plan.spriteTiles)
+	assert.Equal(t, []transcoder.Image{
+		{Path: "sprite/sprite_00.jpg", Width: 1600, Height: 900},
+		{Path: "sprite/sprite_01.jpg", Width: 1600, Height: 900, Time: 1000},
+	}, plan.sprite.Sheets)
+
+	args := defaultCommandBuilder.buildImagesCommand(cfg, plan)
+	assert.Equal(t, []string{"-y", "-i", "/home/thienthn/Downloads/hotkids.mp4",
+		"-map", "0:v:0", "-vf", "fps=1/262.5,scale=320:180", "-frames:v", "4", "-q:v", "3", "-start_number", "0",
+		"/home/thienthn/Downloads/output/test/thumbnails/thumb_%03d.jpg",
+		"-map", "0:v:0", "-vf", "fps=1/10,scale=160:90,tile=10x10", "-q:v", "3", "-start_number", "0",
+		"/home/thienthn/Downloads/output/test/sprite/sprite_%02d.jpg",
+		"-map", "0:v:0", "-ss", "105", "-vf", "scale=1280:720", "-frames:v", "1", "-q:v", "2",
+		"/home/thienthn/Downloads/output/test/poster.jpg"}, args)
+
+	index := spriteIndex(plan.sprite, plan.spriteTiles, 2, 1050)
+	assert.True(t, strings.HasPrefix(index, "WEBVTT\n\n00:00:00.000 --> 00:00:10.000\nsprite_00.jpg#xywh=0,0,160,90\n"))
+	assert.Contains(t, index, "\n00:16:40.000 --> 00:16:50.000\nsprite_01.jpg#xywh=0,0,160,90\n")
+	assert.True(t, strings.HasSuffix(index, "\n00:17:20.000 --> 00:17:30.000\nsprite_01.jpg#xywh=640,0,160,90\n"))
+	assert.NotContains(t, spriteIndex(plan.sprite, plan.spriteTiles, 1, 1050), "sprite_01.jpg")
+
+	cfg.SourceWidth, cfg.SourceHeight, cfg.SourceDuration = 1080, 1920, 0
+	plan = defaultCommandBuilder.planImages(cfg, options)
+	assert.Equal(t, &transcoder.Image{Path: "poster.jpg", Width: 720, Height: 1280}, plan.poster)
+	assert.Nil(t, plan.thumbnails)
+	assert.Nil(t, plan.sprite)
+}
+
+func Test_BuildPreviewCommand(t *testing.T) {
+	_, err := NewPreviewOptions(request.PreviewReq{Format: "avi"})
+	assert.NotNil(t, err)
+	options, err := NewPreviewOptions(request.PreviewReq{Format: "webp"})
+	assert.Nil(t, err)
+	assert.Equal(t, PreviewOptions{Format: WebPPreview, Duration: 6, Snippets: 3, Width: 320}, options)
+
+	cfg := CommandConfig{
+		FilePath:         "/home/thienthn/Downloads/hotkids.mp4",
+		StoredFolderPath: "/home/thienthn/Downloads/output/test",
+		SourceWidth:      1920,
+		SourceHeight:     1080,
+		SourceDuration:   1050,
+	}
+	p := defaultCommandBuilder.planPreview(cfg, options)
+	assert.Equal(t, &transcoder.Preview{
+		Path: "preview.webp", Format: "webp", Width: 320, Height: 180, Duration: 6,
+		Snippets: []transcoder.Snippet{{Start: 174, Duration: 2}, {Start: 524, Duration: 2}, {Start: 874, Duration: 2}},
+	}, p)
+	assert.Equal(t, []string{"-y",
+		"-ss", "174", "-t", "2", "-i", "/home/thienthn/Downloads/hotkids.mp4",
+		"-ss", "524", "-t", "2", "-i", "/home/thienthn/Downloads/hotkids.mp4",
+		"-ss", "874", "-t", "2", "-i", "/home/thienthn/Downloads/hotkids.mp4",
+		"-filter_complex", "[0:v:0]setpts=PTS-STARTPTS[s0];[1:v:0]setpts=PTS-STARTPTS[s1];[2:v:0]setpts=PTS-STARTPTS[s2];" +
+			"[s0][s1][s2]concat=n=3:v=1:a=0,fps=12,scale=320:180[preview]",
+		"-map", "[preview]", "-an", "-c:v", "libwebp", "-loop", "0", "-q:v", "60",
+		"/home/thienthn/Downloads/output/test/preview.webp"}, defaultCommandBuilder.buildPreviewCommand(cfg, p))
+
+	p.Format = string(GIFPreview)
+	p.Path = "preview.gif"
+	args := defaultCommandBuilder.buildPreviewCommand(cfg, p)
+	assert.True(t, strings.HasSuffix(args[20], "[s0][s1][s2]concat=n=3:v=1:a=0,fps=12,scale=320:180,split[a][b];[a]palettegen[palette];[b][palette]paletteuse[preview]"))
+	assert.Equal(t, "/home/thienthn/Downloads/output/test/preview.gif", args[len(args)-1])
+
+	cfg.SourceDuration = 4
+	p = defaultCommandBuilder.planPreview(cfg, options)
+	assert.Equal(t, []transcoder.Snippet{{Start: 0, Duration: 4}}, p.Snippets)
+	assert.Equal(t, float64(4), p.Duration)
+}
+
+func Test_BuildIFramePlaylist(t *testing.T) {
+	frames := segmentIFrames([]ffprobe.Packet{
+		{MediaType: ffprobe.VideoPacket, KeyFrame: 1, PtsTime: 1.4, Pos: 564, Size: 40000},
+		{MediaType: ffprobe.VideoPacket, PtsTime: 1.44, Pos: 44932, Size: 3000},
+		{MediaType: ffprobe.VideoPacket, KeyFrame: 1, PtsTime: 4.4, Pos: 300000, Size: 38000},
+		{MediaType: ffprobe.VideoPacket, KeyFrame: 1, PtsTime: 5, Pos: -1},
+	}, 400000)
+	assert.Equal(t, []iframe{{time: 1.4, offset: 564, length: 44368}, {time: 4.4, offset: 300000, length: 100000}}, frames)
+
+	media := &m3u8.MediaPlaylist{MediaSequence: 0, Segments: []*m3u8.Segment{
+		{URI: "stream_0/data00.ts", Duration: 6},
+		{URI: "stream_0/data01.ts", Duration: 2.5},
+	}}
+	p := buildIFramePlaylist(media, [][]iframe{frames, {{time: 7.4, offset: 376, length: 41000}}})
+	assert.Equal(t, `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:3
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-I-FRAMES-ONLY
+#EXTINF:3.000000,
+#EXT-X-BYTERANGE:44368@564
+stream_0/data00.ts
+#EXTINF:3.000000,
+#EXT-X-BYTERANGE:100000@300000
+stream_0/data00.ts
+#EXTINF:2.500000,
+#EXT-X-BYTERANGE:41000@376
+stream_0/data01.ts
+#EXT-X-ENDLIST
+`, p.Encode())
+	assert.Equal(t, "1080p/index_iframes.m3u8", iframePlaylistName("1080p/index.m3u8"))
+}
+
+func Test_RetrySoftware(t *testing.T) {
+	failed := &commander.Error{Kind: commander.Failed, Err: errors.New("exit status 1")}
+	assert.False(t, retrySoftware(failed, 0))
+	assert.True(t, retrySoftware(fmt.Errorf("%w: %w", ffmpegrunner.ErrHWAccelInit, failed), 0))
+	assert.False(t, retrySoftware(fmt.Errorf("%w: %w", ffmpegrunner.ErrHWAccelInit, failed), 3))
+	assert.False(t, retrySoftware(fmt.Errorf("%w: %w", ffmpegrunner.ErrInvalidInput, failed), 0))
+	assert.False(t, retrySoftware(fmt.Errorf("%w: %w", ffmpegrunner.ErrNoSpaceLeft, failed), 0))
+	assert.False(t, retrySoftware(&commander.Error{Kind: commander.Canceled, Err: context.Canceled}, 0))
+	assert.False(t, retrySoftware(nil, 0))
+}
+
+func Test_Watchdog(t *testing.T) {
+	o := NewWatchdogOptions(config.ServerConfig{MinSpeed: 1})
+	assert.Equal(t, WatchdogOptions{StallTimeout: 120 * time.Second, MinSpeed: 1, SlowTimeout: 60 * time.Second}, o)
+	assert.Zero(t, NewWatchdogOptions(config.ServerConfig{StallTimeout: -1}).StallTimeout)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := newWatchdog(WatchdogOptions{StallTimeout: 30 * time.Second}, transcoder.StageTranscode, start)
+	w.progress(&ffmpegrunner.FrameProgress{FramesProcessed: 100, CurrentTime: 4 * time.Second, Speed: 2}, start.Add(20*time.Second))
+	assert.Nil(t, w.check(start.Add(40*time.Second)))
+	// the same frame doesn't advance
+	w.progress(&ffmpegrunner.FrameProgress{FramesProcessed: 100, CurrentTime: 4 * time.Second, Speed: 2}, start.Add(45*time.Second))
+	w.opened(start.Add(30 * time.Second))
+	err := w.check(start.Add(60 * time.Second))
+	assert.ErrorIs(t, err, ErrStalled)
+	assert.Nil(t, w.check(start.Add(61*time.Second)))
+	assert.Equal(t, []transcoder.WatchdogEvent{{Stage: transcoder.StageTranscode, Action: transcoder.WatchdogAbort,
+		Reason: "no progress is made for 30s", Frame: 100, Time: 4, Speed: 2}}, w.events)
+
+	w = newWatchdog(WatchdogOptions{MinSpeed: 1, SlowTimeout: 10 * time.Second}, transcoder.StageImages, start)
+	w.progress(&ffmpegrunner.FrameProgress{FramesProcessed: 10, Speed: 0.5}, start.Add(time.Second))
+	w.progress(&ffmpegrunner.FrameProgress{FramesProcessed: 30, Speed: 1.5}, start.Add(5*time.Second))
+	w.progress(&ffmpegrunner.FrameProgress{FramesProcessed: 40, Speed: 0.8}, start.Add(6*time.Second))
+	assert.Nil(t, w.check(start.Add(15*time.Second)))
+	assert.ErrorIs(t, w.check(start.Add(16*time.Second)), ErrTooSlow)
+	var actions []transcoder.WatchdogAction
+	for _, e := range w.events {
+		actions = append(actions, e.Action)
+	}
+	assert.Equal(t, []transcoder.WatchdogAction{transcoder.WatchdogSlow, transcoder.WatchdogRecovered,
+		transcoder.WatchdogSlow, transcoder.WatchdogAbort}, actions)
+	assert.Equal(t, "ffmpeg encoded slower than min speed 1.00x for 10s, speed is 0.80x", w.events[3].Reason)
+}
+
+func Test_PauseAndResume(t *testing.T) {
+	decode := func(s string) *m3u8.MediaPlaylist {
+		p, err := m3u8.DecodeMedia(strings.NewReader(s))
+		assert.Nil(t, err)
+		return p
+	}
+	// ffmpeg is stopped while writing data03.ts of 1080 and data02.ts of 720
+	count, secs := completedSegments([]*m3u8.MediaPlaylist{
+		decode("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000000,\ndata00.ts\n#EXTINF:6.000000,\ndata01.ts\n" +
+			"#EXTINF:6.000000,\ndata02.ts\n#EXTINF:2.400000,\ndata03.ts\n#EXT-X-ENDLIST\n"),
+		decode("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000000,\ndata00.ts\n#EXTINF:6.000000,\ndata01.ts\n" +
+			"#EXTINF:3.100000,\ndata02.ts\n#EXT-X-ENDLIST\n"),
+	})
+	assert.Equal(t, 2, count)
+	assert.InDelta(t, 12, secs, 1e-9)
+	// segments of a playlist which is not ended are completed
+	count, _ = completedSegments([]*m3u8.MediaPlaylist{
+		decode("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.000000,\ndata00.ts\n"),
+	})
+	assert.Equal(t, 1, count)
+
+	// a killed ffmpeg writes no playlist, the completed segments are unknown
+	killed := &transcoderImpl{err: &commander.Error{Kind: commander.Canceled, Killed: true}}
+	_, err := killed.pause()
+	assert.NotNil(t, err)
+
+	p := appendSegments(
+		decode("#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:6.000000,\nstream_0/data00.mp4\n"+
+			"#EXTINF:6.000000,\nstream_0/data01.mp4\n"),
+		decode("#EXTM3U\n#EXT-X-TARGETDURATION:7\n#EXT-X-MEDIA-SEQUENCE:2\n#EXT-X-MAP:URI=\"init.mp4\"\n"+
+			"#EXTINF:6.500000,\nstream_0/data02.mp4\n#EXTINF:1.500000,\nstream_0/data03.mp4\n#EXT-X-ENDLIST\n"))
+	assert.Equal(t, int64(0), p.MediaSequence)
+	assert.Equal(t, 7, p.TargetDuration)
+	assert.True(t, p.Ended)
+	var uris []string
+	for _, s := range p.Segments {
+		uris = append(uris, s.URI)
+	}
+	assert.Equal(t, []string{"stream_0/data00.mp4", "stream_0/data01.mp4", "stream_0/data02.mp4", "stream_0/data03.mp4"}, uris)
+	assert.Equal(t, "init.mp4", p.Segments[0].Map.URI)
+	assert.Nil(t, p.Segments[2].Map)
+
+	assert.Equal(t, int64(2), nextSegment(&transcoder.PausePoint{Time: 12, LastSegments: []int64{1, 1}}))
+	args, _ := defaultCommandBuilder.buildCommand(CommandConfig{
+		FilePath:          "input.mp4",
+		StoredFolderPath:  "output",
+		TargetResolutions: []resolution.Resolution{resolution.R360},
+		SourceWidth:       640,
+		SourceHeight:      360,
+		SourceResolution:  360,
+		SourceDuration:    60,
+		SourceBitRate:     1000000,
+		SourceFrameRate:   25,
+		Encoder:           SoftwareEncoder,
+		StartTime:         12,
+		StartNumber:       2,
+	})
+	idx := slices.Index(args, "-i")
+	assert.Equal(t, []string{"-ss", "12", "-i", "input.mp4"}, args[idx-2:idx+2])
+	idx = slices.Index(args, "-output_ts_offset")
+	assert.Equal(t, []string{"-output_ts_offset", "12", "-start_number", "2", "-master_pl_name"}, args[idx:idx+5])
+
+	// overlays are drawn with timestamps of source
+	args, _ = defaultCommandBuilder.buildCommand(CommandConfig{
+		FilePath:          "input.mp4",
+		StoredFolderPath:  "output",
+		TargetResolutions: []resolution.Resolution{resolution.R360},
+		SourceWidth:       640,
+		SourceHeight:      360,
+		SourceResolution:  360,
+		SourceDuration:    60,
+		SourceBitRate:     1000000,
+		SourceFrameRate:   25,
+		Encoder:           SoftwareEncoder,
+		StartTime:         12.5,
+		StartNumber:       2,
+		Overlays:          []Overlay{{Type: TextOverlay, Text: "%{pts:hms}", Position: TopLeft, Scale: 0.05, Opacity: 1}},
+	})
+	idx = slices.Index(args, "-filter:v:0")
+	assert.True(t, strings.HasPrefix(args[idx+1], "scale=-2:360,setpts=PTS+12.5/TB,drawtext="))
+	assert.True(t, strings.HasSuffix(args[idx+1], ",setpts=PTS-12.5/TB"))
+}
+
+func Test_LiveInput(t *testing.T) {
+	assert.True(t, liveInput("rtmp://127.0.0.1:1935/live/7868802855338312"))
+	assert.True(t, liveInput("SRT://10.0.0.1:9000"))
+	assert.False(t, liveInput("/home/thienthn/Downloads/test.mp4"))
+	assert.False(t, liveInput("https://cdn.example.com/input.mp4"))
+}
+
+func Test_WatchdogProbe(t *testing.T) {
+	tr := &transcoderImpl{ll: l.New(), ctx: context.Background(), watchdog: WatchdogOptions{StallTimeout: 50 * time.Millisecond}}
+	err := tr.probe(transcoder.StageImages, "poster scoring", func(ctx context.Context, advance func()) error {
+		<-ctx.Done()
+		return commander.ContextError(ctx, "ffprobe", nil)
+	})
+	assert.ErrorIs(t, err, ErrStalled)
+	// an abort is a failure of the stage, it is not a stop of the job
+	assert.False(t, stopped(err))
+	assert.True(t, stopped(&commander.Error{Kind: commander.Canceled, Err: commander.ErrStopped}))
+	assert.Len(t, tr.watchdogEvents, 1)
+	assert.Equal(t, transcoder.WatchdogAbort, tr.watchdogEvents[0].Action)
+	assert.Equal(t, "no progress is made for 50ms, poster scoring has no output", tr.watchdogEvents[0].Reason)
+
+	// a step which keeps outputting is not capped by stall timeout
+	assert.Nil(t, tr.probe(transcoder.StageTranscode, "gop analysis", func(ctx context.Context, advance func()) error {
+		for i := 0; i < 6; i++ {
+			select {
+			case <-ctx.Done():
+				return commander.ContextError(ctx, "ffprobe", nil)
+			case <-time.After(20 * time.Millisecond):
+				advance()
+			}
+		}
+		return nil
+	}))
+	assert.Len(t, tr.watchdogEvents, 1)
+}
@@ -1,6 +1,7 @@
 package v5
 
 import (
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -14,7 +15,7 @@ import (
 )
 
 var (
-	m3u8Regex     = regexp.MustCompile(`.?(stream_\d\.m3u8).?`)
+	initRegex     = regexp.MustCompile(`(?:init_stream_\d+\.m4s|init[^/]*\.mp4)$`)
 	dataNameRegex = regexp.MustCompile(`data(\d.+?)\.`)
 )
 
@@ -25,8 +26,11 @@ type transcodeThread struct {
 	pool       rpooling.IPool
 	wg         *sync.WaitGroup
 	clearData  bool
-	outputPath string
+	outputPath string // stored folder, names of files are relative to it
 	baseKey    string
+	files      *renditionFiles // hls files of the rendition, nil for other streams
+	fixing     sync.Mutex      // fixed copies of playlist are written one by one
+	vttOffset  int64           // mpegts timestamp which cue time 0 of webvtt segments is mapped to
 	messages   chan ffmpegrunner.OpeningFileProgress
 	lastTSFile transcoder.UploadFile
 	outputChan chan transcoder.UploadFile
@@ -61,42 +65,84 @@ func (t *transcodeThread) stop() {
 func (t *transcodeThread) processMessage() {
 	wg := sync.WaitGroup{}
 	for m := range t.messages {
-		isM3U8 := m3u8Regex.MatchString(m.FilePath)
-		if isM3U8 {
+		// playlist may be written to a temp file then renamed
+		filePath := strings.TrimSuffix(m.FilePath, ".tmp")
+		if isPlaylist(filePath) {
 			t.pool.Submit(func() {
-				elements := strings.Split(m.FilePath, "/")
 				t.uploadFile(transcoder.UploadFile{
-					Name: elements[len(elements)-1],
-					Path: m.FilePath,
+					Name: t.fileName(filePath),
+					Path: t.playlistPath(filePath),
 				}, &wg)
 			})
 			continue
 		}
 
-		if t.lastTSFile.Name != "" {
+		if t.lastTSFile.Name != "" && initRegex.MatchString(t.lastTSFile.Name) {
+			// init segment must be emitted before any media segment of this stream
+			// so it is sent directly instead of uploading in pool
+			t.lastTSFile.UploadKey = t.baseKey + "/" + t.lastTSFile.Name
+			t.outputChan <- t.lastTSFile
+		} else if t.lastTSFile.Name != "" {
 			// this is not the first time, upload last ts file and update m3u8 file
-			t.uploadFile(t.lastTSFile, &wg)
+			t.uploadSegment(t.lastTSFile, &wg)
 		}
 
 		//region update lastTsFile
-		t.lastTSFile.Path = m.FilePath
-		if strings.HasSuffix(t.lastTSFile.Path, ".tmp") {
-			t.lastTSFile.Path = t.lastTSFile.Path[:len(t.lastTSFile.Path)-4]
-		}
-		elements := strings.Split(t.lastTSFile.Path, "/")
-		t.lastTSFile.Name = elements[len(elements)-1]
+		t.lastTSFile.Path = filePath
+		t.lastTSFile.Name = t.fileName(filePath)
 		//endregion
 	}
 
 	// after call stop thread and done process all messages
 	// handle the last segment file
 	if t.lastTSFile.Name != "" {
-		t.uploadFile(t.lastTSFile, &wg)
+		t.uploadSegment(t.lastTSFile, &wg)
 	}
 	wg.Wait()
 	t.wg.Done()
 }
 
+// isPlaylist hls playlists and dash manifest are rewritten while segments are added, they are uploaded whenever they are opened
+// other files are init segments (init_stream_0.m4s, index_init.mp4) or media segments (.ts, .m4s, .vtt)
+func isPlaylist(filePath string) bool {
+	return strings.HasSuffix(filePath, ".m3u8") || strings.HasSuffix(filePath, ".mpd")
+}
+
+// playlistPath path of the playlist file to upload
+// ffmpeg writes wrong uris of segments which are not in the folder of playlist, so a copy with fixed uris is uploaded
+func (t *transcodeThread) playlistPath(filePath string) string {
+	if t.files == nil || t.fileName(filePath) != t.files.playlist {
+		return filePath
+	}
+	t.fixing.Lock()
+	defer t.fixing.Unlock()
+	fixed, err := t.files.fixedCopy(t.outputPath)
+	if err != nil {
+		t.ll.Error("cannot fix playlist", l.String("playlist", t.files.playlist), l.Error(err))
+		return filePath
+	}
+	return fixed
+}
+
+// fileName name of file relative to output path, so the folders of naming template are kept in upload key
+func (t *transcodeThread) fileName(filePath string) string {
+	name, err := filepath.Rel(t.outputPath, filePath)
+	if err != nil || strings.HasPrefix(name, "..") {
+		return filepath.Base(filePath)
+	}
+	return filepath.ToSlash(name)
+}
+
+// uploadSegment upload a completed segment, webvtt segments get the timestamp map of media segments before
+func (t *transcodeThread) uploadSegment(file transcoder.UploadFile, wg *sync.WaitGroup) {
+	if strings.HasSuffix(file.Name, ".vtt") {
+		if err := addTimestampMap(file.Path, t.vttOffset); err != nil {
+			t.ll.Error("cannot add timestamp map to webvtt segment", l.String("file_path", file.Path), l.Error(err))
+		}
+	}
+	t.uploadFile(file, wg)
+}
+
 // uploadFile this function is used to upload file
 func (t *transcodeThread) uploadFile(file transcoder.UploadFile, wg *sync.WaitGroup) {
 	wg.Add(1)
@@ -8,12 +8,16 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"transcode/pkg/commander"
 	"transcode/pkg/config"
 	"transcode/pkg/datetime"
 	ffmpegrunner "transcode/pkg/ffmpeg_runner"
 	"transcode/pkg/ffprobe"
+	"transcode/pkg/m3u8"
 	"transcode/pkg/request"
 	"transcode/pkg/resolution"
 	"transcode/pkg/transcoder"
@@ -22,10 +26,18 @@ import (
 	"github.com/thnthien/great-deku/l"
 )
 
+// gopReadInterval secs of input which are read to know its gop structure
+const gopReadInterval = 60
+
+// liveSchemes protocols of live inputs
+var liveSchemes = []string{"rtmp://", "rtmps://", "rtsp://", "srt://", "udp://", "rtp://", "tcp://"}
+
 var (
-	streamRegex = regexp.MustCompile(`.?(stream_\d).?`)
-	masterRegex = regexp.MustCompile(`.?(master\.m3u8).?`)
-	dataRegex   = regexp.MustCompile(`.?(data(\d+?)\.ts).?`)
+	masterRegex   = regexp.MustCompile(`.?(master\.m3u8).?`)
+	dataRegex     = regexp.MustCompile(`.?(data(\d+?)\.ts).?`)
+	manifestRegex = regexp.MustCompile(`.?(manifest\.mpd).?`)
+	dashRegex     = regexp.MustCompile(`.?(?:init|chunk)_(stream_\d+).?`) // init and media segments of dash representations
+	mediaRegex    = regexp.MustCompile(`.?media_(\d+)\.m3u8.?`)           // hls playlists of cmaf representations
 )
 
 type transcoderImpl struct {
@@ -33,14 +45,31 @@ type transcoderImpl struct {
 	ffprobe        *ffprobe.Ffprobe `container:"name"`
 	commandBuilder *CommandBuilder  `container:"name"`
 
-	wg           *sync.WaitGroup
-	cfg          config.ServerConfig
-	runner       *ffmpegrunner.FfmpegRunner
-	req          request.TranscodeReq
-	threads      map[string]*transcodeThread
-	uploadMaster chan struct{}
-	resolutions  []resolution.Resolution
-	outputChan   chan transcoder.UploadFile
+	wg              *sync.WaitGroup
+	cfg             config.ServerConfig
+	runner          *ffmpegrunner.FfmpegRunner
+	req             request.TranscodeReq
+	threads         map[string]*transcodeThread
+	uploadMaster    chan struct{}
+	renditions      []rendition
+	outputChan      chan transcoder.UploadFile
+	progressChan    chan transcoder.Progress
+	stage           transcoder.Stage // stage which ffmpeg is running, empty between stages
+	stageMu         sync.Mutex       // guards stage, which Stop reads from another goroutine
+	ctx             context.Context  // ffmpeg quits gracefully when it is done
+	formats         []OutputFormat
+	naming          NamingTemplate
+	files           []renditionFiles // names of hls files of renditions
+	codecs          []Codec
+	subtitles       []subtitle         // subtitles which are converted to webvtt renditions of hls
+	iframePlaylists []string           // i-frame playlist of each rendition, empty if it has none
+	encoder         EncoderName        // encoder which is running
+	info            *ffprobe.InputInfo // information of input
+	openedFiles     int                // number of files that ffmpeg opened for writing
+	watchdog        WatchdogOptions
+	watchdogEvents  []transcoder.WatchdogEvent // actions of watchdog on all stages
+	kept            []*m3u8.MediaPlaylist      // playlists of completed segments of paused job, nil if it is not resumed
+	pausing         atomic.Bool                // Stop is called to pause the job
 
 	err error
 }
@@ -54,6 +83,9 @@ func New(cfg config.ServerConfig, req request.TranscodeReq) *transcoderImpl {
 		threads:      make(map[string]*transcodeThread),
 		uploadMaster: make(chan struct{}),
 		outputChan:   make(chan transcoder.UploadFile, 10),
+		progressChan: make(chan transcoder.Progress, 10),
+		ctx:          context.Background(),
+		watchdog:     NewWatchdogOptions(cfg),
 	}
 	os.MkdirAll(req.StoredFolderPath, 0755) //create folder for storing files
 	container.Fill(t)
@@ -64,81 +96,642 @@ func New(cfg config.ServerConfig, req request.TranscodeReq) *transcoderImpl {
 // Transcode start to transcode stream
 // the flow is:
 // - get the information of input stream for knows the input bit rate of streamer
+// - choose the encoder that ffmpeg supports
 // - using the information above to build command with setting match specified with the request and the input information
-// - start to transcode
+// - start to transcode, retry with software encoder if the hardware encoder cannot start
+// ffmpeg is stopped gracefully when ctx is done, the error tells cancellation and timeout apart from failure
+// a paused job returns ErrPaused with its pause point, it is resumed by a request with Resume in the same stored folder
 func (t *transcoderImpl) Transcode(ctx context.Context) (transcoder.OutputData, error) {
 	defer close(t.outputChan)
+	defer close(t.progressChan)
+	t.ctx = ctx
 	data := transcoder.OutputData{}
+	if _, ok := GetEncoder(EncoderName(t.req.Encoder)); t.req.Encoder != "" && !ok {
+		return data, fmt.Errorf("unknown encoder %s", t.req.Encoder)
+	}
+	for _, f := range t.req.Formats {
+		if f != string(HLSFormat) && f != string(DASHFormat) && f != string(CMAFFormat) {
+			return data, fmt.Errorf("unknown output format %s", f)
+		}
+		t.formats = append(t.formats, OutputFormat(f))
+	}
+	if t.hasFormat(CMAFFormat) && len(t.formats) > 1 {
+		// cmaf already provides hls and dash
+		return data, errors.New("cmaf format cannot be combined with other formats")
+	}
+	if t.hasFormat(CMAFFormat) && t.req.KeyInfoFilePath != "" {
+		return data, errors.New("encryption is not supported with cmaf format")
+	}
+	t.naming = NamingTemplate{Playlist: t.cfg.PlaylistTemplate, Segment: t.cfg.SegmentTemplate}
+	if t.req.PlaylistTemplate != "" {
+		t.naming.Playlist = t.req.PlaylistTemplate
+	}
+	if t.req.SegmentTemplate != "" {
+		t.naming.Segment = t.req.SegmentTemplate
+	}
+	if err := t.naming.Validate(); err != nil {
+		return data, err
+	}
+	if t.naming.custom() && (t.hasFormat(DASHFormat) || t.hasFormat(CMAFFormat)) {
+		// dash muxer names files by representation ids
+		return data, errors.New("naming template is only supported with hls format")
+	}
+	overlays, err := NewOverlays(t.req.Overlays, t.req.UserID)
+	if err != nil {
+		return data, err
+	}
+	images, err := NewImageOptions(t.req.Images)
+	if err != nil {
+		return data, err
+	}
+	preview, err := NewPreviewOptions(t.req.Preview)
+	if err != nil {
+		return data, err
+	}
+	var paused *transcoder.PausePoint
+	if t.req.Resume {
+		if !t.canPause() {
+			return data, errors.New("only hls jobs without encryption can be resumed")
+		}
+		if paused, err = readPausePoint(t.req.StoredFolderPath); err != nil {
+			return data, err
+		}
+	}
+	for _, c := range t.req.Codecs {
+		codec, ok := GetCodec(c)
+		if !ok {
+			return data, fmt.Errorf("unknown codec %s", c)
+		}
+		t.codecs = append(t.codecs, codec)
+	}
 	//region get input stream information
-	info, err := t.ffprobe.InputInfo(t.req.FilePath, 2)
+	info, err := t.ffprobe.InputInfo(t.ctx, t.req.FilePath, 2)
 	if err != nil {
 		t.ll.Error("cannot get file info", l.Error(err))
 		return data, err
 	}
 	t.ll.Info("got input info", l.Object("info", info))
+	t.info = info
+	var gop *ffprobe.GOPInfo
+	if !info.HasVideo {
+		t.ll.Info("input has no video, gop is not analyzed", l.String("input", t.req.FilePath))
+	} else if liveInput(t.req.FilePath) {
+		// packets of a live input are read as they are streamed, so it is not analyzed and the source won't be copied
+		t.ll.Info("input is live, gop is not analyzed", l.String("input", t.req.FilePath))
+	} else if err = t.probe(transcoder.StageTranscode, "gop analysis", func(ctx context.Context, advance func()) (err error) {
+		gop, err = t.ffprobe.AnalyzeGOP(ctx, t.req.FilePath, gopReadInterval, advance)
+		return err
+	}); stopped(err) {
+		return data, err
+	} else if err != nil {
+		// without gop structure, the source won't be copied
+		t.ll.Error("cannot analyze gop of input", l.Error(err))
+	} else {
+		t.ll.Info("got gop info", l.Object("gop", gop))
+	}
 	//endregion
-	data.Width = int(info.Width)
-	data.Resolution = int(info.Height)
+	data.Width = int(info.DisplayWidth())
+	data.Height = int(info.DisplayHeight())
+	data.Resolution = int(info.ShortEdge())
+	data.Rotation = info.Rotation
 	data.FPS = info.FrameRate
 	data.Duration = info.Duration
 	data.VideoBitrate = int(info.BitRate)
 	data.AudioBitrate = int(info.AudioBitRate)
+	data.GOP = gop
+
+	if t.hasFormat(HLSFormat) {
+		if t.subtitles, err = buildSubtitles(info.SubtitleStreams, t.req.Subtitles); err != nil {
+			return data, err
+		}
+	} else if len(t.req.Subtitles) > 0 {
+		t.ll.Warn("subtitles are only published with hls format", l.Int("subtitles", len(t.req.Subtitles)))
+	}
+
+	encoder, err := t.chooseEncoder(&data.Encoder)
+	if err != nil {
+		return data, err
+	}
 
 	//get the command
-	args, resolutions := t.commandBuilder.buildCommand(CommandConfig{
+	cmdCfg := CommandConfig{
 		FolderName:         t.req.FolderName,
 		FilePath:           t.req.FilePath,
 		StoredFolderPath:   t.req.StoredFolderPath,
 		KeyInfoFilePath:    t.req.KeyInfoFilePath,
 		TargetResolutions:  t.req.Resolutions,
-		SourceResolution:   info.Height,
-		SourceWidth:        info.Width,
-		SourceHeight:       int64(info.Height),
+		SourceResolution:   info.ShortEdge(),
+		SourceWidth:        info.DisplayWidth(),
+		SourceHeight:       info.DisplayHeight(),
 		SourceDuration:     info.Duration,
 		SourceBitRate:      info.BitRate,
 		SourceAudioBitRate: info.AudioBitRate,
 		SourceFrameRate:    info.FrameRate,
-	})
-	if len(resolutions) == 0 {
+		SourceRotation:     info.Rotation,
+		SourceNoVideo:      !info.HasVideo,
+		SourceNoAudio:      !info.HasAudio,
+		SourceAudioStreams: info.AudioStreams,
+		Encoder:            encoder,
+		SourceVideoCodec:   info.CodecName,
+		SourceGOP:          gop,
+		Codecs:             t.codecs,
+		Naming:             t.naming,
+		Overlays:           overlays,
+		Formats:            t.formats,
+	}
+	if paused != nil {
+		cmdCfg.StartTime = paused.Time
+		cmdCfg.StartNumber = nextSegment(paused)
+	}
+	args, renditions := t.commandBuilder.buildCommand(cmdCfg)
+	if len(renditions) == 0 {
 		return transcoder.OutputData{}, errors.New("original resolution is too low")
 	}
-	numberOfThread := len(resolutions)
-	t.resolutions = resolutions
-	data.Resolutions = resolutions
+	if _, err = t.naming.renditionNames(renditions); err != nil {
+		return data, err
+	}
+	t.encoder = encoder
+	t.renditions = renditions
+	t.files = t.naming.files(renditions, needFMP4(renditions))
+	data.Resolutions = t.outputResolutions()
+	data.Renditions = t.outputRenditions()
+	if paused != nil {
+		if err = t.loadKept(paused); err != nil {
+			return data, err
+		}
+		t.ll.Info("resume transcode file", l.Object("pause_point", paused))
+	}
 
-	t.ll.Info("start transcode file", l.String("input", t.req.FilePath))
+	t.ll.Info("start transcode file", l.String("input", t.req.FilePath), l.String("encoder", string(encoder)))
 	t.ll.Info("ffmpeg command", l.String("command", fmt.Sprintf("%v", args)))
 
-	for i := 0; i < numberOfThread; i++ {
-		// base on the required resolutions that request want
-		// so each resolution will be handled by a thread for uploading ts files, updating realtime m3u8 files
-		m3u8Name := fmt.Sprintf("stream_%d.m3u8", i)
-		t.wg.Add(1)
-		th := newThread(t.cfg.OutputPath, t.req.FolderName, t.cfg.ClearAfterStream, t.outputChan, t.wg)
-		t.threads[fmt.Sprintf("stream_%d", i)] = th
-		th.run()
-		t.ll.Info("start thread", l.Int64("resolution", int64(resolutions[i])),
-			l.String("m3u8_name", m3u8Name), l.Int64("next_segment", 0))
-	}
-
 	startTime := datetime.Now()
-	t.runner.SetArgs(args)
-	done := t.runner.Run()
-	logs := t.runner.Logs()
-
-	t.handleProcess(done, logs) // handles logs of ffmpeg and controls uploading threads
+	t.run(args)
+	if encoder != SoftwareEncoder && retrySoftware(t.err, t.openedFiles) && t.checkSoftware() == nil {
+		// hardware encoder cannot start (no device, driver mismatch), so we retry the job with software encoder
+		t.ll.Warn("encoder failed at startup, retry with software encoder",
+			l.String("encoder", string(encoder)), l.Error(t.err))
+		data.Encoder.Fallback = true
+		data.Encoder.Used = string(SoftwareEncoder)
+		data.Encoder.Reason = fmt.Sprintf("%s failed at startup: %s", encoder, t.err)
+		cmdCfg.Encoder = SoftwareEncoder
+		t.encoder = SoftwareEncoder
+		args, _ = t.commandBuilder.buildCommand(cmdCfg)
+		data.Renditions = t.outputRenditions()
+		t.ll.Info("ffmpeg command", l.String("command", fmt.Sprintf("%v", args)))
+		t.err = nil
+		t.run(args)
+	} else if encoder != SoftwareEncoder && errors.Is(t.err, ffmpegrunner.ErrHWAccelInit) {
+		t.ll.Warn("encoder failed at startup, software encoder is not retried", l.String("encoder", string(encoder)))
+	}
+	if t.pausing.Load() && stopped(t.err) {
+		// the completed segments are kept, the next stages are run when the job is resumed
+		t.fixPlaylists()
+		if t.kept != nil {
+			t.appendKept()
+		}
+		data.Watchdog = t.watchdogEvents
+		if data.Paused, err = t.pause(); err != nil {
+			t.ll.Error("cannot pause transcode file", l.Error(err))
+			return data, err
+		}
+		return data, ErrPaused
+	}
+	if t.err == nil && len(t.subtitles) > 0 {
+		t.runSubtitles(t.commandBuilder.segmentTime(cmdCfg, t.renditions))
+	}
+	data.Subtitles = t.outputSubtitles()
+	if t.err == nil && images.enabled() && !cmdCfg.SourceNoVideo {
+		data.Images = t.runImages(cmdCfg, images)
+	}
+	if t.err == nil && preview.enabled() && !cmdCfg.SourceNoVideo {
+		data.Preview = t.runPreview(cmdCfg, preview)
+	}
+	if t.err == nil && t.hasFormat(HLSFormat) {
+		t.fixPlaylists()
+		if t.kept != nil {
+			t.appendKept()
+		}
+		if t.req.KeyInfoFilePath == "" {
+			t.writeIFramePlaylists()
+			for i, name := range t.iframePlaylists {
+				data.Renditions[i].IFramePlaylist = name
+			}
+		}
+	}
+	if t.err == nil && (t.hasFormat(HLSFormat) || t.hasFormat(CMAFFormat)) {
+		// bandwidths in master written by ffmpeg are estimated from target bitrates
+		// so we rewrite them with the measured ones when all segments are completed
+		t.uploadMasterFile()
+	}
+	if t.err == nil && (t.hasFormat(DASHFormat) || t.hasFormat(CMAFFormat)) {
+		// dash manifest is rewritten after every segment, so we upload it when it is completed
+		t.uploadFile(manifestName)
+	}
+	if t.err == nil && paused != nil {
+		os.Remove(filepath.Join(t.req.StoredFolderPath, pauseName))
+	}
 	err = t.Stop(false)
 	stopTime := datetime.Now()
 	data.TranscodeDuration = int(startTime.DiffAbsInSeconds(stopTime))
+	data.Watchdog = t.watchdogEvents
 	if t.err != nil {
 		err = t.err
 	}
 	return data, err
 }
 
+// run starts ffmpeg with args and waits until it finishes
+func (t *transcoderImpl) run(args []string) {
+	t.threads = make(map[string]*transcodeThread)
+	if t.hasFormat(HLSFormat) {
+		for i := range t.renditions {
+			// base on the required resolutions that request want
+			// so each resolution will be handled by a thread for uploading ts files, updating realtime m3u8 files
+			t.startThread(fmt.Sprintf("stream_%d", i), t.renditions[i].Resolution, &t.files[i])
+		}
+	}
+	if t.hasFormat(DASHFormat) || t.hasFormat(CMAFFormat) {
+		// each dash representation has a thread for uploading its init and media segments, and its playlist for cmaf
+		// the last representation is audio if source has both video and audio
+		for i := range t.renditions {
+			t.startThread(fmt.Sprintf("dash_stream_%d", i), t.renditions[i].Resolution, nil)
+		}
+		if t.separateAudio() {
+			t.startThread(fmt.Sprintf("dash_stream_%d", len(t.renditions)), 0, nil)
+		}
+		t.startThread("dash_manifest", 0, nil)
+	}
+
+	t.execute(transcoder.StageTranscode, float64(t.info.Duration), args)
+}
+
+// runSubtitles convert subtitles to segmented webvtt after the renditions are completed
+// a thread uploads the files of each subtitle, subtitles are not published if ffmpeg fails
+// segmentTime: the segment duration of renditions
+func (t *transcoderImpl) runSubtitles(segmentTime string) {
+	for i := range t.subtitles {
+		// segment muxer doesn't create folders of segments
+		if err := os.MkdirAll(filepath.Join(t.req.StoredFolderPath, subtitleSegmentDir(i)), 0755); err != nil {
+			t.ll.Error("cannot create folder of subtitle", l.Int("index", i), l.Error(err))
+			t.subtitles = nil
+			return
+		}
+	}
+	args := t.commandBuilder.buildSubtitleCommand(t.req.FilePath, t.req.StoredFolderPath, t.subtitles, segmentTime)
+	t.ll.Info("ffmpeg subtitle command", l.String("command", fmt.Sprintf("%v", args)))
+
+	t.threads = make(map[string]*transcodeThread)
+	// timestamps of fmp4 segments start at 0
+	var vttOffset int64 = mpegtsDelay
+	if needFMP4(t.renditions) {
+		vttOffset = 0
+	}
+	for i := range t.subtitles {
+		name := fmt.Sprintf("subs_%d", i)
+		t.startThread(name, 0, nil)
+		t.threads[name].vttOffset = vttOffset
+	}
+	t.execute(transcoder.StageSubtitles, float64(t.info.Duration), args)
+	if t.err != nil {
+		t.subtitles = nil
+		if !stopped(t.err) {
+			t.ll.Error("cannot convert subtitles, they are not published", l.Error(t.err))
+			t.err = nil
+		}
+	}
+}
+
+// runImages generate images of video after the renditions, images are not published if ffmpeg fails
+// image2 muxer logs opening files at debug level, so the files are found in their folders when ffmpeg finishes
+func (t *transcoderImpl) runImages(cmdCfg CommandConfig, options ImageOptions) *transcoder.Images {
+	plan := t.commandBuilder.planImages(cmdCfg, options)
+	for _, dir := range []string{filepath.Dir(thumbnailPattern), filepath.Dir(spritePattern)} {
+		if err := os.MkdirAll(filepath.Join(t.req.StoredFolderPath, dir), 0755); err != nil {
+			t.ll.Error("cannot create folder of images", l.String("folder", dir), l.Error(err))
+			return nil
+		}
+	}
+	var posterScore *ffprobe.FrameScore
+	if plan.poster != nil && options.SmartPoster {
+		if posterScore = t.pickPoster(cmdCfg); posterScore != nil {
+			plan.poster.Time = posterScore.Time
+		}
+		if t.err != nil {
+			return nil
+		}
+	}
+	args := t.commandBuilder.buildImagesCommand(cmdCfg, plan)
+	t.ll.Info("ffmpeg images command", l.String("command", fmt.Sprintf("%v", args)))
+
+	t.threads = make(map[string]*transcodeThread)
+	t.execute(transcoder.StageImages, float64(cmdCfg.SourceDuration), args)
+	if t.err != nil {
+		if !stopped(t.err) {
+			t.ll.Error("cannot generate images, they are not published", l.Error(t.err))
+			t.err = nil
+		}
+		return nil
+	}
+
+	images := &transcoder.Images{}
+	if plan.poster != nil && t.uploadGenerated(plan.poster.Path) {
+		images.Poster = plan.poster
+		images.PosterScore = posterScore
+	}
+	for _, thumbnail := range plan.thumbnails {
+		if t.uploadGenerated(thumbnail.Path) {
+			images.Thumbnails = append(images.Thumbnails, thumbnail)
+		}
+	}
+	if sprite := plan.sprite; sprite != nil {
+		var sheets []transcoder.Image
+		for _, sheet := range sprite.Sheets {
+			if !t.uploadGenerated(sheet.Path) {
+				// sheets are written in order
+				break
+			}
+			sheets = append(sheets, sheet)
+		}
+		sprite.Sheets = sheets
+		index := spriteIndex(sprite, plan.spriteTiles, len(sheets), float64(cmdCfg.SourceDuration))
+		if len(sheets) == 0 {
+			sprite = nil
+		} else if err := os.WriteFile(filepath.Join(t.req.StoredFolderPath, spriteIndexName), []byte(index), 0644); err != nil {
+			t.ll.Error("cannot write index of sprite", l.Error(err))
+			sprite = nil
+		} else {
+			t.uploadFile(spriteIndexName)
+		}
+		images.Sprite = sprite
+	}
+	return images
+}
+
+// runPreview generate the animated preview after the renditions, it is not published if ffmpeg fails
+func (t *transcoderImpl) runPreview(cmdCfg CommandConfig, options PreviewOptions) *transcoder.Preview {
+	p := t.commandBuilder.planPreview(cmdCfg, options)
+	if p == nil {
+		t.ll.Warn("duration of source is unknown, preview is not generated")
+		return nil
+	}
+	args := t.commandBuilder.buildPreviewCommand(cmdCfg, p)
+	t.ll.Info("ffmpeg preview command", l.String("command", fmt.Sprintf("%v", args)))
+
+	t.threads = make(map[string]*transcodeThread)
+	t.execute(transcoder.StagePreview, p.Duration, args)
+	if t.err != nil {
+		if !stopped(t.err) {
+			t.ll.Error("cannot generate preview, it is not published", l.Error(t.err))
+			t.err = nil
+		}
+		return nil
+	}
+	if !t.uploadGenerated(p.Path) {
+		return nil
+	}
+	return p
+}
+
+// pickPoster score candidate frames of source and return the best one for poster
+// nil if no frame can be picked, the poster is taken at its default time then
+func (t *transcoderImpl) pickPoster(cmdCfg CommandConfig) *ffprobe.FrameScore {
+	blur := false
+	if caps, err := t.runner.Capabilities(); err == nil {
+		blur = caps.HasFilter("blurdetect")
+	}
+	var score *ffprobe.FrameScore
+	err := t.probe(transcoder.StageImages, "poster scoring", func(ctx context.Context, advance func()) (err error) {
+		score, err = t.ffprobe.PickPoster(ctx, t.req.FilePath, float64(cmdCfg.SourceDuration), posterCandidates, blur, advance)
+		return err
+	})
+	if stopped(err) {
+		t.err = err
+		return nil
+	} else if err != nil {
+		t.ll.Warn("cannot pick poster by scores, use the default time", l.Error(err))
+		return nil
+	}
+	t.ll.Info("picked poster", l.Object("score", score))
+	return score
+}
+
+// uploadGenerated upload the file if ffmpeg generated it
+func (t *transcoderImpl) uploadGenerated(fileName string) bool {
+	if _, err := os.Stat(filepath.Join(t.req.StoredFolderPath, fileName)); err != nil {
+		t.ll.Warn("file is not generated", l.String("file", fileName), l.Error(err))
+		return false
+	}
+	t.uploadFile(fileName)
+	return true
+}
+
+// execute starts ffmpeg with args and waits until it finishes, the uploading threads must be started
+// stage and duration of output are for progress events
+// ffmpeg is aborted by the watchdog if it stalls or is too slow, the error wraps ErrStalled or ErrTooSlow then
+func (t *transcoderImpl) execute(stage transcoder.Stage, duration float64, args []string) {
+	t.setStage(stage)
+	defer t.setStage("")
+	t.runner.SetDuration(time.Duration(duration * float64(time.Second)))
+	t.runner.SetArgs(args)
+	ctx, abort := context.WithCancelCause(t.ctx)
+	defer abort(nil)
+	w := newWatchdog(t.watchdog, stage, time.Now())
+	done := t.runner.RunContext(ctx)
+	logs := t.runner.Logs()
+
+	t.handleProcess(done, logs, w, abort) // handles logs of ffmpeg and controls uploading threads
+	t.watchdogEvents = append(t.watchdogEvents, w.events...)
+}
+
+// setStage set the stage which ffmpeg is running
+func (t *transcoderImpl) setStage(stage transcoder.Stage) {
+	t.stageMu.Lock()
+	defer t.stageMu.Unlock()
+	t.stage = stage
+}
+
+// liveInput input is a live stream, which is read as long as it is streamed
+func liveInput(input string) bool {
+	input = strings.ToLower(input)
+	for _, scheme := range liveSchemes {
+		if strings.HasPrefix(input, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// stopped ffmpeg is stopped by cancellation, timeout or Stop, it didn't fail by itself
+// the job is not retried and the next stages are not run
+// an abort of watchdog is a failure of the stage, so an optional stage which is aborted is not published
+func stopped(err error) bool {
+	return (commander.IsKind(err, commander.Canceled) || commander.IsKind(err, commander.Timeout)) && !aborted(err)
+}
+
+// retrySoftware check if the failed job should be retried with software encoder
+// only a hardware encoder which cannot start before writing any file is retried,
+// the other failures happen to software encoder in the same way
+func retrySoftware(err error, openedFiles int) bool {
+	return openedFiles == 0 && errors.Is(err, ffmpegrunner.ErrHWAccelInit)
+}
+
+// separateAudio audio is a separate representation of dash, which is not in the ones of video
+func (t *transcoderImpl) separateAudio() bool {
+	return len(t.renditions) > 0 && !t.renditions[0].NoVideo && !t.renditions[0].NoAudio
+}
+
+// outputResolutions the resolutions of output, in decreasing order
+func (t *transcoderImpl) outputResolutions() []resolution.Resolution {
+	var res []resolution.Resolution
+	for _, r := range t.renditions {
+		if r.NoVideo {
+			continue
+		}
+		if len(res) > 0 && r.Resolution >= res[len(res)-1] {
+			// ladder of next codec
+			break
+		}
+		res = append(res, r.Resolution)
+	}
+	return res
+}
+
+// outputSubtitles the subtitles which are published
+func (t *transcoderImpl) outputSubtitles() []transcoder.Subtitle {
+	res := make([]transcoder.Subtitle, 0, len(t.subtitles))
+	for i, s := range t.subtitles {
+		res = append(res, transcoder.Subtitle{
+			Name:     s.name(i),
+			Language: s.Language,
+			Playlist: subtitlePlaylist(i),
+			Embedded: s.FilePath == "",
+		})
+	}
+	return res
+}
+
+func (t *transcoderImpl) outputRenditions() []transcoder.Rendition {
+	enc := t.commandBuilder.chooseEncoder(t.encoder)
+	res := make([]transcoder.Rendition, 0, len(t.renditions))
+	for _, r := range t.renditions {
+		o := transcoder.Rendition{
+			Resolution: r.Resolution,
+			Codec:      string(r.Codec),
+			Codecs:     r.codecsString(enc, t.info),
+			Width:      r.Width,
+			Height:     r.Height,
+			FrameRate:  r.FrameRate,
+			Copy:       r.Copy,
+		}
+		if !r.Copy {
+			o.VideoBitrate = int(r.bitRate.bitRate)
+		}
+		if r.Audio != nil {
+			o.Language = r.Audio.Language
+		}
+		res = append(res, o)
+	}
+	return res
+}
+
+// startThread start the thread which uploads files of stream
+func (t *transcoderImpl) startThread(streamName string, res resolution.Resolution, files *renditionFiles) {
+	t.wg.Add(1)
+	th := newThread(t.req.StoredFolderPath, t.req.FolderName, t.cfg.ClearAfterStream, t.outputChan, t.wg)
+	th.files = files
+	t.threads[streamName] = th
+	th.run()
+	t.ll.Info("start thread", l.Int64("resolution", int64(res)),
+		l.String("stream_name", streamName), l.Int64("next_segment", 0))
+}
+
+// hasFormat check if the output format is requested, hls is the default one
+func (t *transcoderImpl) hasFormat(format OutputFormat) bool {
+	if len(t.formats) == 0 {
+		return format == HLSFormat
+	}
+	for _, f := range t.formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// chooseEncoder choose the encoder which ffmpeg binary can run
+// the requested encoder is used if ffmpeg supports it, otherwise fallback to software encoder
+// report is filled with the reason of choice and the capabilities of ffmpeg
+// an error is returned if ffmpeg supports neither the requested encoder nor software encoder
+func (t *transcoderImpl) chooseEncoder(report *transcoder.EncoderReport) (EncoderName, error) {
+	requested := t.commandBuilder.chooseEncoder(EncoderName(t.req.Encoder))
+	report.Requested = string(requested.Name())
+	report.Used = string(requested.Name())
+
+	caps, err := t.runner.Capabilities()
+	if err != nil {
+		// we don't know what ffmpeg supports, try the requested one and rely on fallback when it fails
+		t.ll.Error("cannot get ffmpeg capabilities", l.Error(err))
+		report.Reason = "cannot probe ffmpeg capabilities: " + err.Error()
+		return requested.Name(), nil
+	}
+	report.HWAccels = caps.HWAccels
+	report.Encoders = caps.Encoders
+
+	if err = requested.Check(caps, t.jobCodecs()); err != nil {
+		if requested.Name() == SoftwareEncoder {
+			return "", fmt.Errorf("%s is not supported: %w", requested.Name(), err)
+		}
+		if swErr := t.checkSoftware(); swErr != nil {
+			return "", fmt.Errorf("%s is not supported: %w, and %s is not supported: %w",
+				requested.Name(), err, SoftwareEncoder, swErr)
+		}
+		report.Used = string(SoftwareEncoder)
+		report.Reason = fmt.Sprintf("%s is not supported: %s", requested.Name(), err)
+		t.ll.Warn("requested encoder is not supported, use software encoder",
+			l.String("encoder", report.Requested), l.Error(err))
+		return SoftwareEncoder, nil
+	}
+	report.Reason = fmt.Sprintf("%s is supported by ffmpeg", requested.Name())
+	return requested.Name(), nil
+}
+
+// checkSoftware check if ffmpeg can run software encoder for codecs of job, it is the fallback of hardware encoder
+func (t *transcoderImpl) checkSoftware() error {
+	caps, err := t.runner.Capabilities()
+	if err != nil {
+		return err
+	}
+	enc, _ := GetEncoder(SoftwareEncoder)
+	if err = enc.Check(caps, t.jobCodecs()); err != nil {
+		t.ll.Warn("software encoder is not supported", l.Error(err))
+	}
+	return err
+}
+
+// jobCodecs the requested codecs, h264 is the default one
+func (t *transcoderImpl) jobCodecs() []Codec {
+	if len(t.codecs) == 0 {
+		return []Codec{H264}
+	}
+	return t.codecs
+}
+
 // Stop if we want to stop or pause transcoding of stream, call to this thread
-// isPause: is pausing or stopping transcoding
+// isPause: is pausing or stopping transcoding, only transcoding of renditions of hls jobs without encryption can be paused
 func (t *transcoderImpl) Stop(isPause bool) error {
+	if isPause {
+		// the stage doesn't change until pausing is set, so a job is paused only in transcoding stage
+		t.stageMu.Lock()
+		canPause := t.canPause() && t.stage == transcoder.StageTranscode
+		if canPause {
+			t.pausing.Store(true)
+		}
+		t.stageMu.Unlock()
+		if !canPause {
+			return errors.New("only transcoding of hls renditions without encryption can be paused")
+		}
+	}
 	if t.runner.IsRunning() {
 		if err := t.runner.Stop(); err != nil {
 			// stop ffmpeg command
@@ -153,10 +746,42 @@ func (t *transcoderImpl) Output() chan transcoder.UploadFile {
 	return t.outputChan
 }
 
+func (t *transcoderImpl) Progress() chan transcoder.Progress {
+	return t.progressChan
+}
+
+// reportProgress send progress of ffmpeg to progress channel
+// the event is dropped if channel is full, so a slow receiver doesn't block the logs of ffmpeg
+func (t *transcoderImpl) reportProgress(p *ffmpegrunner.FrameProgress) {
+	t.ll.Trace("progress message", l.String("msg", p.ToString()))
+	event := transcoder.Progress{
+		Stage:   t.stage,
+		Frame:   p.FramesProcessed,
+		FPS:     p.FPS,
+		Bitrate: p.Bitrate,
+		Time:    p.CurrentTime.Seconds(),
+		Speed:   p.Speed,
+		Percent: p.Progress,
+		ETA:     -1,
+		Ended:   p.Ended,
+	}
+	if p.ETA >= 0 {
+		event.ETA = p.ETA.Seconds()
+	}
+	select {
+	case t.progressChan <- event:
+	default:
+	}
+}
+
 // handleProcess read logs of ffmpeg and controls uploading threads
 // done: channel for done signal
 // logs: channel for receiving logs of ffmpeg
-func (t *transcoderImpl) handleProcess(done chan error, logs chan ffmpegrunner.IProgress) {
+// w: watchdog of ffmpeg, abort is called with the reason when it stalls or is too slow
+func (t *transcoderImpl) handleProcess(done chan error, logs chan ffmpegrunner.IProgress, w *watchdog,
+	abort context.CancelCauseFunc) {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case err := <-done:
@@ -165,6 +790,14 @@ func (t *transcoderImpl) handleProcess(done chan error, logs chan ffmpegrunner.I
 				t.err = err
 				t.ll.Error("error when handle process", l.Error(err))
 			}
+			// the logs are read to the end, so the last progress and files are not lost
+			for logs != nil {
+				msg, ok := <-logs
+				if !ok {
+					break
+				}
+				t.handleLog(msg, w)
+			}
 
 			for key := range t.threads {
 				// call stop to all uploading threads
@@ -174,39 +807,71 @@ func (t *transcoderImpl) handleProcess(done chan error, logs chan ffmpegrunner.I
 			t.ll.Info("finished transcode file", l.Object("request", t.req))
 
 			return
-		case msg := <-logs:
-			if msg == nil {
-				continue
+		case now := <-ticker.C:
+			if err := w.check(now); err != nil {
+				t.ll.Error("watchdog aborts ffmpeg", l.String("stage", string(t.stage)), l.Error(err))
+				abort(err)
 			}
-			switch msg.GetType() {
-			case ffmpegrunner.OpeningFile:
-				// if this is the opening file log, we send it to uploading thread that in charging of this file
-				p := msg.(*ffmpegrunner.OpeningFileProgress)
-				t.ll.Trace("opening file message", l.String("file_path", p.FilePath))
-				t.handleOutputFile(p)
-			default:
-				t.ll.Trace("raw message", l.String("msg", msg.ToString()))
+		case msg, ok := <-logs:
+			if !ok {
+				// logs end before done is received
+				logs = nil
+				continue
 			}
+			t.handleLog(msg, w)
 		}
 	}
 }
 
+// handleLog handle a log of ffmpeg, w is told the progress and opened files
+func (t *transcoderImpl) handleLog(msg ffmpegrunner.IProgress, w *watchdog) {
+	if msg == nil {
+		return
+	}
+	switch msg.GetType() {
+	case ffmpegrunner.Frame:
+		p := msg.(*ffmpegrunner.FrameProgress)
+		w.progress(p, time.Now())
+		t.reportProgress(p)
+	case ffmpegrunner.OpeningFile:
+		// if this is the opening file log, we send it to uploading thread that in charging of this file
+		p := msg.(*ffmpegrunner.OpeningFileProgress)
+		t.ll.Trace("opening file message", l.String("file_path", p.FilePath))
+		w.opened(time.Now())
+		t.handleOutputFile(p)
+	default:
+		t.ll.Trace("raw message", l.String("msg", msg.ToString()))
+	}
+}
+
 func (t *transcoderImpl) handleOutputFile(p *ffmpegrunner.OpeningFileProgress) {
 	filePath := p.FilePath
+	t.openedFiles++
 
 	if master := masterRegex.FindStringSubmatch(filePath); len(master) > 1 {
-		// if this is master file, upload it immediately
-		t.uploadMasterFile()
+		// master file is rewritten and uploaded once when all segments are completed
 		return
 	}
-
-	//this is the case of stream file
-	match := streamRegex.FindStringSubmatch(filePath)
-	if len(match) < 2 {
+	var streamName string
+	if manifest := manifestRegex.FindStringSubmatch(filePath); len(manifest) > 1 {
+		// dash manifest is uploaded whenever it is rewritten, the completed one is uploaded again after ffmpeg finished
+		streamName = "dash_manifest"
+	} else if idx := t.hlsRendition(filePath); idx >= 0 {
+		//this is the case of stream file
+		streamName = fmt.Sprintf("stream_%d", idx)
+	} else if match := dashRegex.FindStringSubmatch(filePath); len(match) > 1 {
+		// this is the case of dash segment file
+		streamName = "dash_" + match[1]
+	} else if match = mediaRegex.FindStringSubmatch(filePath); len(match) > 1 {
+		// this is the case of cmaf media playlist
+		streamName = "dash_stream_" + match[1]
+	} else if match = subtitleRegex.FindStringSubmatch(filePath); len(match) > 1 {
+		// this is the case of webvtt playlist or segment
+		streamName = "subs_" + match[1]
+	} else {
 		t.ll.Error("cannot find stream from Path", l.String("file_path", filePath))
 		return
 	}
-	streamName := match[1]
 
 	// we get the in charged thread and send the log to that thread
 	th, ok := t.threads[streamName]
@@ -217,20 +882,32 @@ func (t *transcoderImpl) handleOutputFile(p *ffmpegrunner.OpeningFileProgress) {
 	}
 }
 
-// uploadMasterFile upload master file to storage
+// hlsRendition index of the rendition whose hls files has the file, -1 if it is not a hls file
+func (t *transcoderImpl) hlsRendition(filePath string) int {
+	if !t.hasFormat(HLSFormat) {
+		return -1
+	}
+	name, err := filepath.Rel(t.req.StoredFolderPath, strings.TrimSuffix(filePath, ".tmp"))
+	if err != nil {
+		return -1
+	}
+	name = filepath.ToSlash(name)
+	for i, f := range t.files {
+		if f.match(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// uploadMasterFile rewrite master file with bandwidths measured from segments and upload it to storage
+// it must be called after all segments are written
 func (t *transcoderImpl) uploadMasterFile() {
-	time.Sleep(500 * time.Millisecond)
-	fileName := "master.m3u8"
+	fileName := masterName
 	filePath := filepath.Join(t.req.StoredFolderPath, fileName)
-	//content, err := os.ReadFile(filePath)
-	//for i := 0; i < len(t.resolutions); i++ {
-	//	streamName := fmt.Sprintf("stream_%d", i)
-	//	folderName := fmt.Sprintf("%d", t.resolutions[i])
-	//	content = bytes.Replace(content, []byte(streamName), []byte(path.Join(folderName, streamName)), -1)
-	//}
-	//if err = os.WriteFile(filePath, content, 0666); err != nil {
-	//	t.ll.Error("cannot update master file", l.String("file_path", filePath), l.Error(err))
-	//}
+	if err := t.rewriteMaster(filePath); err != nil {
+		t.ll.Error("cannot rewrite master file", l.String("file_path", filePath), l.Error(err))
+	}
 	t.outputChan <- transcoder.UploadFile{
 		Name:      fileName,
 		Path:      filePath,
@@ -238,6 +915,60 @@ func (t *transcoderImpl) uploadMasterFile() {
 	}
 }
 
+// fixPlaylists fix uris of segments in playlists of renditions and upload the changed ones
+// threads upload fixed copies while ffmpeg runs, the playlists themselves are fixed after ffmpeg exits
+func (t *transcoderImpl) fixPlaylists() {
+	for _, f := range t.files {
+		changed, err := f.fixSegmentURIs(t.req.StoredFolderPath)
+		if err != nil {
+			t.ll.Error("cannot fix playlist", l.String("playlist", f.playlist), l.Error(err))
+			continue
+		}
+		if changed {
+			t.uploadFile(f.playlist)
+		}
+	}
+}
+
+// writeIFramePlaylists write an i-frame playlist of each video rendition for trick play when segments are completed
+// i-frames are byte ranges of ts segments, so encrypted segments have no i-frame playlist
+func (t *transcoderImpl) writeIFramePlaylists() {
+	t.iframePlaylists = make([]string, len(t.renditions))
+	if needFMP4(t.renditions) {
+		// i-frames of fmp4 segments need the byte ranges of their moof boxes, which ffprobe doesn't tell
+		t.ll.Info("i-frame playlists are not written for fmp4 segments")
+		return
+	}
+	for i, r := range t.renditions {
+		if r.NoVideo || r.Audio != nil {
+			continue
+		}
+		var name string
+		err := t.probe(transcoder.StageTranscode, "i-frame playlist", func(ctx context.Context, advance func()) (err error) {
+			name, err = t.writeIFramePlaylist(ctx, i, advance)
+			return err
+		})
+		if stopped(err) {
+			t.err = err
+			return
+		} else if err != nil {
+			t.ll.Error("cannot write i-frame playlist", l.Int("index", i), l.Error(err))
+			continue
+		}
+		t.iframePlaylists[i] = name
+		t.uploadFile(name)
+	}
+}
+
+// uploadFile upload the file in stored folder to storage
+func (t *transcoderImpl) uploadFile(fileName string) {
+	t.outputChan <- transcoder.UploadFile{
+		Name:      fileName,
+		Path:      filepath.Join(t.req.StoredFolderPath, fileName),
+		UploadKey: path.Join(t.req.FolderName, fileName),
+	}
+}
+
 // clearStream clear all files of this streaming session
 func (t *transcoderImpl) clearStream() {
 	err := os.RemoveAll(t.req.StoredFolderPath)
@@ -0,0 +1,157 @@
+package v5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"transcode/pkg/config"
+	ffmpegrunner "transcode/pkg/ffmpeg_runner"
+	"transcode/pkg/transcoder"
+
+	"github.com/thnthien/great-deku/l"
+)
+
+var (
+	ErrStalled = errors.New("no progress is made")                  // no frame is encoded and no file is opened, or ffprobe outputs nothing, for stall timeout
+	ErrTooSlow = errors.New("ffmpeg encoded slower than min speed") // speed stayed below min speed for slow timeout
+)
+
+const (
+	defaultStallTimeout = 120 * time.Second
+	defaultSlowTimeout  = 60 * time.Second
+	watchdogInterval    = time.Second // how often the watchdog checks a running ffmpeg
+)
+
+// WatchdogOptions limits of a running ffmpeg, it is aborted when they are exceeded
+type WatchdogOptions struct {
+	StallTimeout time.Duration // 0 if stalls are not checked
+	MinSpeed     float64       // multiplier of realtime, 0 if speed is not checked
+	SlowTimeout  time.Duration
+}
+
+// NewWatchdogOptions read limits of watchdog from config and fill the defaults
+func NewWatchdogOptions(cfg config.ServerConfig) WatchdogOptions {
+	o := WatchdogOptions{
+		StallTimeout: time.Duration(cfg.StallTimeout) * time.Second,
+		MinSpeed:     cfg.MinSpeed,
+		SlowTimeout:  time.Duration(cfg.SlowTimeout) * time.Second,
+	}
+	if cfg.StallTimeout == 0 {
+		o.StallTimeout = defaultStallTimeout
+	} else if cfg.StallTimeout < 0 {
+		o.StallTimeout = 0
+	}
+	if o.MinSpeed < 0 {
+		o.MinSpeed = 0
+	}
+	if o.SlowTimeout <= 0 {
+		o.SlowTimeout = defaultSlowTimeout
+	}
+	return o
+}
+
+// watchdog tracks progress of a stage, ffmpeg advances when it encodes a frame, reaches a later time or opens a file
+type watchdog struct {
+	options   WatchdogOptions
+	stage     transcoder.Stage
+	advanced  time.Time // last time ffmpeg advanced
+	frame     int64
+	time      time.Duration // time of output which ffmpeg reached
+	speed     float64
+	slowSince time.Time // zero if speed is not below min speed
+	aborted   bool
+	events    []transcoder.WatchdogEvent
+}
+
+func newWatchdog(options WatchdogOptions, stage transcoder.Stage, now time.Time) *watchdog {
+	return &watchdog{options: options, stage: stage, advanced: now}
+}
+
+// progress record a progress block of ffmpeg
+// speed of ffmpeg is the average since it started, so it is slow only when the most of encoding is slow
+func (w *watchdog) progress(p *ffmpegrunner.FrameProgress, now time.Time) {
+	if p.FramesProcessed > w.frame || p.CurrentTime > w.time {
+		w.advanced = now
+	}
+	w.frame = max(w.frame, p.FramesProcessed)
+	w.time = max(w.time, p.CurrentTime)
+	if p.Speed <= 0 {
+		return
+	}
+	w.speed = p.Speed
+	if w.options.MinSpeed <= 0 {
+		return
+	}
+	if w.speed < w.options.MinSpeed && w.slowSince.IsZero() {
+		w.slowSince = now
+		w.report(transcoder.WatchdogSlow, fmt.Sprintf("speed %.2fx is below %.2fx", w.speed, w.options.MinSpeed))
+	} else if w.speed >= w.options.MinSpeed && !w.slowSince.IsZero() {
+		w.slowSince = time.Time{}
+		w.report(transcoder.WatchdogRecovered, fmt.Sprintf("speed %.2fx is back to %.2fx", w.speed, w.options.MinSpeed))
+	}
+}
+
+// opened record that ffmpeg opened a file for writing
+func (w *watchdog) opened(now time.Time) {
+	w.advanced = now
+}
+
+// check return the reason to abort ffmpeg, it is returned only once
+func (w *watchdog) check(now time.Time) error {
+	if w.aborted {
+		return nil
+	}
+	var err error
+	if stall := now.Sub(w.advanced); w.options.StallTimeout > 0 && stall >= w.options.StallTimeout {
+		err = fmt.Errorf("%w for %s", ErrStalled, stall.Round(time.Second))
+	} else if slow := now.Sub(w.slowSince); !w.slowSince.IsZero() && slow >= w.options.SlowTimeout {
+		err = fmt.Errorf("%w %.2fx for %s, speed is %.2fx", ErrTooSlow, w.options.MinSpeed, slow.Round(time.Second), w.speed)
+	}
+	if err != nil {
+		w.aborted = true
+		w.report(transcoder.WatchdogAbort, err.Error())
+	}
+	return err
+}
+
+func (w *watchdog) report(action transcoder.WatchdogAction, reason string) {
+	w.events = append(w.events, transcoder.WatchdogEvent{
+		Stage:  w.stage,
+		Action: action,
+		Reason: reason,
+		Frame:  w.frame,
+		Time:   w.time.Seconds(),
+		Speed:  w.speed,
+	})
+}
+
+// aborted ffmpeg or ffprobe is stopped by the watchdog
+func aborted(err error) bool {
+	return errors.Is(err, ErrStalled) || errors.Is(err, ErrTooSlow)
+}
+
+// probe run a ffprobe step of stage under the watchdog
+// run calls advance whenever ffprobe outputs, the step is aborted with ErrStalled if it doesn't advance for stall timeout
+func (t *transcoderImpl) probe(stage transcoder.Stage, step string, run func(ctx context.Context, advance func()) error) error {
+	ctx, abort := context.WithCancelCause(t.ctx)
+	defer abort(nil)
+	advance := func() {}
+	if t.watchdog.StallTimeout > 0 {
+		stall := time.AfterFunc(t.watchdog.StallTimeout, func() {
+			abort(fmt.Errorf("%w for %s, %s has no output", ErrStalled, t.watchdog.StallTimeout, step))
+		})
+		defer stall.Stop()
+		advance = func() { stall.Reset(t.watchdog.StallTimeout) }
+	}
+	err := run(ctx, advance)
+	if aborted(err) {
+		t.ll.Error("watchdog aborts ffprobe", l.String("stage", string(stage)), l.String("step", step), l.Error(err))
+		t.watchdogEvents = append(t.watchdogEvents, transcoder.WatchdogEvent{
+			Stage:  stage,
+			Action: transcoder.WatchdogAbort,
+			Reason: context.Cause(ctx).Error(),
+		})
+	}
+	return err
+}